@@ -6,15 +6,29 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 
+	"github.com/CrazeeGhost/stalkerhek/dvr"
+	"github.com/CrazeeGhost/stalkerhek/hls"
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 	"github.com/CrazeeGhost/stalkerhek/webui"
 )
 
 var flagConfig = flag.String("config", "stalkerhek.yml", "path to the config file")
+var flagPlaylistGroups = flag.String("playlist-groups", webui.PlaylistGroupsProfile, "group titles of aggregated /playlist.m3u: 'profile' (prefixed with profile name) or 'genre' (merged)")
+var flagData = flag.String("data", "data", "directory for persistent data such as logo cache, recordings and bandwidth counters")
+var flagLogoTTL = flag.Duration("logo-ttl", hls.DefaultLogoTTL, "time after which cached logos are revalidated upstream")
+var flagLogoSize = flag.Int("logo-size", 0, "resize logos to fit this many pixels (0 serves them as they are)")
+var flagLogoDir = flag.String("logo-dir", "", "directory of local logo images, preferred over portal's logos")
+var flagLogoMap = flag.String("logo-map", "", "YAML file mapping channel title regexes or tvg-ids to files in -logo-dir")
+var flagTLSCert = flag.String("tls-cert", "", "PEM certificate file of the WebUI's HTTPS listener")
+var flagTLSKey = flag.String("tls-key", "", "PEM private key file of the WebUI's HTTPS listener")
+var flagTLSAuto = flag.Bool("tls-auto", false, "serve the WebUI over HTTPS with a certificate of a self-signed CA kept in <data>/tls")
+var flagSegmentCache = flag.Int64("segment-cache-mb", hls.DefaultSegmentCacheSize>>20, "memory budget of HLS segment cache in MiB (0 disables caching)")
+var flagSegmentMax = flag.Int64("segment-max-mb", hls.DefaultSegmentMaxSize>>20, "size limit of a single buffered HLS segment in MiB; larger responses are passed through")
 
 // Global context for graceful shutdown
 var (
@@ -28,6 +42,18 @@ func main() {
 
 	flag.Parse()
 
+	hls.SetSegmentCacheSize(*flagSegmentCache << 20)
+	hls.SetSegmentMaxSize(*flagSegmentMax << 20)
+	hls.SetLogoCache(filepath.Join(*flagData, "logos"), *flagLogoTTL, *flagLogoSize)
+	if err := hls.SetLogoPack(*flagLogoDir, *flagLogoMap); err != nil {
+		log.Fatalln("Unable to load logo pack:", err)
+	}
+	if err := webui.SetPlaylistGroups(*flagPlaylistGroups); err != nil {
+		log.Fatalln(err)
+	}
+	stalker.SetCertDir(filepath.Join(*flagData, "tls"))
+	webui.SetTLS(stalker.ListenerTLS{CertFile: *flagTLSCert, KeyFile: *flagTLSKey, Auto: *flagTLSAuto})
+
 	// Initialize in-memory configuration; WebUI will collect portal URL and MAC.
 	c := &stalker.Config{
 		Portal: &stalker.Portal{
@@ -42,6 +68,14 @@ func main() {
 		},
 	}
 
+	if err := hls.InitBandwidth(ctx, filepath.Join(*flagData, "bandwidth.json")); err != nil {
+		log.Println("Bandwidth counters are not persisted:", err)
+	}
+
+	if err := dvr.Init(ctx, filepath.Join(*flagData, "recordings")); err != nil {
+		log.Println("Recordings are disabled:", err)
+	}
+
 	// Start WebUI and keep it running
 	log.Println("Starting WebUI on :4400 ...")
 	go webui.StartWithContext(ctx, c, make(chan struct{})) // ready ignored
@@ -64,5 +98,6 @@ func main() {
 	log.Println("Shutdown signal received, stopping services...")
 	cancel()
 	wg.Wait()
+	hls.SaveBandwidth()
 	log.Println("All services stopped gracefully")
 }
@@ -0,0 +1,393 @@
+// Package dvr records live channels of running profiles to disk on schedule.
+package dvr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+// Recording statuses
+const (
+	StatusScheduled = "scheduled"
+	StatusRecording = "recording"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+const (
+	retryMinDelay = 2 * time.Second  // First retry after upstream drop
+	retryMaxDelay = 30 * time.Second // Retry delay doubles up to this
+)
+
+// Recording is a scheduled, running or finished recording of a channel.
+type Recording struct {
+	ID        int       `json:"id"`
+	ProfileID int       `json:"profile_id"`
+	Channel   string    `json:"channel"` // Channel title as shown in profile's playlist
+	Title     string    `json:"title"`   // Programme title
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Status    string    `json:"status"`
+	File      string    `json:"file"` // File name in recordings directory
+	Size      int64     `json:"size"` // Bytes written so far
+	Retries   int       `json:"retries"`
+	Error     string    `json:"error,omitempty"` // Last upstream error
+}
+
+var (
+	mu         sync.Mutex
+	baseCtx    = context.Background()
+	dir        string
+	recordings = map[int]*Recording{}
+	cancels    = map[int]context.CancelFunc{} // Recordings that are waiting for start or running
+	nextID     = 1
+
+	recordStream = hls.Record // Writes channel's live stream until it ends or ctx is done
+)
+
+// Init loads recordings kept in 'recordingsDir' and schedules pending ones. Recordings that were
+// interrupted by shutdown continue if their end time has not passed yet. Once ctx is done, running
+// recordings stop without changing their status, so they can continue after restart.
+func Init(ctx context.Context, recordingsDir string) error {
+	if err := os.MkdirAll(recordingsDir, 0o755); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	baseCtx, dir = ctx, recordingsDir
+
+	content, err := ioutil.ReadFile(indexFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		var arr []*Recording
+		if err := json.Unmarshal(content, &arr); err != nil {
+			return errors.New("recordings index: " + err.Error())
+		}
+		for _, r := range arr {
+			recordings[r.ID] = r
+			if r.ID >= nextID {
+				nextID = r.ID + 1
+			}
+		}
+	}
+
+	for _, r := range recordings {
+		if r.Status != StatusScheduled && r.Status != StatusRecording {
+			continue
+		}
+		if time.Now().Before(r.End) {
+			start(r)
+			continue
+		}
+		if r.Size > 0 {
+			r.Status = StatusCompleted
+		} else {
+			r.Status, r.Error = StatusFailed, "stalkerhek was not running at scheduled time"
+		}
+	}
+	hls.SetRecordingsSource(files)
+	return save()
+}
+
+// Schedule adds a new recording. Zero start time starts recording immediately.
+func Schedule(r Recording) (Recording, error) {
+	if r.Channel == "" {
+		return r, errors.New("channel is required")
+	}
+	if r.Start.IsZero() {
+		r.Start = time.Now()
+	}
+	if !r.End.After(r.Start) {
+		return r, errors.New("end must be after start")
+	}
+	if !r.End.After(time.Now()) {
+		return r, errors.New("end is in the past")
+	}
+	if r.Title == "" {
+		r.Title = r.Channel
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dir == "" {
+		return r, errors.New("recordings are not enabled")
+	}
+	r.ID = nextID
+	nextID++
+	r.Status, r.Size, r.Retries, r.Error = StatusScheduled, 0, 0, ""
+	r.File = fmt.Sprintf("%d %s %s.ts", r.ID, safeName(r.Title), r.Start.Local().Format("2006-01-02 1504"))
+	rec := r
+	recordings[r.ID] = &rec
+	start(&rec)
+	return rec, save()
+}
+
+// List returns recordings of a profile (or of all profiles if profileID is 0), newest first.
+func List(profileID int) []Recording {
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]Recording, 0, len(recordings))
+	for _, r := range recordings {
+		if profileID == 0 || r.ProfileID == profileID {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.After(out[j].Start)
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out
+}
+
+// Get returns a recording by its ID.
+func Get(id int) (Recording, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	r, found := recordings[id]
+	if !found {
+		return Recording{}, false
+	}
+	return *r, true
+}
+
+// Stop ends a scheduled or running recording. Recorded part is kept as a completed recording.
+func Stop(id int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	r, found := recordings[id]
+	if !found {
+		return errors.New("recording not found")
+	}
+	cancel, active := cancels[id]
+	if !active {
+		return errors.New("recording is not scheduled or running")
+	}
+	if r.Size > 0 {
+		r.Status = StatusCompleted
+	} else {
+		r.Status = StatusCancelled
+	}
+	cancel()
+	delete(cancels, id)
+	return save()
+}
+
+// Delete stops a recording if it's active and removes it together with its file.
+func Delete(id int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	r, found := recordings[id]
+	if !found {
+		return errors.New("recording not found")
+	}
+	if cancel, active := cancels[id]; active {
+		r.Status = StatusCancelled
+		cancel()
+		delete(cancels, id)
+	}
+	delete(recordings, id)
+	if err := os.Remove(filepath.Join(dir, r.File)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove recording file: %v", err)
+	}
+	return save()
+}
+
+// start arms a recording: it waits for start time, then records until end time. Must be called
+// with lock held.
+func start(r *Recording) {
+	ctx, cancel := context.WithDeadline(baseCtx, r.End)
+	cancels[r.ID] = cancel
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(r.Start)):
+		}
+		record(ctx, r)
+	}()
+}
+
+// record writes recording to its file, reconnecting after upstream drops, until ctx is done.
+func record(ctx context.Context, r *Recording) {
+	mu.Lock()
+	if ctx.Err() != nil { // Stopped meanwhile
+		mu.Unlock()
+		return
+	}
+	r.Status = StatusRecording
+	path := filepath.Join(dir, r.File)
+	profileID, channel := r.ProfileID, r.Channel
+	save()
+	mu.Unlock()
+
+	log.Printf("Recording '%s' of '%s' started", r.Title, channel)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		finish(ctx, r, err)
+		return
+	}
+	defer f.Close()
+
+	w := &countingWriter{f: f, r: r}
+	var delay time.Duration
+	var lastErr error
+	for {
+		written := w.written
+		lastErr = recordStream(ctx, profileID, channel, w)
+		if ctx.Err() != nil {
+			break
+		}
+
+		delay = retryDelay(delay, w.written > written)
+		log.Printf("Recording '%s' of '%s' interrupted, retrying in %v: %v", r.Title, channel, delay, lastErr)
+		mu.Lock()
+		r.Retries++
+		r.Error = lastErr.Error()
+		mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	finish(ctx, r, lastErr)
+}
+
+// retryDelay returns delay before the next reconnect, given the previous one (0 if there was
+// none). Delay doubles up to retryMaxDelay while reconnects fail, and starts over once stream
+// delivered something, as it was working.
+func retryDelay(prev time.Duration, progressed bool) time.Duration {
+	if prev == 0 || progressed {
+		return retryMinDelay
+	}
+	if prev *= 2; prev > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return prev
+}
+
+// finish sets final status of a recording whose context is done or that failed to start.
+func finish(ctx context.Context, r *Recording, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if baseCtx.Err() != nil {
+		// Shutting down; recording continues after restart
+		save()
+		return
+	}
+	if r.Status != StatusRecording {
+		// Stopped or deleted by user
+		return
+	}
+	delete(cancels, r.ID)
+	switch {
+	case ctx.Err() == nil && err != nil:
+		r.Status, r.Error = StatusFailed, err.Error()
+	case r.Size > 0:
+		r.Status = StatusCompleted
+	default:
+		r.Status = StatusFailed
+		if r.Error == "" {
+			r.Error = "nothing was recorded"
+		}
+	}
+	log.Printf("Recording '%s' of '%s' %s (%d bytes)", r.Title, r.Channel, r.Status, r.Size)
+	save()
+}
+
+// countingWriter writes recording to its file and keeps recording's size up to date.
+type countingWriter struct {
+	f       *os.File
+	r       *Recording
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.written += int64(n)
+	mu.Lock()
+	w.r.Size += int64(n)
+	mu.Unlock()
+	return n, err
+}
+
+// files lists completed recordings of a profile for playlists.
+func files(profileID int) []hls.RecordedFile {
+	var out []hls.RecordedFile
+	for _, r := range List(profileID) {
+		if r.Status != StatusCompleted {
+			continue
+		}
+		mu.Lock()
+		path := filepath.Join(dir, r.File)
+		mu.Unlock()
+		title := r.Title + " (" + r.Start.Local().Format("2006-01-02 15:04") + ")"
+		out = append(out, hls.RecordedFile{ID: strconv.Itoa(r.ID), Title: title, Path: path})
+	}
+	return out
+}
+
+func indexFile() string {
+	return filepath.Join(dir, "recordings.json")
+}
+
+// save writes recordings index to disk. Must be called with lock held.
+func save() error {
+	arr := make([]*Recording, 0, len(recordings))
+	for _, r := range recordings {
+		arr = append(arr, r)
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].ID < arr[j].ID })
+	content, err := json.MarshalIndent(arr, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := indexFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0o644); err != nil {
+		log.Printf("Unable to save recordings: %v", err)
+		return err
+	}
+	return os.Rename(tmp, indexFile())
+}
+
+// safeName makes title usable as a file name.
+func safeName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, title)
+	name = strings.Trim(name, " .")
+	if r := []rune(name); len(r) > 80 {
+		name = string(r[:80])
+	}
+	if name == "" {
+		name = "recording"
+	}
+	return name
+}
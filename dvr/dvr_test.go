@@ -0,0 +1,105 @@
+package dvr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		prev       time.Duration
+		progressed bool
+		want       time.Duration
+	}{
+		{"first retry", 0, false, retryMinDelay},
+		{"first retry after data", 0, true, retryMinDelay},
+		{"doubles", retryMinDelay, false, 2 * retryMinDelay},
+		{"keeps doubling", 4 * retryMinDelay, false, 8 * retryMinDelay},
+		{"capped", 8 * retryMinDelay, false, retryMaxDelay},
+		{"stays capped", retryMaxDelay, false, retryMaxDelay},
+		{"starts over after data", retryMaxDelay, true, retryMinDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryDelay(tt.prev, tt.progressed); got != tt.want {
+				t.Errorf("retryDelay(%v, %v) = %v, want %v", tt.prev, tt.progressed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recordingsDir := t.TempDir()
+	if err := Init(ctx, recordingsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upstream drops after the first chunk, then streams until recording ends
+	var callsMu sync.Mutex
+	calls := 0
+	recordStream = func(ctx context.Context, profileID int, channel string, w io.Writer) error {
+		callsMu.Lock()
+		calls++
+		call := calls
+		callsMu.Unlock()
+		if call == 1 {
+			w.Write([]byte("abc"))
+			return errors.New("upstream dropped")
+		}
+		w.Write([]byte("def"))
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	r, err := Schedule(Recording{ProfileID: 1, Channel: "News", End: time.Now().Add(retryMinDelay + time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(retryMinDelay + 10*time.Second)
+	for {
+		if r, _ = Get(r.ID); r.Status != StatusScheduled && r.Status != StatusRecording {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recording did not finish, status %s", r.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if r.Status != StatusCompleted || r.Retries != 1 || r.Error != "upstream dropped" || r.Size != 6 {
+		t.Errorf("recording = %+v, want completed after 1 retry with 6 bytes", r)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(recordingsDir, r.File))
+	if err != nil || string(content) != "abcdef" {
+		t.Errorf("recorded %q (%v), want %q", content, err, "abcdef")
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"News at 10", "News at 10"},
+		{"Film: Part 1/2", "Film_ Part 1_2"},
+		{" ..hidden.. ", "hidden"},
+		{"???", "___"},
+		{"", "recording"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			if got := safeName(tt.title); got != tt.want {
+				t.Errorf("safeName(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+		})
+	}
+}
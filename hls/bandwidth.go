@@ -0,0 +1,435 @@
+package hls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bandwidth accounting windows
+const (
+	WindowHourly = "hourly"
+	WindowDaily  = "daily"
+)
+
+const (
+	bandwidthHourlyKeep = 7 * 24 * time.Hour  // Hourly windows are kept this long
+	bandwidthDailyKeep  = 90 * 24 * time.Hour // Daily windows are kept this long
+	bandwidthSaveEvery  = time.Minute
+	bandwidthFlushEvery = time.Second // Pending traffic is added to windows this often
+)
+
+var errQuota = errors.New("daily traffic quota is exceeded")
+
+// usageKey identifies what traffic belongs to. Upstream traffic is shared by all viewers of a
+// channel, so it has no client.
+type usageKey struct {
+	ProfileID int
+	Channel   string // Empty for traffic that doesn't belong to a channel, e.g. playlists
+	Client    string
+}
+
+type usageCounter struct {
+	Upstream   int64
+	Downstream int64
+}
+
+// bandwidthWindows holds counters of windows by their start (unix seconds).
+type bandwidthWindows map[int64]map[usageKey]*usageCounter
+
+// Usage is traffic within a window, aggregated by profile, channel or client.
+type Usage struct {
+	Start           time.Time `json:"start"`
+	ProfileID       int       `json:"profile_id,omitempty"`
+	Channel         string    `json:"channel,omitempty"`
+	Client          string    `json:"client,omitempty"`
+	UpstreamBytes   int64     `json:"upstream_bytes"`   // Read from portal and stream origins
+	DownstreamBytes int64     `json:"downstream_bytes"` // Written to clients
+}
+
+// usageRecord is a counter as it's stored on disk.
+type usageRecord struct {
+	Window     string    `json:"window"`
+	Start      time.Time `json:"start"`
+	ProfileID  int       `json:"profile_id"`
+	Channel    string    `json:"channel,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Upstream   int64     `json:"up"`
+	Downstream int64     `json:"down"`
+}
+
+// bandwidthState holds traffic counters of all profiles.
+type bandwidthState struct {
+	sync.Mutex
+	path   string // File counters are saved to; empty if they are kept in memory only
+	dirty  bool   // Counters changed since last save
+	hourly bandwidthWindows
+	daily  bandwidthWindows
+
+	// Traffic not yet added to windows by key. Streams count every read and write, so they only
+	// add to these atomically instead of taking the lock.
+	pending   sync.Map // usageKey -> *pendingCounter
+	flushOnce sync.Once
+}
+
+// pendingCounter is traffic counted since last flush. Its fields are accessed atomically.
+type pendingCounter struct {
+	upstream   int64
+	downstream int64
+}
+
+var bandwidth = &bandwidthState{hourly: bandwidthWindows{}, daily: bandwidthWindows{}}
+
+// InitBandwidth loads traffic counters from 'path' and saves them there periodically until ctx
+// is done. Counters are kept in memory only if this is not called.
+func InitBandwidth(ctx context.Context, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var records []usageRecord
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &records); err != nil {
+			return errors.New("bandwidth counters: " + err.Error())
+		}
+	}
+
+	bandwidth.Lock()
+	bandwidth.path = path
+	for _, r := range records {
+		windows := bandwidth.hourly
+		if r.Window == WindowDaily {
+			windows = bandwidth.daily
+		}
+		c := windows.counter(r.Start.Unix(), usageKey{r.ProfileID, r.Channel, r.Client})
+		c.Upstream += r.Upstream
+		c.Downstream += r.Downstream
+	}
+	bandwidth.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(bandwidthSaveEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				SaveBandwidth()
+				return
+			case <-ticker.C:
+				SaveBandwidth()
+			}
+		}
+	}()
+	return nil
+}
+
+// SaveBandwidth writes traffic counters to disk if they changed since the last save.
+func SaveBandwidth() {
+	bandwidth.Lock()
+	bandwidth.flush(time.Now())
+	if bandwidth.path == "" || !bandwidth.dirty {
+		bandwidth.Unlock()
+		return
+	}
+	bandwidth.prune(time.Now())
+	records := append(bandwidth.hourly.records(WindowHourly), bandwidth.daily.records(WindowDaily)...)
+	path := bandwidth.path
+	bandwidth.dirty = false
+	bandwidth.Unlock()
+
+	content, err := json.Marshal(records)
+	if err == nil {
+		err = writeFileAtomic(path, content)
+	}
+	if err != nil {
+		log.Printf("Unable to save bandwidth counters: %v", err)
+	}
+}
+
+func (w bandwidthWindows) counter(start int64, key usageKey) *usageCounter {
+	counters, found := w[start]
+	if !found {
+		counters = make(map[usageKey]*usageCounter)
+		w[start] = counters
+	}
+	c, found := counters[key]
+	if !found {
+		c = &usageCounter{}
+		counters[key] = c
+	}
+	return c
+}
+
+func (w bandwidthWindows) records(window string) []usageRecord {
+	var out []usageRecord
+	for start, counters := range w {
+		for k, c := range counters {
+			out = append(out, usageRecord{window, time.Unix(start, 0), k.ProfileID, k.Channel, k.Client, c.Upstream, c.Downstream})
+		}
+	}
+	return out
+}
+
+// prune drops windows that are too old. Must be called with lock held.
+func (b *bandwidthState) prune(now time.Time) {
+	for start := range b.hourly {
+		if now.Sub(time.Unix(start, 0)) > bandwidthHourlyKeep {
+			delete(b.hourly, start)
+		}
+	}
+	for start := range b.daily {
+		if now.Sub(time.Unix(start, 0)) > bandwidthDailyKeep {
+			delete(b.daily, start)
+		}
+	}
+}
+
+// windowStart returns start of hourly or daily window containing t, in local time.
+func windowStart(window string, t time.Time) time.Time {
+	y, m, d := t.Date()
+	if window == WindowDaily {
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+}
+
+// countUsage adds traffic to pending counters, which are added to current windows every
+// bandwidthFlushEvery, and before counters are read.
+func countUsage(key usageKey, upstream, downstream int64) {
+	c, found := bandwidth.pending.Load(key)
+	if !found {
+		c, _ = bandwidth.pending.LoadOrStore(key, &pendingCounter{})
+		bandwidth.flushOnce.Do(func() { go flushBandwidth() })
+	}
+	pc := c.(*pendingCounter)
+	if upstream != 0 {
+		atomic.AddInt64(&pc.upstream, upstream)
+	}
+	if downstream != 0 {
+		atomic.AddInt64(&pc.downstream, downstream)
+	}
+}
+
+// flushBandwidth adds pending traffic to windows periodically, so it lands in the window it
+// was counted in.
+func flushBandwidth() {
+	for now := range time.Tick(bandwidthFlushEvery) {
+		bandwidth.Lock()
+		bandwidth.flush(now)
+		bandwidth.Unlock()
+	}
+}
+
+// flush adds pending traffic to windows containing 'now'. Must be called with lock held.
+func (b *bandwidthState) flush(now time.Time) {
+	hourly, daily := windowStart(WindowHourly, now).Unix(), windowStart(WindowDaily, now).Unix()
+	b.pending.Range(func(k, v interface{}) bool {
+		pc := v.(*pendingCounter)
+		upstream, downstream := atomic.SwapInt64(&pc.upstream, 0), atomic.SwapInt64(&pc.downstream, 0)
+		if upstream == 0 && downstream == 0 {
+			return true
+		}
+		if _, found := b.hourly[hourly]; !found {
+			b.prune(now) // New window, drop old ones
+		}
+		for _, c := range []*usageCounter{b.hourly.counter(hourly, k.(usageKey)), b.daily.counter(daily, k.(usageKey))} {
+			c.Upstream += upstream
+			c.Downstream += downstream
+		}
+		b.dirty = true
+		return true
+	})
+}
+
+// usedToday sums today's traffic of keys accepted by 'match'.
+func usedToday(match func(usageKey) bool) usageCounter {
+	var sum usageCounter
+	bandwidth.Lock()
+	defer bandwidth.Unlock()
+	bandwidth.flush(time.Now())
+	for k, c := range bandwidth.daily[windowStart(WindowDaily, time.Now()).Unix()] {
+		if match(k) {
+			sum.Upstream += c.Upstream
+			sum.Downstream += c.Downstream
+		}
+	}
+	return sum
+}
+
+// GetUsage returns traffic of hourly or daily windows, newest first, aggregated by "profile",
+// "channel" or "client". Traffic of a single profile is returned if profileID is not 0.
+func GetUsage(window, by string, profileID int) ([]Usage, error) {
+	if by != "profile" && by != "channel" && by != "client" {
+		return nil, fmt.Errorf("unknown aggregation '%s'", by)
+	}
+
+	bandwidth.Lock()
+	defer bandwidth.Unlock()
+	bandwidth.flush(time.Now())
+	var windows bandwidthWindows
+	switch window {
+	case WindowHourly:
+		windows = bandwidth.hourly
+	case WindowDaily, "":
+		windows = bandwidth.daily
+	default:
+		return nil, fmt.Errorf("unknown window '%s'", window)
+	}
+	type group struct {
+		start int64
+		key   usageKey
+	}
+	sums := make(map[group]*usageCounter)
+	for start, counters := range windows {
+		for k, c := range counters {
+			if profileID != 0 && k.ProfileID != profileID {
+				continue
+			}
+			g := group{start, usageKey{ProfileID: k.ProfileID}}
+			switch by {
+			case "channel":
+				g.key.Channel = k.Channel
+			case "client":
+				if k.Client == "" {
+					continue // Upstream traffic belongs to no client
+				}
+				g.key = usageKey{Client: k.Client}
+			}
+			sum, found := sums[g]
+			if !found {
+				sum = &usageCounter{}
+				sums[g] = sum
+			}
+			sum.Upstream += c.Upstream
+			sum.Downstream += c.Downstream
+		}
+	}
+
+	out := make([]Usage, 0, len(sums))
+	for g, c := range sums {
+		out = append(out, Usage{
+			Start:           time.Unix(g.start, 0),
+			ProfileID:       g.key.ProfileID,
+			Channel:         g.key.Channel,
+			Client:          g.key.Client,
+			UpstreamBytes:   c.Upstream,
+			DownstreamBytes: c.Downstream,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.After(out[j].Start)
+		}
+		if out[i].UpstreamBytes+out[i].DownstreamBytes != out[j].UpstreamBytes+out[j].DownstreamBytes {
+			return out[i].UpstreamBytes+out[i].DownstreamBytes > out[j].UpstreamBytes+out[j].DownstreamBytes
+		}
+		return out[i].Channel+out[i].Client < out[j].Channel+out[j].Client
+	})
+	return out, nil
+}
+
+// checkQuota returns errQuota if profile's upstream traffic or client's downstream traffic (from
+// all profiles) exceeded its daily quota.
+func (s *server) checkQuota(addr string) error {
+	if quota := s.opts.DailyQuota; quota > 0 {
+		used := usedToday(func(k usageKey) bool { return k.ProfileID == s.opts.ProfileID })
+		if used.Upstream >= quota {
+			return errQuota
+		}
+	}
+	if quota, found := s.clientQuotas.match(addr); found && quota > 0 {
+		used := usedToday(func(k usageKey) bool { return k.Client == addr })
+		if used.Downstream >= quota {
+			return errQuota
+		}
+	}
+	return nil
+}
+
+// meteredTransport counts bodies of upstream responses as traffic of a channel.
+type meteredTransport struct {
+	base http.RoundTripper
+	key  usageKey
+}
+
+func (t meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		resp.Body = meteredBody{resp.Body, t.key}
+	}
+	return resp, err
+}
+
+type meteredBody struct {
+	io.ReadCloser
+	key usageKey
+}
+
+func (b meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		countUsage(b.key, int64(n), 0)
+	}
+	return n, err
+}
+
+type meterContextKey struct{}
+
+// meter attributes downstream traffic of a request.
+type meter struct {
+	key usageKey
+}
+
+// metered counts everything written to clients as their downstream traffic. Stream handlers
+// attribute it to a channel with setMeterChannel.
+func (s *server) metered(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := &meter{key: usageKey{ProfileID: s.opts.ProfileID, Client: clientAddr(r)}}
+		r = r.WithContext(context.WithValue(r.Context(), meterContextKey{}, m))
+		h.ServeHTTP(meteredResponseWriter{w, m}, r)
+	})
+}
+
+// setMeterChannel attributes downstream traffic of request with given context to a channel.
+func setMeterChannel(ctx context.Context, title string) {
+	if m, ok := ctx.Value(meterContextKey{}).(*meter); ok {
+		m.key.Channel = title
+	}
+}
+
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	m *meter
+}
+
+func (mw meteredResponseWriter) Write(p []byte) (int, error) {
+	n, err := mw.ResponseWriter.Write(p)
+	if n > 0 {
+		countUsage(mw.m.key, 0, int64(n))
+	}
+	return n, err
+}
+
+func (mw meteredResponseWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,325 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	broadcastRingSize  = 8 << 20   // Bytes of media kept for viewers that fall behind
+	broadcastJoinLag   = 512 << 10 // New viewers start this many bytes behind live edge, so players fill their buffers quickly
+	broadcastChunkSize = 64 << 10  // Max bytes written to a viewer at once
+	broadcastMaxSkips  = 10        // Viewer that falls out of ring buffer this many times is disconnected
+	tsPacketSize       = 188       // Skips are aligned to MPEG-TS packets
+)
+
+// broadcaster reads a raw media stream from upstream once and fans it out to all viewers of a channel.
+type broadcaster struct {
+	channel *Channel
+
+	ready chan struct{} // Closed once upstream response is received (or failed)
+	err   error         // Upstream error, set before 'ready' is closed
+
+	header http.Header
+	status int
+	body   io.ReadCloser
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ring    []byte
+	written int64 // Total bytes received from upstream; position of live edge
+	viewers int
+	done    bool // Upstream finished or torn down
+}
+
+var (
+	broadcastsMu sync.Mutex
+	broadcasts   = map[*Channel]*broadcaster{}
+)
+
+// joinBroadcast returns running broadcaster of a channel, or starts a new one using 'open' to
+// connect to upstream. Caller must call leave() once done.
+func joinBroadcast(ch *Channel, open func() (*http.Response, error)) (*broadcaster, error) {
+	broadcastsMu.Lock()
+	b, found := broadcasts[ch]
+	if found {
+		b.mu.Lock()
+		if b.done {
+			found = false
+		} else {
+			b.viewers++
+		}
+		b.mu.Unlock()
+	}
+	if !found {
+		b = &broadcaster{
+			channel: ch,
+			ready:   make(chan struct{}),
+			ring:    make([]byte, broadcastRingSize),
+			viewers: 1,
+		}
+		b.cond = sync.NewCond(&b.mu)
+		broadcasts[ch] = b
+	}
+	broadcastsMu.Unlock()
+
+	if !found {
+		b.start(open)
+	}
+
+	<-b.ready
+	if b.err != nil {
+		b.leave()
+		return nil, b.err
+	}
+	return b, nil
+}
+
+func (b *broadcaster) start(open func() (*http.Response, error)) {
+	resp, err := open()
+	if err != nil {
+		b.err = err
+		b.finish()
+		close(b.ready)
+		return
+	}
+	b.header = resp.Header
+	b.status = resp.StatusCode
+	b.body = resp.Body
+	close(b.ready)
+
+	go b.readUpstream()
+}
+
+// readUpstream copies upstream stream into ring buffer until broadcaster is torn down. Dropped
+// upstream connections are replaced using a new link, so viewers keep watching.
+func (b *broadcaster) readUpstream() {
+	defer func() {
+		b.mu.Lock()
+		body := b.body
+		b.mu.Unlock()
+		body.Close()
+	}()
+	buf := make([]byte, 32<<10)
+	failures, connected := 0, time.Now()
+	for {
+		b.mu.Lock()
+		body := b.body
+		b.mu.Unlock()
+		n, err := body.Read(buf)
+		if n > 0 {
+			b.mu.Lock()
+			b.write(buf[:n])
+			b.mu.Unlock()
+			b.cond.Broadcast()
+		}
+		if err != nil {
+			if time.Since(connected) > retryResetAfter {
+				failures = 0
+			}
+			if !b.reconnect(err, &failures) {
+				b.finish()
+				return
+			}
+			connected = time.Now()
+		}
+	}
+}
+
+// reconnect replaces dropped upstream connection. It returns false if broadcaster was torn down
+// or channel's retry budget is used up; 'failures' counts reconnects in a row.
+func (b *broadcaster) reconnect(cause error, failures *int) bool {
+	title := b.channel.StalkerChannel.Title
+	for {
+		if b.isDone() {
+			return false
+		}
+		if *failures >= b.channel.retryBudget {
+			log.Printf("Shared stream of '%s' ended: %v", title, cause)
+			return false
+		}
+		log.Printf("Shared stream of '%s' dropped (%v), reconnecting (retry %d/%d)", title, cause, *failures+1, b.channel.retryBudget)
+		time.Sleep(retryDelay(*failures))
+		*failures++
+		if b.isDone() {
+			return false
+		}
+
+		resp, err := b.channel.reopen()
+		if err != nil {
+			cause = err
+			continue
+		}
+		b.mu.Lock()
+		if b.done {
+			b.mu.Unlock()
+			resp.Body.Close()
+			return false
+		}
+		old := b.body
+		b.body = resp.Body
+		b.mu.Unlock()
+		old.Close()
+		return true
+	}
+}
+
+func (b *broadcaster) isDone() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done
+}
+
+// write appends data to ring buffer. Must be called with 'mu' locked.
+func (b *broadcaster) write(p []byte) {
+	for len(p) > 0 {
+		off := int(b.written % int64(len(b.ring)))
+		n := copy(b.ring[off:], p)
+		b.written += int64(n)
+		p = p[n:]
+	}
+}
+
+// finish marks broadcaster as done, wakes up all viewers and removes it from the registry.
+func (b *broadcaster) finish() {
+	b.mu.Lock()
+	b.done = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+
+	broadcastsMu.Lock()
+	if broadcasts[b.channel] == b {
+		delete(broadcasts, b.channel)
+	}
+	broadcastsMu.Unlock()
+}
+
+// leave unregisters a viewer. Upstream connection is closed once the last viewer leaves.
+func (b *broadcaster) leave() {
+	b.mu.Lock()
+	b.viewers--
+	last := b.viewers == 0
+	if last {
+		b.done = true // Don't let new viewers join a broadcaster that is being torn down
+	}
+	b.mu.Unlock()
+	if !last {
+		return
+	}
+	b.finish()
+	b.mu.Lock()
+	body := b.body
+	b.mu.Unlock()
+	if body != nil {
+		body.Close() // Unblocks readUpstream
+	}
+}
+
+// serve writes shared stream to a single viewer until viewer disconnects or upstream ends.
+func (b *broadcaster) serve(ctx context.Context, w http.ResponseWriter) {
+	addHeaders(b.header, w.Header(), false)
+	w.WriteHeader(b.status)
+	flusher, _ := w.(http.Flusher)
+
+	v := b.newViewer(ctx)
+	defer v.close()
+
+	chunk := make([]byte, broadcastChunkSize)
+	for {
+		n, err := v.Read(chunk)
+		if n > 0 {
+			if _, werr := w.Write(chunk[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err == errSlowViewer {
+				log.Printf("Viewer of '%s' is too slow, disconnecting", b.channel.StalkerChannel.Title)
+			}
+			return
+		}
+	}
+}
+
+var errSlowViewer = errors.New("viewer is too slow")
+
+// viewer reads shared stream at its own pace.
+type viewer struct {
+	b     *broadcaster
+	ctx   context.Context
+	stop  func() bool
+	pos   int64 // Position in shared stream
+	skips int
+}
+
+// newViewer returns reader of shared stream that starts near live edge. Reads fail once ctx is done.
+func (b *broadcaster) newViewer(ctx context.Context) *viewer {
+	v := &viewer{b: b, ctx: ctx}
+
+	// Wake up viewer when it's context is done, even if upstream is stalled
+	v.stop = context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		b.mu.Unlock()
+		b.cond.Broadcast()
+	})
+
+	b.mu.Lock()
+	v.pos = b.written - broadcastJoinLag
+	b.mu.Unlock()
+	if v.pos < 0 {
+		v.pos = 0
+	}
+	v.pos -= v.pos % tsPacketSize
+	return v
+}
+
+func (v *viewer) close() {
+	v.stop()
+}
+
+// Read blocks until shared stream has data for the viewer.
+func (v *viewer) Read(p []byte) (int, error) {
+	b := v.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for v.pos == b.written && !b.done && v.ctx.Err() == nil {
+		b.cond.Wait()
+	}
+	if err := v.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if b.done && v.pos == b.written {
+		return 0, io.EOF
+	}
+
+	// Viewer is too slow and its data was already overwritten - jump closer to live edge
+	if oldest := b.written - int64(len(b.ring)); v.pos < oldest {
+		v.skips++
+		if v.skips > broadcastMaxSkips {
+			return 0, errSlowViewer
+		}
+		v.pos = b.written - int64(len(b.ring))/2
+		v.pos -= v.pos % tsPacketSize
+	}
+
+	n := b.written - v.pos
+	if n > int64(len(p)) {
+		n = int64(len(p))
+	}
+	off := int(v.pos % int64(len(b.ring)))
+	copied := copy(p[:n], b.ring[off:])
+	if int64(copied) < n {
+		copy(p[copied:n], b.ring)
+	}
+	v.pos += n
+	return int(n), nil
+}
@@ -1,6 +1,9 @@
 package hls
 
 import (
+	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,12 +16,9 @@ const (
 	linkTypeMedia   = 2
 )
 
-// Logo stores TV channel logo details.
+// Logo stores TV channel logo details. Logos themselves are kept in logo cache.
 type Logo struct {
-	Mux              *sync.Mutex
-	Link             string // Link to channel's URL
-	Cache            []byte // Actual logo
-	CacheContentType string // Logo type
+	Link string // Link to channel's logo; empty if channel has none
 }
 
 // Channel stores TV channel details.
@@ -38,8 +38,27 @@ type Channel struct {
 	Logo *Logo // Reference to channel's logo
 
 	Genre string // TV channel genre. This field does not require synchronization
+
+	server   *server      // HLS service of channel's profile
+	client   *http.Client // HTTP client of channel's profile, used for all upstream requests
+	prefetch bool         // Prefetch next HLS segment while serving the current one
+
+	retryBudget int // Link refreshes per failed request, and reconnects of shared stream in a row
+
+	failover      *Channel  // Same channel in another profile, used while this one is failing
+	failoverUntil time.Time // Failover expiry; extended on every request
 }
 
+const (
+	linkMaxIdle      = 10 * time.Minute // Links unused this long are replaced before use, as they have likely expired
+	linkExpiryMargin = 10 * time.Second // Links are replaced this long before expiry announced in their query
+	retryMinDelay    = 250 * time.Millisecond
+	retryResetAfter  = 30 * time.Second // Shared stream that ran this long gets its full retry budget back
+)
+
+// Query parameters portals use to announce link expiry as unix time
+var linkExpiryParams = []string{"expires", "expire", "expiry", "exp"}
+
 func (c *Channel) validate() error {
 	if !c.isValid() {
 		newLink, err := c.StalkerChannel.NewLink(false)
@@ -55,17 +74,70 @@ func (c *Channel) validate() error {
 	return nil
 }
 
+// isValid reports whether channel's link can be used. Links are used until upstream rejects them
+// (see serveContentRequest), unless they were not used for a long time or their token expired.
 func (c *Channel) isValid() bool {
-	// If channel has never been accessed
+	// If channel has never been accessed or its link was invalidated
 	if c.lastAccess.IsZero() {
 		return false
 	}
+	if time.Since(c.lastAccess) > linkMaxIdle {
+		return false
+	}
+	for _, link := range []string{c.Link, c.HLSLink} {
+		if expiry, found := linkExpiry(link); found && time.Until(expiry) < linkExpiryMargin {
+			return false
+		}
+	}
+	return true
+}
 
-	// 30 seconds timout for HLS content
-	if c.LinkType == linkTypeHLS {
-		return time.Since(c.lastAccess).Seconds() <= 30
+// invalidate makes the next request of the channel get a new link.
+func (c *Channel) invalidate() {
+	c.Mux.Lock()
+	c.lastAccess = time.Time{}
+	c.Mux.Unlock()
+}
+
+// reopen gets a new link of a raw media channel and connects to it. Used to resume shared stream
+// after upstream drops.
+func (c *Channel) reopen() (*http.Response, error) {
+	c.Mux.Lock()
+	link, err := c.StalkerChannel.NewLink(false)
+	if err == nil {
+		c.Link = link
+		c.lastAccess = time.Now()
+	}
+	c.Mux.Unlock()
+	if err != nil {
+		return nil, err
 	}
+	return response(c.client, link)
+}
 
-	// 5 seconds for everything else
-	return time.Since(c.lastAccess).Seconds() <= 5
+// linkExpiry returns expiry time announced in link's query, if any.
+func linkExpiry(link string) (time.Time, bool) {
+	if link == "" {
+		return time.Time{}, false
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return time.Time{}, false
+	}
+	q := u.Query()
+	for _, name := range linkExpiryParams {
+		// Only values that look like unix seconds, as some portals use these names for durations
+		if v, err := strconv.ParseInt(q.Get(name), 10, 64); err == nil && v > 1e9 && v < 1e10 {
+			return time.Unix(v, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// retryDelay returns delay before retry 'attempt' (starting at 0) of a failed upstream request.
+func retryDelay(attempt int) time.Duration {
+	if attempt > 4 {
+		attempt = 4
+	}
+	return retryMinDelay << uint(attempt)
 }
@@ -1,20 +1,24 @@
 package hls
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
-func handleContent(cr *ContentRequest) {
+// handleContent serves channel's content. Upstream errors are returned (instead of being sent
+// to the client) only if nothing has been written to the client yet, so caller can fail over.
+func handleContent(cr *ContentRequest) error {
 	linkType := cr.ChannelRef.LinkType
 
 	if linkType == linkTypeUnknown {
-		handleContentUnknown(cr)
-		return
+		return handleContentUnknown(cr)
 	}
 
 	// At this point we will no longer modify channel details, so we get a copy of 'ChannelRef'
@@ -24,23 +28,28 @@ func handleContent(cr *ContentRequest) {
 
 	switch linkType {
 	case linkTypeHLS:
-		handleContentHLS(cr)
+		if cr.TSOutput {
+			return handleContentHLSStream(cr)
+		}
+		return handleContentHLS(cr)
 	case linkTypeMedia:
-		handleContentMedia(cr)
+		if cr.HLSOutput {
+			return handleContentSegmenter(cr)
+		}
+		return handleContentMedia(cr)
 	default:
 		http.Error(cr.ResponseWriter, "invalid media type", http.StatusInternalServerError)
+		return nil
 	}
 }
 
 // ####################################################
 
-func handleContentUnknown(cr *ContentRequest) {
-	resp, err := response(cr.ChannelRef.Link)
+func handleContentUnknown(cr *ContentRequest) error {
+	resp, err := response(cr.ChannelRef.client, cr.ChannelRef.Link)
 	if err != nil {
 		cr.ChannelRef.Mux.Unlock()
-		http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
-		log.Println(err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -52,12 +61,12 @@ func handleContentUnknown(cr *ContentRequest) {
 		cr.ChannelRef.HLSLinkRoot = deleteAfterLastSlash(cr.ChannelRef.HLSLink)
 	}
 
-	handleContent(cr)
+	return handleContent(cr)
 }
 
 // ####################################################
 
-func handleContentHLS(cr *ContentRequest) {
+func handleContentHLS(cr *ContentRequest) error {
 	var link string
 	if cr.Suffix == "" {
 		link = cr.Channel.HLSLink
@@ -65,15 +74,72 @@ func handleContentHLS(cr *ContentRequest) {
 		link = cr.Channel.HLSLinkRoot + cr.Suffix
 	}
 
-	resp, err := response(link)
+	// Media segments are shared between viewers through segment cache
+	if cr.Suffix != "" && segments.isSegment(cr.Suffix, link) {
+		seg, call := segments.fetch(cr.Channel.client, link, false)
+		if seg == nil {
+			contentType, err := call.headers()
+			if err != nil {
+				return err
+			}
+			// Upstream might return playlist where segment was expected
+			if getLinkType(contentType) == linkTypeHLS {
+				if seg, err = call.result(link); err != nil {
+					return err
+				}
+			}
+		}
+		if cr.Channel.prefetch {
+			segments.prefetchAfter(cr.Channel.client, link)
+		}
+		if seg != nil {
+			handleSegment(cr, seg, link)
+		} else {
+			streamSegment(cr, call, link)
+		}
+		return nil
+	}
+
+	resp, err := response(cr.Channel.client, link)
 	if err != nil {
-		http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
-		log.Println(err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
 	handleEstablishedContentHLS(cr, resp, link)
+	return nil
+}
+
+// streamSegment writes segment to client while it's being downloaded.
+func streamSegment(cr *ContentRequest, call *segmentCall, link string) {
+	contentType, _ := call.headers()
+	cr.ResponseWriter.Header().Set("Content-Type", contentType)
+	cr.ResponseWriter.WriteHeader(http.StatusOK)
+	n, err := call.copyTo(cr.ResponseWriter)
+	if err == errSegmentTooLarge {
+		err = passThrough(cr.Channel.client, link, n, cr.ResponseWriter)
+	}
+	if err != nil && cr.Request.Context().Err() == nil {
+		log.Printf("Segment of '%s' ended early: %v", cr.Title, err)
+	}
+}
+
+func handleSegment(cr *ContentRequest, seg *segment, link string) {
+	// Upstream might return playlist where segment was expected
+	if getLinkType(seg.contentType) == linkTypeHLS {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{seg.contentType}},
+			Body:       ioutil.NopCloser(bytes.NewReader(seg.data)),
+		}
+		handleEstablishedContentHLS(cr, resp, link)
+		return
+	}
+
+	cr.ResponseWriter.Header().Set("Content-Type", seg.contentType)
+	cr.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(seg.data)))
+	cr.ResponseWriter.WriteHeader(http.StatusOK)
+	cr.ResponseWriter.Write(seg.data)
 }
 
 func handleEstablishedContentHLS(cr *ContentRequest, resp *http.Response, link string) {
@@ -82,12 +148,23 @@ func handleEstablishedContentHLS(cr *ContentRequest, resp *http.Response, link s
 	if strings.HasPrefix(cr.Request.URL.Path, "/iptv/") {
 		prefixBase = "/iptv/"
 	}
-	prefix := "http://" + cr.Request.Host + prefixBase + url.PathEscape(cr.Title) + "/"
+	prefix := requestOrigin(cr.Request) + prefixBase + url.PathEscape(cr.Title) + "/"
 
 	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
 	switch {
 	case contentType == "application/vnd.apple.mpegurl" || contentType == "application/x-mpegurl": // HLS metadata
-		content := rewriteLinks(&resp.Body, prefix, cr.Channel.HLSLinkRoot)
+		body := resp.Body
+		if cr.Variants.active() {
+			lines, err := applyVariants(cr, resp.Body, link)
+			if err != nil {
+				log.Printf("Unable to apply variant policy to '%s': %v", cr.Title, err)
+				http.Error(cr.ResponseWriter, "bad gateway", http.StatusBadGateway)
+				return
+			}
+			body = ioutil.NopCloser(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+		}
+		content, segmentLinks := rewriteLinks(&body, prefix, cr.Channel.HLSLinkRoot)
+		segments.announce(segmentLinks)
 		addHeaders(resp.Header, cr.ResponseWriter.Header(), false)
 		cr.ResponseWriter.WriteHeader(http.StatusOK)
 		fmt.Fprint(cr.ResponseWriter, content)
@@ -98,20 +175,39 @@ func handleEstablishedContentHLS(cr *ContentRequest, resp *http.Response, link s
 
 // ####################################################
 
-func handleContentMedia(cr *ContentRequest) {
-	resp, err := response(cr.Channel.Link)
+// handleContentMedia serves raw media stream. All viewers of the same channel share a single
+// upstream connection.
+func handleContentMedia(cr *ContentRequest) error {
+	b, err := joinBroadcast(cr.ChannelRef, func() (*http.Response, error) {
+		return response(cr.Channel.client, cr.Channel.Link)
+	})
 	if err != nil {
-		http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
-		log.Println(err)
-		return
+		return err
 	}
-	defer resp.Body.Close()
+	defer b.leave()
 
-	handleEstablishedContentMedia(cr, resp)
+	b.serve(cr.Request.Context(), cr.ResponseWriter)
+	return nil
+}
+
+// handleContentSegmenter serves raw media stream as HLS playlist of segments cut out of
+// channel's shared stream.
+func handleContentSegmenter(cr *ContentRequest) error {
+	sg, err := getSegmenter(cr.ChannelRef, func() (*http.Response, error) {
+		return response(cr.Channel.client, cr.Channel.Link)
+	})
+	if err != nil {
+		return err
+	}
+	sg.writePlaylist(cr.ResponseWriter, segmenterPrefix(cr.Request, cr.Title))
+	return nil
 }
 
 func handleEstablishedContentMedia(cr *ContentRequest, resp *http.Response) {
 	addHeaders(resp.Header, cr.ResponseWriter.Header(), true)
 	cr.ResponseWriter.WriteHeader(resp.StatusCode)
-	io.Copy(cr.ResponseWriter, resp.Body)
+	if _, err := io.Copy(cr.ResponseWriter, resp.Body); isStall(err) {
+		// Headers are sent already, so closing the connection lets the player reconnect
+		log.Printf("Closing client of '%s': %v", cr.Title, err)
+	}
 }
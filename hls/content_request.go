@@ -16,17 +16,33 @@ type ContentRequest struct {
 	Suffix     string
 	ChannelRef *Channel
 
+	Primary *Channel // Channel the client asked for; differs from ChannelRef when failover is active
+
+	Variants VariantPolicy // Applied to upstream master playlists
+
+	HLSOutput bool // Raw MPEG-TS channels are served as HLS (see segmenter)
+	TSOutput  bool // HLS channels are served as continuous MPEG-TS (see stitcher)
+
 	Channel Channel
+
+	clientWriter  http.ResponseWriter // Client's response writer and request, before stream admission
+	clientRequest *http.Request
+	release       func() // Ends stream admission of the request
 }
 
 // Returns ContentRequest objected that contains HTTP request, its responseWriter and TV channel reference.
-func getContentRequest(w http.ResponseWriter, r *http.Request, expectedPrefix string) (*ContentRequest, error) {
+func (s *server) getContentRequest(w http.ResponseWriter, r *http.Request, expectedPrefix string) (*ContentRequest, error) {
 	reqPath := strings.Replace(r.URL.RequestURI(), expectedPrefix, "", 1)
 	reqPathParts := strings.SplitN(reqPath, "/", 2)
 	if len(reqPathParts) == 0 {
 		return nil, errors.New("bad request")
 	}
 
+	// Query of a channel request is not part of its title
+	if i := strings.IndexByte(reqPathParts[0], '?'); i > -1 {
+		reqPathParts[0] = reqPathParts[0][:i]
+	}
+
 	// Unescape channel title
 	var err error
 	reqPathParts[0], err = url.PathUnescape(reqPathParts[0])
@@ -34,29 +50,61 @@ func getContentRequest(w http.ResponseWriter, r *http.Request, expectedPrefix st
 		return nil, err
 	}
 
-	// Find channel reference
-	channelRef, ok := playlist[reqPathParts[0]]
-	if !ok {
-		return nil, errors.New("bad request")
-	}
-
 	// /iptv/<channel>
 	if len(reqPathParts) == 1 {
-		return &ContentRequest{
-			ResponseWriter: w,
-			Request:        r,
-			Title:          reqPathParts[0],
-			Suffix:         "",
-			ChannelRef:     channelRef,
-		}, nil
+		return s.newContentRequest(w, r, reqPathParts[0], "")
 	}
 
 	// /iptv/<channel>/<something_more>
+	return s.newContentRequest(w, r, reqPathParts[0], reqPathParts[1])
+}
+
+// newContentRequest returns ContentRequest for a channel with given title.
+func (s *server) newContentRequest(w http.ResponseWriter, r *http.Request, title, suffix string) (*ContentRequest, error) {
+	playlist, _ := s.channels()
+	channelRef, ok := playlist[title]
+	if !ok {
+		return nil, errors.New("bad request")
+	}
+	// Channel requests may override profile's variant policy; queries of other requests belong to upstream
+	variants := s.opts.Variants
+	if suffix == "" {
+		var err error
+		if variants, err = parseVariantQuery(r.URL.Query(), variants); err != nil {
+			return nil, err
+		}
+	}
 	return &ContentRequest{
 		ResponseWriter: w,
 		Request:        r,
-		Title:          reqPathParts[0],
-		Suffix:         reqPathParts[1],
+		Title:          title,
+		Suffix:         suffix,
 		ChannelRef:     channelRef,
+		Primary:        channelRef,
+		Variants:       variants,
+		clientWriter:   w,
+		clientRequest:  r,
 	}, nil
 }
+
+// admit counts the request against stream limit of the profile serving channel 'ch', replacing
+// request's previous admission.
+func (cr *ContentRequest) admit(s *server, ch *Channel) error {
+	cr.end()
+	ctx, sess, release, err := s.admitStream(cr.clientRequest, ch, cr.Title)
+	if err != nil {
+		return err
+	}
+	cr.release = release
+	cr.Request = cr.clientRequest.WithContext(ctx)
+	cr.ResponseWriter = sess.responseWriter(cr.clientWriter)
+	return nil
+}
+
+// end ends stream admission of the request, if it has one.
+func (cr *ContentRequest) end() {
+	if cr.release != nil {
+		cr.release()
+		cr.release = nil
+	}
+}
@@ -0,0 +1,200 @@
+package hls
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// failoverHold defines for how long an idle channel keeps being served from another profile before
+// its own profile is tried again. Every request to the channel extends this period.
+const failoverHold = 2 * time.Minute
+
+var (
+	serversMu sync.RWMutex
+	servers   = map[int]*server{} // Running HLS services by profile ID
+)
+
+func registerServer(s *server) {
+	serversMu.Lock()
+	servers[s.opts.ProfileID] = s
+	serversMu.Unlock()
+}
+
+func unregisterServer(s *server) {
+	serversMu.Lock()
+	if servers[s.opts.ProfileID] == s {
+		delete(servers, s.opts.ProfileID)
+	}
+	serversMu.Unlock()
+}
+
+var (
+	reQualityTags = regexp.MustCompile(`\b(uhd|fhd|hd|sd|4k|hevc|h265|50fps|60fps)\b`)
+	reNonAlnum    = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+// normalizeTitle makes channel titles comparable across portals, e.g. "BBC One HD" and "bbc-one" match.
+func normalizeTitle(title string) string {
+	t := strings.ToLower(title)
+	t = reNonAlnum.ReplaceAllString(t, " ")
+	t = reQualityTags.ReplaceAllString(t, " ")
+	return strings.Join(strings.Fields(t), "")
+}
+
+// matchKeys returns keys by which the same channel can be found in other profiles.
+func matchKeys(ch *stalker.Channel) []string {
+	keys := make([]string, 0, 2)
+	if id := strings.ToLower(strings.TrimSpace(ch.XMLTVID)); id != "" {
+		keys = append(keys, "id:"+id)
+	}
+	if t := normalizeTitle(ch.Title); t != "" {
+		keys = append(keys, "title:"+t)
+	}
+	return keys
+}
+
+// activeFailover returns the channel of another profile that currently serves this channel.
+func (c *Channel) activeFailover() *Channel {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+	if c.failover == nil {
+		return nil
+	}
+	if time.Now().After(c.failoverUntil) {
+		c.failover = nil
+		return nil
+	}
+	c.failoverUntil = time.Now().Add(failoverHold)
+	return c.failover
+}
+
+func (c *Channel) setFailover(alt *Channel) {
+	c.Mux.Lock()
+	c.failover = alt
+	c.failoverUntil = time.Now().Add(failoverHold)
+	c.Mux.Unlock()
+}
+
+// failoverCandidates returns matching channels of other running profiles in preferred order.
+func (s *server) failoverCandidates(primary *Channel) []*Channel {
+	order, ok := s.opts.Failover[primary.Genre]
+	if !ok {
+		order, ok = s.opts.Failover["*"]
+	}
+
+	serversMu.RLock()
+	defer serversMu.RUnlock()
+
+	if !ok {
+		order = make([]int, 0, len(servers))
+		for id := range servers {
+			order = append(order, id)
+		}
+		sort.Ints(order)
+	}
+
+	keys := matchKeys(primary.StalkerChannel)
+	candidates := make([]*Channel, 0, len(order))
+	for _, id := range order {
+		other, found := servers[id]
+		if !found || other == s {
+			continue
+		}
+		other.mu.RLock()
+		for _, key := range keys {
+			if ch, found := other.byMatchKey[key]; found {
+				candidates = append(candidates, ch)
+				break
+			}
+		}
+		other.mu.RUnlock()
+	}
+	return candidates
+}
+
+// failover tries to serve the request from other profiles. Returns true if the client got a response.
+func (s *server) failover(cr *ContentRequest) bool {
+	failed := cr.ChannelRef
+	if failed != cr.Primary {
+		cr.Primary.setFailover(nil) // Failover target itself failed
+	}
+	for _, alt := range s.failoverCandidates(cr.Primary) {
+		if alt == failed {
+			continue
+		}
+
+		// Stream now counts against the limit of alternate's profile
+		if err := cr.admit(s, alt); err != nil {
+			log.Printf("Failover of '%s' to '%s' refused: %v", cr.Title, alt.StalkerChannel.Title, err)
+			continue
+		}
+		cr.ChannelRef = alt
+
+		// Segment names differ between portals, so playlist requests are answered with the entry playlist
+		if strings.HasSuffix(strings.ToLower(cr.Suffix), ".m3u8") {
+			cr.Suffix = ""
+		}
+
+		alt.Mux.Lock()
+		if err := alt.validate(); err != nil {
+			alt.Mux.Unlock()
+			log.Printf("Failover of '%s' to '%s' failed: %v", cr.Title, alt.StalkerChannel.Title, err)
+			continue
+		}
+		// Following requests go to the alternate only once it has proven to work. Streams may
+		// last for hours, so that's once it starts responding rather than once it's done.
+		w := cr.ResponseWriter
+		cr.ResponseWriter = &startWriter{ResponseWriter: w, onStart: func() { cr.Primary.setFailover(alt) }}
+		err := handleContent(cr)
+		cr.ResponseWriter = w
+		if err != nil {
+			log.Printf("Failover of '%s' to '%s' failed: %v", cr.Title, alt.StalkerChannel.Title, err)
+			continue
+		}
+		log.Printf("Channel '%s' served via failover channel '%s'", cr.Title, alt.StalkerChannel.Title)
+		return true
+	}
+
+	cr.Primary.setFailover(nil)
+	return false
+}
+
+// startWriter calls onStart once a successful response starts.
+type startWriter struct {
+	http.ResponseWriter
+	onStart func()
+	started bool
+}
+
+func (w *startWriter) WriteHeader(code int) {
+	if code < http.StatusBadRequest {
+		w.start()
+	}
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *startWriter) Write(p []byte) (int, error) {
+	w.start() // Implicit "200 OK"
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *startWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *startWriter) start() {
+	if !w.started {
+		w.started = true
+		w.onStart()
+	}
+}
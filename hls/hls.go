@@ -11,8 +11,114 @@ import (
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
-var playlist map[string]*Channel
-var sortedChannels []string
+// DefaultRetryBudget is used if Options.RetryBudget is not set.
+const DefaultRetryBudget = 3
+
+// Options holds per-profile settings of HLS service.
+type Options struct {
+	ProfileID   int    // Profile this service belongs to
+	ProfileName string // Used in logs only
+	Bind        string // Address to listen on
+
+	// TLS makes the service listen on HTTPS
+	TLS stalker.ListenerTLS
+
+	// Access restricts clients of the service. Its token is propagated to all generated links.
+	Access stalker.AccessRules
+
+	// Transport is used for all requests to stream origins and logos. Default transport is used if nil.
+	Transport http.RoundTripper
+
+	// Failover maps channel group (genre) to the ordered list of profile IDs that should be tried
+	// when this profile is unable to serve a channel. Key "*" applies to groups without own entry.
+	// If no entry matches, all other running profiles are tried in order of their IDs.
+	Failover map[string][]int
+
+	// Prefetch makes HLS service download the next segment announced in media playlist while
+	// the current one is being served.
+	Prefetch bool
+
+	// HLSOutput makes playlists advertise all channels as HLS. Raw MPEG-TS channels are cut into
+	// segments locally, so clients that only support HLS can play them.
+	HLSOutput bool
+
+	// Variants filters or pins variants of upstream master playlists. Channel requests may
+	// override it with query parameters (see parseVariantQuery).
+	Variants VariantPolicy
+
+	// EPGURL is advertised in playlist header (url-tvg, x-tvg-url), so players can load XMLTV guide.
+	EPGURL string
+
+	// PlayerUserAgent is advertised to players for every channel via #EXTVLCOPT, for setups where
+	// something between player and this service filters by user agent.
+	PlayerUserAgent string
+
+	// RetryBudget is how many times a new link is requested when upstream rejects the current
+	// one, before the request fails over or fails. Shared raw streams reconnect this many times in
+	// a row after upstream drops. Zero means DefaultRetryBudget; negative disables retries.
+	RetryBudget int
+
+	// ConnectTimeout, FirstByteTimeout and IdleTimeout limit how long stream fetching waits for a
+	// connection to upstream, for its response headers, and for more data mid-stream. Stalls are
+	// counted per channel and handled like other upstream failures (see RetryBudget). Zero means
+	// the Default* value; negative disables the timeout.
+	ConnectTimeout   time.Duration
+	FirstByteTimeout time.Duration
+	IdleTimeout      time.Duration
+
+	// ProbeInterval enables background health probing: every channel's link is resolved and its
+	// stream opened once per this interval. Channels that fail are grouped under "Offline".
+	ProbeInterval time.Duration
+
+	// HideOffline drops channels that failed their last probe from playlists.
+	HideOffline bool
+
+	// MaxStreams limits concurrent upstream streams of this profile, as portals allow only a few
+	// per MAC. Viewers of the same channel share a stream. Zero means no limit.
+	MaxStreams int
+
+	// StreamPolicy decides what happens when a new stream would exceed MaxStreams: PolicyReject
+	// (default), PolicyPreemptOldest or PolicyPreemptPriority.
+	StreamPolicy string
+
+	// ClientPriorities maps client IP address or CIDR network to its priority for
+	// PolicyPreemptPriority. Key "dvr" applies to recordings. Unlisted clients have priority 0.
+	ClientPriorities map[string]int
+
+	// DailyQuota refuses new streams once profile's upstream traffic of the day reaches this many
+	// bytes. Zero means no quota.
+	DailyQuota int64
+
+	// ClientQuotas maps client IP address or CIDR network to bytes it may receive per day from all
+	// profiles. New streams of clients over their quota are refused.
+	ClientQuotas map[string]int64
+}
+
+// server holds the state of a single HLS service (one per profile).
+type server struct {
+	opts   Options
+	client *http.Client // Client used for upstream requests of this profile
+
+	mu             sync.RWMutex // Guards channel lists below, which are replaced on channel list updates
+	playlist       map[string]*Channel
+	sortedChannels []string
+
+	byMatchKey map[string]*Channel // Channels indexed by matchKey(), used by failover
+
+	probesMu sync.RWMutex
+	probes   map[string]ProbeResult // Channel title -> result of its last health probe
+
+	activeRequests int32 // Stream requests being served; accessed atomically
+	lastRequest    int64 // Unix nanoseconds of the last finished stream request; accessed atomically
+
+	streams      *streamLimiter
+	clientQuotas clientRules
+
+	streamTransport http.RoundTripper // Transport of channels' upstream requests, with connect timeout
+	stalls          stallStats
+
+	access *stalker.AccessGuard
+}
 
 // Start starts main routine.
 func Start(chs map[string]*stalker.Channel, bind string) {
@@ -21,40 +127,44 @@ func Start(chs map[string]*stalker.Channel, bind string) {
 
 // StartWithContext starts main routine with graceful shutdown support.
 func StartWithContext(ctx context.Context, chs map[string]*stalker.Channel, bind string) {
-	// Initialize playlist
-	playlist = make(map[string]*Channel)
-	sortedChannels = make([]string, 0, len(chs))
-	for k, v := range chs {
-		playlist[k] = &Channel{
-			StalkerChannel: v,
-			Mux:            &sync.Mutex{},
-			Logo: &Logo{
-				Mux:  &sync.Mutex{},
-				Link: v.Logo(),
-			},
-			Genre: v.Genre(),
-		}
-		sortedChannels = append(sortedChannels, k)
+	StartWithOptions(ctx, chs, Options{Bind: bind})
+}
+
+// StartWithOptions starts main routine of a profile's HLS service with graceful shutdown support.
+func StartWithOptions(ctx context.Context, chs map[string]*stalker.Channel, opts Options) {
+	guard, err := stalker.NewAccessGuard("HLS of profile "+opts.ProfileName, opts.Access)
+	if err != nil {
+		log.Printf("HLS service not started: %v", err)
+		return
 	}
-	sort.Strings(sortedChannels)
+	s := newServer(chs, opts)
+	s.access = guard
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/iptv", playlistHandler)
-	mux.HandleFunc("/iptv/", channelHandler)
-	mux.HandleFunc("/logo/", logoHandler)
+	mux.HandleFunc("/iptv", s.playlistHandler)
+	mux.HandleFunc("/iptv/", s.channelHandler)
+	mux.HandleFunc("/logo/", s.logoHandler)
+	mux.HandleFunc("/hls/", s.hlsHandler)
+	mux.HandleFunc("/ts/", s.tsHandler)
+	mux.HandleFunc("/recordings/", s.recordingsHandler)
 	// Root endpoints: playlist at "/" and channels at "/<title>".
-	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("/", s.rootHandler)
 
-	server := &http.Server{
-		Addr:    bind,
-		Handler: mux,
+	srv := &http.Server{
+		Addr:    opts.Bind,
+		Handler: s.metered(guard.Wrap(mux)),
 	}
 
+	registerServer(s)
+	defer unregisterServer(s)
+
+	go s.runProber(ctx)
+
 	log.Println("HLS service should be started!")
 
 	// Start server in goroutine
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := stalker.ListenAndServe(srv, opts.TLS); err != nil && err != http.ErrServerClosed {
 			log.Printf("HLS server error: %v", err)
 		}
 	}()
@@ -65,9 +175,103 @@ func StartWithContext(ctx context.Context, chs map[string]*stalker.Channel, bind
 	time.Sleep(3 * time.Second)
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := server.Shutdown(shutdownCtx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("HLS server shutdown error: %v", err)
 	} else {
 		log.Println("HLS server shutdown complete")
 	}
 }
+
+func newServer(chs map[string]*stalker.Channel, opts Options) *server {
+	s := &server{opts: opts, client: httpClient}
+	s.streams = newStreamLimiter(opts.MaxStreams, opts.StreamPolicy, opts.ClientPriorities)
+	s.streams.allow = s.checkQuota
+	s.clientQuotas = parseClientRules(opts.ClientQuotas)
+	if opts.Transport != nil {
+		s.client = newHTTPClient(opts.Transport)
+	}
+	connect, _, _ := s.streamTimeouts()
+	s.streamTransport = withConnectTimeout(opts.Transport, connect)
+	s.setChannels(chs)
+	return s
+}
+
+// setChannels replaces channel list of the service. Channels that are still present keep their state.
+func (s *server) setChannels(chs map[string]*stalker.Channel) {
+	playlist := make(map[string]*Channel, len(chs))
+	sortedChannels := make([]string, 0, len(chs))
+	byMatchKey := make(map[string]*Channel, len(chs))
+
+	s.mu.RLock()
+	old := s.playlist
+	s.mu.RUnlock()
+
+	for k, v := range chs {
+		ch, found := old[k]
+		if !found || ch.StalkerChannel.CMD != v.CMD || ch.Genre != v.Genre() ||
+			ch.StalkerChannel.Number != v.Number || ch.StalkerChannel.XMLTVID != v.XMLTVID {
+			ch = &Channel{
+				StalkerChannel: v,
+				Mux:            &sync.Mutex{},
+				Logo:           &Logo{Link: v.Logo()},
+				Genre:          v.Genre(),
+				server:         s,
+				client:         s.channelClient(k),
+				prefetch:       s.opts.Prefetch,
+				retryBudget:    s.retryBudget(),
+			}
+		}
+		playlist[k] = ch
+		sortedChannels = append(sortedChannels, k)
+		for _, key := range matchKeys(v) {
+			if _, exists := byMatchKey[key]; !exists {
+				byMatchKey[key] = ch
+			}
+		}
+	}
+	// Customized lists are sorted by position given by playlist rules, others by title
+	sort.Slice(sortedChannels, func(i, j int) bool {
+		pi, pj := chs[sortedChannels[i]].Position, chs[sortedChannels[j]].Position
+		if pi != pj {
+			return pi < pj
+		}
+		return sortedChannels[i] < sortedChannels[j]
+	})
+
+	s.mu.Lock()
+	s.playlist = playlist
+	s.sortedChannels = sortedChannels
+	s.byMatchKey = byMatchKey
+	s.mu.Unlock()
+}
+
+// retryBudget returns RetryBudget option with default applied.
+func (s *server) retryBudget() int {
+	switch {
+	case s.opts.RetryBudget == 0:
+		return DefaultRetryBudget
+	case s.opts.RetryBudget < 0:
+		return 0
+	}
+	return s.opts.RetryBudget
+}
+
+// channels returns a consistent snapshot of channel list.
+func (s *server) channels() (map[string]*Channel, []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.playlist, s.sortedChannels
+}
+
+// UpdateChannels replaces channel list of a running profile's HLS service. Returns false if
+// the profile has no running HLS service.
+func UpdateChannels(profileID int, chs map[string]*stalker.Channel) bool {
+	serversMu.RLock()
+	s, found := servers[profileID]
+	serversMu.RUnlock()
+	if !found {
+		return false
+	}
+	s.setChannels(chs)
+	return true
+}
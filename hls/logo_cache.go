@@ -0,0 +1,267 @@
+package hls
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLogoTTL is the default time after which cached logos are revalidated upstream.
+const DefaultLogoTTL = 24 * time.Hour
+
+// logoMaxSize limits size of downloaded logos.
+const logoMaxSize = 2 << 20
+
+// logoEntry is a cached channel logo.
+type logoEntry struct {
+	Link         string    `json:"link"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checked      time.Time `json:"checked"` // Last time logo was downloaded or revalidated
+
+	data    []byte // Logo as given by upstream
+	served  []byte // Logo as served to clients (resized if configured)
+	servedT string // Content type of 'served'
+}
+
+// logoCall is an in-flight logo download that concurrent requests of the same logo wait for.
+type logoCall struct {
+	done  chan struct{}
+	entry *logoEntry
+	err   error
+}
+
+// logoCache caches channel logos in memory and on disk, one directory per portal.
+type logoCache struct {
+	mu       sync.Mutex
+	dir      string        // Root directory of disk cache; disk cache is disabled if empty
+	ttl      time.Duration // Logos older than this are revalidated upstream
+	size     int           // Max width and height of served logos; 0 serves them as they are
+	entries  map[string]*logoEntry
+	inflight map[string]*logoCall
+}
+
+var logos = &logoCache{
+	ttl:      DefaultLogoTTL,
+	entries:  make(map[string]*logoEntry),
+	inflight: make(map[string]*logoCall),
+}
+
+// SetLogoCache configures logo cache: disk directory (empty keeps logos in memory only),
+// revalidation interval and max logo size in pixels (0 serves logos as they are).
+func SetLogoCache(dir string, ttl time.Duration, size int) {
+	logos.mu.Lock()
+	logos.dir = dir
+	logos.ttl = ttl
+	logos.size = size
+	logos.entries = make(map[string]*logoEntry)
+	logos.mu.Unlock()
+	resetPlaceholders()
+}
+
+// logoKey returns cache directory (per portal) and file name of channel's logo.
+func logoKey(ch *Channel) (string, string) {
+	portal := "default"
+	if p := ch.StalkerChannel.Portal; p != nil {
+		link := p.URL()
+		if len(p.Mirrors) > 0 {
+			link = p.Mirrors[0] // Mirrors serve the same logos, so they share one cache
+		}
+		if u, err := url.Parse(link); err == nil && u.Host != "" {
+			portal = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(u.Host)
+		}
+	}
+	link := ch.StalkerChannel.LogoLink
+	if link == "" {
+		link = ch.Logo.Link
+	}
+	sum := sha1.Sum([]byte(link))
+	return portal, hex.EncodeToString(sum[:])
+}
+
+// get returns logo of a channel, downloading or revalidating it if needed. Concurrent requests of
+// the same logo share one download. Stale logo is returned if upstream fails.
+func (lc *logoCache) get(ch *Channel) (*logoEntry, error) {
+	portal, name := logoKey(ch)
+	key := portal + "/" + name
+
+	lc.mu.Lock()
+	size := lc.size
+	e, found := lc.entries[key]
+	if !found {
+		e = lc.load(portal, name, size)
+		if e != nil {
+			lc.entries[key] = e
+		}
+	}
+	if e != nil && time.Since(e.Checked) < lc.ttl {
+		lc.mu.Unlock()
+		return e, nil
+	}
+	if call, found := lc.inflight[key]; found {
+		lc.mu.Unlock()
+		<-call.done
+		return call.entry, call.err
+	}
+	call := &logoCall{done: make(chan struct{})}
+	lc.inflight[key] = call
+	lc.mu.Unlock()
+
+	fresh, err := fetchLogo(ch.client, ch.Logo.Link, e, size)
+	if err != nil && e != nil {
+		log.Printf("Serving stale logo of '%s': %v", ch.StalkerChannel.Title, err)
+		fresh, err = e, nil
+	}
+	call.entry, call.err = fresh, err
+
+	lc.mu.Lock()
+	if err == nil {
+		lc.entries[key] = fresh
+	}
+	delete(lc.inflight, key)
+	lc.mu.Unlock()
+	close(call.done)
+
+	if err == nil && fresh != e {
+		lc.save(portal, name, fresh)
+	}
+	return fresh, err
+}
+
+// fetchLogo downloads logo, or revalidates cached one if given.
+func fetchLogo(client *http.Client, link string, cached *logoEntry, size int) (*logoEntry, error) {
+	header := http.Header{}
+	if cached != nil && cached.Link == link {
+		if cached.ETag != "" {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := conditionalResponse(client, link, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		e := *cached
+		e.Checked = time.Now()
+		return &e, nil
+	}
+	// Error pages must not replace the logo, so anything else than an image is a failure
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("logo request failed: " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, logoMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > logoMaxSize {
+		return nil, errors.New("logo is larger than " + strconv.Itoa(logoMaxSize) + " bytes")
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(strings.ToLower(contentType), "image/") {
+		return nil, errors.New("logo is not an image (" + contentType + ")")
+	}
+	e := &logoEntry{
+		Link:         link,
+		ContentType:  contentType,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Checked:      time.Now(),
+		data:         data,
+	}
+	e.prepare(size)
+	return e, nil
+}
+
+// prepare sets logo as served to clients, resized to fit 'size' pixels if it's not zero.
+func (e *logoEntry) prepare(size int) {
+	e.served, e.servedT = e.data, e.ContentType
+	if e.servedT == "" {
+		e.servedT = http.DetectContentType(e.data)
+	}
+	if size > 0 {
+		if resized, ok := resizeLogo(e.data, size); ok {
+			e.served, e.servedT = resized, "image/png"
+		}
+	}
+}
+
+// load reads logo from disk cache. Returns nil if it's not there.
+func (lc *logoCache) load(portal, name string, size int) *logoEntry {
+	if lc.dir == "" {
+		return nil
+	}
+	path := filepath.Join(lc.dir, portal, name)
+	meta, err := ioutil.ReadFile(path + ".json")
+	if err != nil {
+		return nil
+	}
+	e := &logoEntry{}
+	if err := json.Unmarshal(meta, e); err != nil {
+		return nil
+	}
+	if e.data, err = ioutil.ReadFile(path); err != nil {
+		return nil
+	}
+	e.prepare(size)
+	return e
+}
+
+// save writes logo to disk cache. Failures are logged only, as logo is still served from memory.
+func (lc *logoCache) save(portal, name string, e *logoEntry) {
+	lc.mu.Lock()
+	dir := lc.dir
+	lc.mu.Unlock()
+	if dir == "" {
+		return
+	}
+
+	dir = filepath.Join(dir, portal)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Unable to cache logo: %v", err)
+		return
+	}
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, name)
+	if err := writeFileAtomic(path, e.data); err != nil {
+		log.Printf("Unable to cache logo: %v", err)
+		return
+	}
+	if err := writeFileAtomic(path+".json", meta); err != nil {
+		log.Printf("Unable to cache logo: %v", err)
+	}
+}
+
+// writeFileAtomic writes file via temporary file, so readers never see partial content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
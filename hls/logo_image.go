@@ -0,0 +1,238 @@
+package hls
+
+import (
+	"bytes"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Decoders of logo formats portals use
+	_ "image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// placeholderSize is the size of generated placeholder logos if logos are not resized.
+const placeholderSize = 256
+
+// logoMaxPixels limits dimensions of logos that get decoded for resizing, as small files can declare huge images.
+const logoMaxPixels = 4096 * 4096
+
+// glyphs is a 5x7 bitmap font used to draw initials on placeholder logos.
+var glyphs = map[rune][7]string{
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'C': {".###.", "#...#", "#....", "#....", "#....", "#...#", ".###."},
+	'D': {"####.", "#...#", "#...#", "#...#", "#...#", "#...#", "####."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'J': {"..###", "...#.", "...#.", "...#.", "...#.", "#..#.", ".##.."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'Q': {".###.", "#...#", "#...#", "#...#", "#.#.#", "#..#.", ".##.#"},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'V': {"#...#", "#...#", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "#.#.#", ".#.#."},
+	'X': {"#...#", "#...#", ".#.#.", "..#..", ".#.#.", "#...#", "#...#"},
+	'Y': {"#...#", "#...#", ".#.#.", "..#..", "..#..", "..#..", "..#.."},
+	'Z': {"#####", "....#", "...#.", "..#..", ".#...", "#....", "#####"},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'?': {".###.", "#...#", "....#", "...#.", "..#..", ".....", "..#.."},
+}
+
+var (
+	placeholdersMu sync.Mutex
+	placeholders   = map[string][]byte{} // Initials -> PNG
+)
+
+func resetPlaceholders() {
+	placeholdersMu.Lock()
+	placeholders = map[string][]byte{}
+	placeholdersMu.Unlock()
+}
+
+// initials returns up to two initials of channel title that can be drawn with placeholder font.
+func initials(title string) string {
+	var out []rune
+	for _, word := range strings.FieldsFunc(title, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		r := unicode.ToUpper([]rune(word)[0])
+		if _, found := glyphs[r]; !found {
+			continue
+		}
+		out = append(out, r)
+		if len(out) == 2 {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return "?"
+	}
+	return string(out)
+}
+
+// placeholderLogo returns PNG with initials of channel title on a background whose color is
+// derived from the title, so every channel gets a stable and distinguishable image.
+func placeholderLogo(title string) []byte {
+	text := initials(title)
+
+	h := fnv.New32a()
+	h.Write([]byte(title))
+	sum := h.Sum32()
+	key := text + "/" + strconv.Itoa(int(sum%360))
+
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+	if img, found := placeholders[key]; found {
+		return img
+	}
+
+	size := placeholderSize
+	logos.mu.Lock()
+	if logos.size > 0 {
+		size = logos.size
+	}
+	logos.mu.Unlock()
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{hueColor(float64(sum % 360))}, image.Point{}, draw.Src)
+
+	// Text is 5 columns per glyph with 1 column gaps, scaled to fit 70% of width and 50% of height
+	cols := len(text)*6 - 1
+	scale := size * 7 / 10 / cols
+	if max := size / 2 / 7; scale > max {
+		scale = max
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	x0 := (size - cols*scale) / 2
+	y0 := (size - 7*scale) / 2
+	for i, r := range text {
+		for y, row := range glyphs[r] {
+			for x, c := range row {
+				if c != '#' {
+					continue
+				}
+				px := x0 + (i*6+x)*scale
+				py := y0 + y*scale
+				draw.Draw(img, image.Rect(px, py, px+scale, py+scale), image.White, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	placeholders[key] = buf.Bytes()
+	return buf.Bytes()
+}
+
+// hueColor returns a muted color of given hue (0-360), dark enough for white text.
+func hueColor(hue float64) color.RGBA {
+	const s, v = 0.55, 0.55
+	c := v * s
+	hp := hue / 60
+	x := c * (1 - abs(mod2(hp)-1))
+	var r, g, b float64
+	switch int(hp) {
+	case 0:
+		r, g = c, x
+	case 1:
+		r, g = x, c
+	case 2:
+		g, b = c, x
+	case 3:
+		g, b = x, c
+	case 4:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := v - c
+	return color.RGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 255}
+}
+
+func mod2(f float64) float64 { return f - 2*float64(int(f/2)) }
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+// resizeLogo scales image down to fit into size x size box, keeping its aspect ratio, and encodes
+// it as PNG. Returns false if image can't be decoded, is too large to decode or is already small enough.
+func resizeLogo(data []byte, size int) ([]byte, bool) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || int64(cfg.Width)*int64(cfg.Height) > logoMaxPixels {
+		return nil, false
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size || w == 0 || h == 0 {
+		return nil, false
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	// Box filter: every destination pixel is the average of source pixels it covers
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					c := color.RGBA64Model.Convert(src.At(sx, sy)).(color.RGBA64)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
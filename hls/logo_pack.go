@@ -0,0 +1,277 @@
+package hls
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// logoPackCheckInterval limits how often logo pack directory and mapping file are checked for changes.
+const logoPackCheckInterval = 10 * time.Second
+
+// LogoPackRule maps channels to a file of local logo pack. Channel matches if its title matches
+// regex Match or its XMLTV ID equals TVGID.
+type LogoPackRule struct {
+	Match string `yaml:"match"`
+	TVGID string `yaml:"tvg_id"`
+	File  string `yaml:"file"`
+}
+
+// LogoReport tells which channels of a profile have a logo in local logo pack.
+type LogoReport struct {
+	Enabled   bool     `json:"enabled"`   // Logo pack is configured
+	Matched   int      `json:"matched"`   // Channels with logo from logo pack
+	Unmatched []string `json:"unmatched"` // Titles of channels without logo in logo pack
+}
+
+type logoPackRule struct {
+	re    *regexp.Regexp
+	tvgID string
+	file  string
+}
+
+// packLogo is a logo file of logo pack, prepared to be served.
+type packLogo struct {
+	modTime     time.Time
+	data        []byte
+	contentType string
+}
+
+// logoPack is a local directory of logo images, preferred over logos given by portal.
+type logoPack struct {
+	mu      sync.RWMutex
+	dir     string // Directory with logo images; logo pack is disabled if empty
+	mapping string // YAML file with []LogoPackRule; optional
+	rules   []logoPackRule
+	files   map[string]string // Normalized file name without extension -> file name
+	modTime time.Time         // Latest modification time of directory and mapping file
+	checked time.Time
+	cache   map[string]*packLogo // File name -> logo
+}
+
+var pack = &logoPack{}
+
+// SetLogoPack configures local logo pack: directory of logo images and optional YAML mapping file
+// of channel title regexes and XMLTV IDs to file names. Channels without mapping match files named
+// after them (case, spaces and punctuation are ignored). Empty dir disables logo pack.
+func SetLogoPack(dir, mapping string) error {
+	pack.mu.Lock()
+	defer pack.mu.Unlock()
+	pack.dir, pack.mapping = dir, mapping
+	pack.rules, pack.files, pack.cache = nil, nil, nil
+	pack.modTime, pack.checked = time.Time{}, time.Time{}
+	if dir == "" {
+		return nil
+	}
+	return pack.load()
+}
+
+// load reads directory listing and mapping file. Must be called with lock held.
+func (lp *logoPack) load() error {
+	lp.checked = time.Now()
+	lp.modTime = lp.lastChange()
+
+	entries, err := ioutil.ReadDir(lp.dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !isImageFile(e.Name()) {
+			continue
+		}
+		files[normalizeLogoName(strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))] = e.Name()
+	}
+
+	var rules []logoPackRule
+	if lp.mapping != "" {
+		content, err := ioutil.ReadFile(lp.mapping)
+		if err != nil {
+			return err
+		}
+		var mapping []LogoPackRule
+		if err := yaml.Unmarshal(content, &mapping); err != nil {
+			return errors.New("logo mapping " + lp.mapping + ": " + err.Error())
+		}
+		for _, m := range mapping {
+			if m.File == "" || (m.Match == "" && m.TVGID == "") {
+				return errors.New("logo mapping " + lp.mapping + ": every entry needs 'file' and 'match' or 'tvg_id'")
+			}
+			rule := logoPackRule{tvgID: m.TVGID, file: m.File}
+			if m.Match != "" {
+				if rule.re, err = regexp.Compile(m.Match); err != nil {
+					return errors.New("logo mapping '" + m.Match + "': " + err.Error())
+				}
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	lp.files, lp.rules = files, rules
+	lp.cache = make(map[string]*packLogo)
+	return nil
+}
+
+// lastChange returns latest modification time of logo directory and mapping file.
+func (lp *logoPack) lastChange() time.Time {
+	var t time.Time
+	for _, path := range []string{lp.dir, lp.mapping} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// refresh reloads logo pack if its directory or mapping file changed since last check.
+func (lp *logoPack) refresh() {
+	lp.mu.RLock()
+	due := lp.dir != "" && time.Since(lp.checked) >= logoPackCheckInterval
+	lp.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if time.Since(lp.checked) < logoPackCheckInterval {
+		return
+	}
+	lp.checked = time.Now()
+	if !lp.lastChange().After(lp.modTime) {
+		return
+	}
+	// Keep previous state if new mapping is broken
+	rules, files, cache := lp.rules, lp.files, lp.cache
+	if err := lp.load(); err != nil {
+		lp.rules, lp.files, lp.cache = rules, files, cache
+	}
+}
+
+// match returns file name of channel's logo in logo pack, or empty string if there is none.
+// Mapping file is consulted first, then file names.
+func (lp *logoPack) match(title string, ch *Channel) string {
+	lp.refresh()
+
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+	if lp.dir == "" {
+		return ""
+	}
+	tvgID := ch.StalkerChannel.XMLTVID
+	for _, r := range lp.rules {
+		if (r.tvgID != "" && r.tvgID == tvgID) || (r.re != nil && r.re.MatchString(title)) {
+			return r.file
+		}
+	}
+	return lp.files[normalizeLogoName(title)]
+}
+
+// logo returns channel's logo from logo pack, resized like portal logos. Returns false if channel
+// has no logo in logo pack or it can't be read.
+func (lp *logoPack) logo(title string, ch *Channel) ([]byte, string, bool) {
+	file := lp.match(title, ch)
+	if file == "" {
+		return nil, "", false
+	}
+
+	lp.mu.RLock()
+	path := filepath.Join(lp.dir, filepath.Clean("/"+file))
+	cached := lp.cache[file]
+	lp.mu.RUnlock()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", false
+	}
+	if cached != nil && cached.modTime.Equal(fi.ModTime()) {
+		return cached.data, cached.contentType, true
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", false
+	}
+	l := &packLogo{modTime: fi.ModTime(), data: data, contentType: mime.TypeByExtension(filepath.Ext(path))}
+	if l.contentType == "" {
+		l.contentType = http.DetectContentType(data)
+	}
+	logos.mu.Lock()
+	size := logos.size
+	logos.mu.Unlock()
+	if size > 0 {
+		if resized, ok := resizeLogo(data, size); ok {
+			l.data, l.contentType = resized, "image/png"
+		}
+	}
+
+	lp.mu.Lock()
+	if lp.cache != nil {
+		lp.cache[file] = l
+	}
+	lp.mu.Unlock()
+	return l.data, l.contentType, true
+}
+
+// GetLogoReport tells which channels of a running profile have a logo in local logo pack.
+// Returns false if the profile has no running HLS service.
+func GetLogoReport(profileID int) (LogoReport, bool) {
+	serversMu.RLock()
+	s, found := servers[profileID]
+	serversMu.RUnlock()
+	if !found {
+		return LogoReport{}, false
+	}
+
+	pack.mu.RLock()
+	report := LogoReport{Enabled: pack.dir != "", Unmatched: []string{}}
+	pack.mu.RUnlock()
+	if !report.Enabled {
+		return report, true
+	}
+
+	playlist, sortedChannels := s.channels()
+	for _, title := range sortedChannels {
+		if pack.match(title, playlist[title]) != "" {
+			report.Matched++
+		} else {
+			report.Unmatched = append(report.Unmatched, title)
+		}
+	}
+	sort.Strings(report.Unmatched)
+	return report, true
+}
+
+// normalizeLogoName lowercases name and drops everything but letters and digits, so "BBC One HD",
+// "bbc_one_hd" and "bbc-one-hd" are the same.
+func normalizeLogoName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp":
+		return true
+	}
+	return false
+}
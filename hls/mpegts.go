@@ -0,0 +1,106 @@
+package hls
+
+// Minimal MPEG-TS parsing, just enough to cut a stream into HLS segments.
+
+const (
+	tsSyncByte = 0x47
+	tsPIDPAT   = 0x0000
+	pcrClock   = 90000 // PCR base ticks per second
+)
+
+// tsPacket wraps a single 188 bytes long MPEG-TS packet.
+type tsPacket []byte
+
+func (p tsPacket) pid() uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+// payloadStart reports whether packet starts a new PES packet or PSI section.
+func (p tsPacket) payloadStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p tsPacket) hasAdaptation() bool {
+	return p[3]&0x20 != 0 && p[4] > 0
+}
+
+// randomAccess reports whether packet is flagged as a random access point (keyframe).
+func (p tsPacket) randomAccess() bool {
+	return p.hasAdaptation() && p[5]&0x40 != 0
+}
+
+// pcr returns program clock reference base (90kHz), if packet carries one.
+func (p tsPacket) pcr() (int64, bool) {
+	if !p.hasAdaptation() || p[5]&0x10 == 0 || p[4] < 7 {
+		return 0, false
+	}
+	v := int64(p[6])<<25 | int64(p[7])<<17 | int64(p[8])<<9 | int64(p[9])<<1 | int64(p[10])>>7
+	return v, true
+}
+
+// payload returns packet's payload, skipping adaptation field.
+func (p tsPacket) payload() []byte {
+	start := 4
+	if p[3]&0x20 != 0 {
+		start += 1 + int(p[4])
+	}
+	if p[3]&0x10 == 0 || start >= len(p) {
+		return nil
+	}
+	return p[start:]
+}
+
+// psiSection returns PSI section of a packet that starts one (skipping pointer field).
+func (p tsPacket) psiSection() []byte {
+	if !p.payloadStart() {
+		return nil
+	}
+	pl := p.payload()
+	if len(pl) < 1 || 1+int(pl[0]) >= len(pl) {
+		return nil
+	}
+	section := pl[1+int(pl[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) {
+		return section
+	}
+	return section[:3+length]
+}
+
+// parsePAT returns PID of the first program's PMT.
+func parsePAT(section []byte) (uint16, bool) {
+	// table header is 8 bytes long, 4 bytes of CRC at the end
+	if len(section) < 12 || section[0] != 0x00 {
+		return 0, false
+	}
+	for i := 8; i+4 <= len(section)-4; i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		if program == 0 {
+			continue // network PID
+		}
+		return uint16(section[i+2]&0x1f)<<8 | uint16(section[i+3]), true
+	}
+	return 0, false
+}
+
+// parsePMTVideoPID returns PID of the first video stream listed in PMT.
+func parsePMTVideoPID(section []byte) (uint16, bool) {
+	if len(section) < 16 || section[0] != 0x02 {
+		return 0, false
+	}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + programInfoLength; i+5 <= len(section)-4; {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		switch streamType {
+		case 0x01, 0x02, 0x10, 0x1b, 0x24, 0x42, 0xea: // MPEG-1/2, MPEG-4, H.264, H.265, AVS, VC-1
+			return pid, true
+		}
+		i += 5 + esInfoLength
+	}
+	return 0, false
+}
@@ -0,0 +1,204 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+const (
+	probeMinDelay   = 2 * time.Second  // Channels are never probed faster than this
+	probeTimeout    = 15 * time.Second // Max time for upstream to respond to a probe
+	probeIdleWindow = 30 * time.Second // Probing pauses while streams were requested this recently
+	probeMaxBody    = 1 << 20          // Max size of HLS playlist read by a probe
+)
+
+// ProbeResult is the outcome of the last health probe of a channel.
+type ProbeResult struct {
+	Online   bool      `json:"online"`
+	Checked  time.Time `json:"checked"`
+	TTFBMs   int64     `json:"ttfb_ms"`             // Time to the first byte of stream (or playlist), in milliseconds
+	LinkType string    `json:"link_type,omitempty"` // "hls" or "media"
+	Error    string    `json:"error,omitempty"`
+}
+
+// ChannelInfo describes a channel of a running profile.
+type ChannelInfo struct {
+	Title  string       `json:"title"`
+	Genre  string       `json:"genre"`
+	Number int          `json:"number,omitempty"`
+	TVGID  string       `json:"tvg_id,omitempty"`
+	Probe  *ProbeResult `json:"probe,omitempty"`  // Nil until channel was probed
+	Stalls *StallStats  `json:"stalls,omitempty"` // Nil if upstream never stalled
+}
+
+// GetChannels returns channels of a running profile in playlist order, with results of their last
+// health probes and stall counters. Returns false if the profile has no running HLS service.
+func GetChannels(profileID int) ([]ChannelInfo, bool) {
+	s, found := lookupServer(profileID)
+	if !found {
+		return nil, false
+	}
+	playlist, sortedChannels := s.channels()
+	out := make([]ChannelInfo, 0, len(sortedChannels))
+	for _, title := range sortedChannels {
+		ch := playlist[title]
+		out = append(out, ChannelInfo{
+			Title:  title,
+			Genre:  ch.Genre,
+			Number: ch.StalkerChannel.Number,
+			TVGID:  ch.StalkerChannel.XMLTVID,
+			Probe:  s.probeResult(title),
+			Stalls: s.stalls.get(title),
+		})
+	}
+	return out, true
+}
+
+// GetAccessStats returns counters of requests rejected by access rules of a running profile's HLS
+// service. Returns false if the profile has no running HLS service.
+func GetAccessStats(profileID int) (stalker.AccessStats, bool) {
+	s, found := lookupServer(profileID)
+	if !found || s.access == nil {
+		return stalker.AccessStats{}, false
+	}
+	return s.access.Stats(), true
+}
+
+// track marks a stream request as running, so prober doesn't compete with viewers for portal's
+// stream limit. Returned function must be called once request is done.
+func (s *server) track() func() {
+	atomic.AddInt32(&s.activeRequests, 1)
+	return func() {
+		atomic.AddInt32(&s.activeRequests, -1)
+		atomic.StoreInt64(&s.lastRequest, time.Now().UnixNano())
+	}
+}
+
+// busy reports whether streams of this profile are being watched.
+func (s *server) busy() bool {
+	last := time.Unix(0, atomic.LoadInt64(&s.lastRequest))
+	return atomic.LoadInt32(&s.activeRequests) > 0 || time.Since(last) < probeIdleWindow
+}
+
+// probeResult returns result of channel's last probe, or nil if it was not probed yet.
+func (s *server) probeResult(title string) *ProbeResult {
+	s.probesMu.RLock()
+	defer s.probesMu.RUnlock()
+	if r, found := s.probes[title]; found {
+		return &r
+	}
+	return nil
+}
+
+// offline reports whether channel failed its last probe.
+func (s *server) offline(title string) bool {
+	r := s.probeResult(title)
+	return r != nil && !r.Online
+}
+
+// runProber probes channels one by one, so every channel is checked once per ProbeInterval, but
+// never faster than probeMinDelay. Probing pauses while profile's streams are being watched.
+func (s *server) runProber(ctx context.Context) {
+	if s.opts.ProbeInterval <= 0 {
+		return
+	}
+	next := 0
+	for {
+		playlist, titles := s.channels()
+		delay := probeMinDelay
+		if len(titles) > 0 {
+			if d := s.opts.ProbeInterval / time.Duration(len(titles)); d > delay {
+				delay = d
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if len(titles) == 0 || s.busy() {
+			continue
+		}
+
+		if next >= len(titles) {
+			next = 0
+		}
+		title := titles[next]
+		next++
+		probeCtx, release, ok := s.streams.reserveProbe(ctx, playlist[title])
+		if !ok {
+			continue // No free stream slot; channel gets probed next round
+		}
+		r := s.probeChannel(probeCtx, playlist[title])
+		release()
+		if probeCtx.Err() != nil {
+			continue // Aborted for a viewer, or shutting down
+		}
+		if !r.Online && !s.offline(title) {
+			log.Printf("Channel '%s' of profile %d is offline: %s", title, s.opts.ProfileID, r.Error)
+		}
+
+		s.probesMu.Lock()
+		if s.probes == nil {
+			s.probes = make(map[string]ProbeResult)
+		}
+		s.probes[title] = r
+		s.probesMu.Unlock()
+	}
+}
+
+// probeChannel resolves a new link of a channel and reads the first bytes of its stream, or its
+// playlist if it's HLS. Profile's plain client is used, so probes are not counted as traffic or
+// stalls of the channel.
+func (s *server) probeChannel(ctx context.Context, ch *Channel) ProbeResult {
+	r := ProbeResult{Checked: time.Now()}
+	fail := func(err error) ProbeResult {
+		r.Error = err.Error()
+		return r
+	}
+
+	link, err := ch.StalkerChannel.NewLink(false)
+	if err != nil {
+		return fail(err)
+	}
+
+	client := *s.client
+	client.Timeout = probeTimeout
+	started := time.Now()
+	resp, err := contextResponse(ctx, &client, link, nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, tsPacketSize)
+	n, err := io.ReadAtLeast(resp.Body, buf, 1)
+	if n == 0 {
+		return fail(errors.New("no data received: " + err.Error()))
+	}
+	r.TTFBMs = time.Since(started).Milliseconds()
+
+	if getLinkType(resp.Header.Get("Content-Type")) == linkTypeHLS {
+		r.LinkType = "hls"
+		body := io.MultiReader(bytes.NewReader(buf[:n]), io.LimitReader(resp.Body, probeMaxBody))
+		pl, variant, err := parsePlaylist(body, resp.Request.URL)
+		if err != nil {
+			return fail(err)
+		}
+		if variant == "" && len(pl.segments) == 0 {
+			return fail(errors.New("playlist has no segments"))
+		}
+	} else {
+		r.LinkType = "media"
+	}
+
+	r.Online = true
+	return r
+}
@@ -0,0 +1,177 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// recordingClient is the client address of recordings, usable in Options.ClientPriorities.
+const recordingClient = "dvr"
+
+var (
+	errNoService     = errors.New("profile has no running HLS service")
+	errNoChannel     = errors.New("channel not found")
+	errStreamEnded   = errors.New("upstream stream ended")
+	errStreamStopped = errors.New("stream was preempted or kicked")
+	errHLSUpstream   = errors.New("upstream is HLS, not a raw stream")
+	errNoRecording   = errors.New("recording not found")
+)
+
+// RecordedFile is a finished recording listed in "Recordings" group of playlists.
+type RecordedFile struct {
+	ID    string // Used in link: /recordings/<ID>.ts
+	Title string
+	Path  string // Path to .ts file
+}
+
+var (
+	recordingsMu     sync.RWMutex
+	recordingsSource func(profileID int) []RecordedFile
+)
+
+// SetRecordingsSource sets function that lists finished recordings of a profile.
+func SetRecordingsSource(fn func(profileID int) []RecordedFile) {
+	recordingsMu.Lock()
+	recordingsSource = fn
+	recordingsMu.Unlock()
+}
+
+func recordedFiles(profileID int) []RecordedFile {
+	recordingsMu.RLock()
+	fn := recordingsSource
+	recordingsMu.RUnlock()
+	if fn == nil {
+		return nil
+	}
+	return fn(profileID)
+}
+
+// LookupChannel returns channel of a running profile by its playlist title.
+func LookupChannel(profileID int, title string) (*stalker.Channel, bool) {
+	s, found := lookupServer(profileID)
+	if !found {
+		return nil, false
+	}
+	playlist, _ := s.channels()
+	ch, found := playlist[title]
+	if !found {
+		return nil, false
+	}
+	return ch.StalkerChannel, true
+}
+
+// ChannelTitles returns playlist titles of a running profile's channels, in playlist order.
+func ChannelTitles(profileID int) ([]string, bool) {
+	s, found := lookupServer(profileID)
+	if !found {
+		return nil, false
+	}
+	_, sortedChannels := s.channels()
+	return sortedChannels, true
+}
+
+func lookupServer(profileID int) (*server, bool) {
+	serversMu.RLock()
+	defer serversMu.RUnlock()
+	s, found := servers[profileID]
+	return s, found
+}
+
+// Record writes live stream of a running profile's channel to w as MPEG-TS until ctx is done.
+// Raw channels share upstream connection with viewers; channel's link is resolved anew only if
+// there is none. HLS channels are stitched into a continuous stream. Returns error if stream can't be opened or
+// ends before ctx is done, so caller can retry.
+func Record(ctx context.Context, profileID int, title string, w io.Writer) error {
+	s, found := lookupServer(profileID)
+	if !found {
+		return errNoService
+	}
+	playlist, _ := s.channels()
+	ch, found := playlist[title]
+	if !found {
+		return errNoChannel
+	}
+	defer s.track()()
+
+	// Stream context is cancelled early if the stream gets preempted or kicked
+	streamCtx, sess, release, err := s.streams.admit(ctx, ch, title, recordingClient, "DVR")
+	if err != nil {
+		return err
+	}
+	defer release()
+	w = sess.writer(w)
+
+	// Stream of other viewers is joined as it is. Otherwise a new link is resolved, and upstream
+	// turns out to be either raw stream, which viewers may join, or HLS, which is stitched.
+	var hlsLink string
+	b, err := joinBroadcast(ch, func() (*http.Response, error) {
+		resp, err := ch.reopen()
+		if err != nil {
+			return nil, err
+		}
+		if getLinkType(resp.Header.Get("Content-Type")) == linkTypeHLS {
+			resp.Body.Close()
+			hlsLink = resp.Request.URL.String()
+			return nil, errHLSUpstream
+		}
+		return resp, nil
+	})
+
+	if err == errHLSUpstream && hlsLink != "" {
+		pl, plLink, err := loadMediaPlaylist(ch.client, hlsLink, s.opts.Variants)
+		if err != nil {
+			return err
+		}
+		if err := stitch(streamCtx, ch.client, title, pl, plLink, w); err != nil {
+			return err
+		}
+	} else {
+		if err != nil {
+			return err
+		}
+		v := b.newViewer(streamCtx)
+		_, err = io.Copy(w, v)
+		v.close()
+		b.leave()
+		if err != nil && streamCtx.Err() == nil {
+			return err
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return nil
+	case streamCtx.Err() != nil:
+		return errStreamStopped
+	default:
+		return errStreamEnded
+	}
+}
+
+// writeRecordings writes M3U entries of profile's finished recordings in "Recordings" group.
+func (s *server) writeRecordings(w io.Writer, origin, groupPrefix string) {
+	for _, rec := range recordedFiles(s.opts.ProfileID) {
+		fmt.Fprintf(w, "#EXTINF:-1 tvg-name=\"%s\" group-title=\"%s\", %s\n", m3uAttr(rec.Title), m3uAttr(groupPrefix+"Recordings"), m3uName(rec.Title))
+		fmt.Fprintf(w, "%s/recordings/%s.ts\n", origin, rec.ID)
+	}
+}
+
+// Handles '/recordings/<id>.ts' requests
+func (s *server) recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/recordings/"), ".ts")
+	for _, rec := range recordedFiles(s.opts.ProfileID) {
+		if rec.ID == id {
+			w.Header().Set("Content-Type", "video/mp2t")
+			http.ServeFile(w, r, rec.Path)
+			return
+		}
+	}
+	http.Error(w, errNoRecording.Error(), http.StatusNotFound)
+}
@@ -2,116 +2,301 @@ package hls
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Handles '/iptv' requests
-func playlistHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) playlistHandler(w http.ResponseWriter, r *http.Request) {
+	s.servePlaylist(w, r, "/iptv/")
+}
+
+// servePlaylist writes extended M3U playlist of all channels. Channel links are prefixed with 'base'.
+func (s *server) servePlaylist(w http.ResponseWriter, r *http.Request, base string) {
 	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
-	fmt.Fprintln(w, "#EXTM3U")
+	if s.opts.EPGURL != "" {
+		fmt.Fprintf(w, "#EXTM3U url-tvg=\"%s\" x-tvg-url=\"%s\"\n", m3uAttr(s.opts.EPGURL), m3uAttr(s.opts.EPGURL))
+	} else {
+		fmt.Fprintln(w, "#EXTM3U")
+	}
+	s.writeEntries(w, requestOrigin(r), base, "")
+}
+
+// writeEntries writes M3U entries of all channels and recordings, pointing to this service at
+// 'origin' (scheme://host:port). Group titles are prefixed with 'groupPrefix'.
+func (s *server) writeEntries(w io.Writer, origin, base, groupPrefix string) {
+	playlist, sortedChannels := s.channels()
 	for _, title := range sortedChannels {
-		link := "http://" + r.Host + "/iptv/" + url.PathEscape(title)
-		logo := "/logo/" + url.PathEscape(title)
+		ch := playlist[title]
+		group := ch.Genre
+		if s.offline(title) {
+			if s.opts.HideOffline {
+				continue
+			}
+			group = "Offline"
+		}
+		fmt.Fprint(w, "#EXTINF:-1")
+		if id := ch.StalkerChannel.XMLTVID; id != "" {
+			fmt.Fprintf(w, " tvg-id=\"%s\"", m3uAttr(id))
+		}
+		fmt.Fprintf(w, " tvg-name=\"%s\"", m3uAttr(title))
+		if n := ch.StalkerChannel.Number; n > 0 {
+			fmt.Fprintf(w, " tvg-chno=\"%d\"", n)
+		}
+		fmt.Fprintf(w, " tvg-logo=\"%s/logo/%s\"", origin, url.PathEscape(title))
+		fmt.Fprintf(w, " group-title=\"%s\", %s\n", m3uAttr(groupPrefix+group), m3uName(title))
+		if s.opts.PlayerUserAgent != "" {
+			fmt.Fprintf(w, "#EXTVLCOPT:http-user-agent=%s\n", s.opts.PlayerUserAgent)
+		}
+		fmt.Fprintln(w, s.channelLink(origin, base, title))
+	}
+	s.writeRecordings(w, origin, groupPrefix)
+}
 
-		fmt.Fprintf(w, "#EXTINF:-1 tvg-logo=\"%s\" group-title=\"%s\", %s\n%s\n", logo, playlist[title].Genre, title, link)
+// WritePlaylistEntries writes M3U entries (without header) of a running profile's channels, with
+// links pointing to profile's HLS service at 'host' (host:port). Group titles are prefixed with
+// 'groupPrefix'. Returns false if the profile has no running HLS service.
+func WritePlaylistEntries(w io.Writer, profileID int, host, groupPrefix string) bool {
+	serversMu.RLock()
+	s, found := servers[profileID]
+	serversMu.RUnlock()
+	if !found {
+		return false
 	}
+	s.writeEntries(w, s.opts.TLS.Scheme()+"://"+host+s.opts.Access.LinkPrefix(), "/", groupPrefix)
+	return true
+}
+
+// m3uAttr makes value safe to be used as quoted M3U attribute.
+func m3uAttr(v string) string {
+	return strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(v)
+}
+
+// m3uName makes value safe to be used as M3U display name, which ends at the end of line.
+func m3uName(v string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(v)
+}
+
+// channelLink returns playlist link of a channel. If HLS output is enabled, all channels are
+// advertised as HLS, regardless of their upstream format.
+func (s *server) channelLink(origin, base, title string) string {
+	if s.opts.HLSOutput {
+		return origin + "/hls/" + url.PathEscape(title) + ".m3u8"
+	}
+	return origin + base + url.PathEscape(title)
 }
 
 // Handles '/iptv/' requests
-func channelHandler(w http.ResponseWriter, r *http.Request) {
-	cr, err := getContentRequest(w, r, "/iptv/")
+func (s *server) channelHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveChannel(w, r, "/iptv/")
+}
+
+// Handles '/logo/' requests. Local logo pack is preferred over portal's logos. Channels without
+// logo, or whose logo can't be retrieved, get a generated placeholder.
+func (s *server) logoHandler(w http.ResponseWriter, r *http.Request) {
+	cr, err := s.getContentRequest(w, r, "/logo/")
 	if err != nil {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Lock channel's mux
-	cr.ChannelRef.Mux.Lock()
-
-	// Keep track on channel access time
-	if err = cr.ChannelRef.validate(); err != nil {
-		cr.ChannelRef.Mux.Unlock()
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		log.Println(err)
-		return
+	data, contentType, found := pack.logo(cr.Title, cr.ChannelRef)
+	if !found && cr.ChannelRef.Logo.Link != "" {
+		if logo, err := logos.get(cr.ChannelRef); err == nil {
+			data, contentType = logo.served, logo.servedT
+		} else {
+			log.Printf("Unable to retrieve logo of '%s': %v", cr.Title, err)
+		}
+	}
+	if len(data) == 0 {
+		data, contentType = placeholderLogo(cr.Title), "image/png"
 	}
 
-	// Handle content
-	handleContent(cr)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(data)
 }
 
-// Handles '/logo/' requests
-func logoHandler(w http.ResponseWriter, r *http.Request) {
-	cr, err := getContentRequest(w, r, "/logo/")
+// Handles '/hls/' requests: '/hls/<channel>.m3u8' playlists and '/hls/<channel>/<n>.ts' segments
+func (s *server) hlsHandler(w http.ResponseWriter, r *http.Request) {
+	defer s.track()()
+
+	reqPath := strings.TrimPrefix(r.URL.EscapedPath(), "/hls/")
+	if i := strings.IndexByte(reqPath, '/'); i > -1 {
+		s.serveSegment(w, r, reqPath[:i], reqPath[i+1:])
+		return
+	}
+
+	title, err := url.PathUnescape(strings.TrimSuffix(reqPath, ".m3u8"))
 	if err != nil {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
+	cr, err := s.newContentRequest(w, r, title, "")
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	cr.HLSOutput = true
 
-	// Lock
-	cr.ChannelRef.Logo.Mux.Lock()
-
-	// Retrieve from Stalker middleware if no cache is present
-	if len(cr.ChannelRef.Logo.Cache) == 0 {
-		img, contentType, err := download(cr.ChannelRef.Logo.Link)
+	// Channel is already being segmented - no need to bother the portal
+	ch := cr.Primary
+	if alt := ch.activeFailover(); alt != nil {
+		ch = alt
+	}
+	if sg := lookupSegmenter(ch); sg != nil {
+		_, sess, release, err := s.admitStream(r, ch, title)
 		if err != nil {
-			cr.ChannelRef.Logo.Mux.Unlock()
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Println(err)
+			streamError(w, err)
 			return
 		}
-		cr.ChannelRef.Logo.Cache = img
-		cr.ChannelRef.Logo.CacheContentType = contentType
+		defer release()
+		sg.writePlaylist(sess.responseWriter(w), segmenterPrefix(r, title))
+		return
+	}
+
+	s.serveContentRequest(cr)
+}
+
+// serveSegment serves a segment produced by channel's segmenter.
+func (s *server) serveSegment(w http.ResponseWriter, r *http.Request, escapedTitle, name string) {
+	title, err := url.PathUnescape(escapedTitle)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(name, ".ts"))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
 	}
+	playlist, _ := s.channels()
+	ch, found := playlist[title]
+	if !found {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if alt := ch.activeFailover(); alt != nil {
+		ch = alt
+	}
+	_, sess, release, err := s.admitStream(r, ch, title)
+	if err != nil {
+		streamError(w, err)
+		return
+	}
+	defer release()
+	w = sess.responseWriter(w)
 
-	// Create local copy so we don't need thread syncrhonization
-	logo := *cr.ChannelRef.Logo
+	var seg *tsSegment
+	if sg := lookupSegmenter(ch); sg != nil {
+		seg = sg.segment(seq)
+	}
+	if seg == nil {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
 
-	// Unlock
-	cr.ChannelRef.Logo.Mux.Unlock()
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Content-Length", strconv.Itoa(len(seg.data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(seg.data)
+}
 
-	w.Header().Set("Content-Type", logo.CacheContentType)
-	w.Write(logo.Cache)
+// Handles '/ts/' requests: channels as continuous MPEG-TS streams, even if upstream serves HLS
+func (s *server) tsHandler(w http.ResponseWriter, r *http.Request) {
+	cr, err := s.getContentRequest(w, r, "/ts/")
+	if err != nil || cr.Suffix != "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	cr.TSOutput = true
+	s.serveContentRequest(cr)
 }
 
 // rootHandler serves playlist at "/" and channels at root paths without the "/iptv" prefix.
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-    if r.URL.Path == "/" {
-        // Serve playlist at root
-        w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
-        w.WriteHeader(http.StatusOK)
-
-        fmt.Fprintln(w, "#EXTM3U")
-        for _, title := range sortedChannels {
-            link := "http://" + r.Host + "/" + url.PathEscape(title)
-            logo := "/logo/" + url.PathEscape(title)
-            fmt.Fprintf(w, "#EXTINF:-1 tvg-logo=\"%s\" group-title=\"%s\", %s\n%s\n", logo, playlist[title].Genre, title, link)
-        }
-        return
-    }
-
-    // Treat anything else at root as a channel request
-    cr, err := getContentRequest(w, r, "/")
-    if err != nil {
-        http.Error(w, "invalid request", http.StatusBadRequest)
-        return
-    }
-
-    // Lock channel's mux
-    cr.ChannelRef.Mux.Lock()
-
-    // Keep track on channel access time
-    if err = cr.ChannelRef.validate(); err != nil {
-        cr.ChannelRef.Mux.Unlock()
-        http.Error(w, "internal server error", http.StatusInternalServerError)
-        log.Println(err)
-        return
-    }
-
-    // Handle content
-    handleContent(cr)
+func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		// Serve playlist at root
+		s.servePlaylist(w, r, "/")
+		return
+	}
+
+	// Treat anything else at root as a channel request
+	s.serveChannel(w, r, "/")
+}
+
+// serveChannel streams the requested channel, falling back to the same channel of another
+// profile if this profile is unable to serve it.
+func (s *server) serveChannel(w http.ResponseWriter, r *http.Request, expectedPrefix string) {
+	cr, err := s.getContentRequest(w, r, expectedPrefix)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	s.serveContentRequest(cr)
+}
+
+// serveContentRequest serves content request, failing over to other profiles if needed.
+func (s *server) serveContentRequest(cr *ContentRequest) {
+	defer s.track()()
+
+	// Keep serving from another profile if failover happened recently
+	if alt := cr.Primary.activeFailover(); alt != nil {
+		cr.ChannelRef = alt
+	}
+
+	// Count the stream against stream limit of the serving profile while client is connected
+	if err := cr.admit(s, cr.ChannelRef); err != nil {
+		streamError(cr.ResponseWriter, err)
+		return
+	}
+	defer cr.end()
+
+	// Upstream rejecting a link usually means it expired, so a new one is requested and the
+	// request is retried before anything reaches the client
+	budget := cr.ChannelRef.retryBudget
+	for attempt := 0; ; attempt++ {
+		// Lock channel's mux
+		cr.ChannelRef.Mux.Lock()
+
+		// Keep track on channel access time
+		err := cr.ChannelRef.validate()
+		if err != nil {
+			cr.ChannelRef.Mux.Unlock()
+		} else {
+			// Handle content
+			err = handleContent(cr)
+		}
+		if err == nil {
+			return
+		}
+
+		if attempt >= budget || cr.Request.Context().Err() != nil {
+			s.handleFailure(cr, err)
+			return
+		}
+		log.Printf("Refreshing link of '%s' (retry %d/%d): %v", cr.Title, attempt+1, budget, err)
+		cr.ChannelRef.invalidate()
+		select {
+		case <-cr.Request.Context().Done():
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+}
+
+// handleFailure attempts failover to other profiles and responds with an error if none succeeds.
+func (s *server) handleFailure(cr *ContentRequest, err error) {
+	log.Println(err)
+	if s.failover(cr) {
+		return
+	}
+	http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
 }
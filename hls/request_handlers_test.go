@@ -0,0 +1,26 @@
+package hls
+
+import "testing"
+
+func TestM3UEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		attr string
+		disp string
+	}{
+		{"plain", "BBC One", "BBC One", "BBC One"},
+		{"quotes", `Say "Hi"`, "Say 'Hi'", `Say "Hi"`},
+		{"injected lines", "News\n#EXTINF:-1,Fake\r\nhttp://evil/", "News #EXTINF:-1,Fake  http://evil/", "News #EXTINF:-1,Fake  http://evil/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m3uAttr(tt.in); got != tt.attr {
+				t.Errorf("m3uAttr(%q) = %q, want %q", tt.in, got, tt.attr)
+			}
+			if got := m3uName(tt.in); got != tt.disp {
+				t.Errorf("m3uName(%q) = %q, want %q", tt.in, got, tt.disp)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package hls
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSegmentCacheSize is the default byte budget of HLS segment cache.
+const DefaultSegmentCacheSize = 64 << 20
+
+// maxNextSegments limits how many "next segment" relations announced by media playlists are remembered.
+const maxNextSegments = 10000
+
+// DefaultSegmentMaxSize is the default limit of a single segment kept in memory.
+const DefaultSegmentMaxSize = 16 << 20
+
+// Media segment types; other links are segments only if a media playlist listed them after #EXTINF
+var segmentExtensions = []string{".ts", ".aac", ".m4s", ".mp4"}
+
+var errSegmentTooLarge = errors.New("segment exceeds size limit")
+
+// segment is a cached HLS segment.
+type segment struct {
+	link        string
+	contentType string
+	data        []byte
+}
+
+// segmentCall is an in-flight upstream fetch. Data is streamed to all requests of the segment
+// while it's downloaded, up to segment size limit.
+type segmentCall struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	ready       bool // Response headers received, or fetch failed
+	contentType string
+	data        []byte
+	done        bool // Fetch finished, failed or exceeded size limit
+	err         error
+}
+
+// segmentCache is an LRU cache of HLS segments keyed by upstream URL, limited by total size.
+type segmentCache struct {
+	mu       sync.Mutex
+	budget   int64
+	maxSize  int64 // Segments larger than this are not buffered, but passed through
+	size     int64
+	lru      *list.List               // Front is most recently used
+	entries  map[string]*list.Element // Values are *segment
+	inflight map[string]*segmentCall
+	next     map[string]string // Segment URL -> URL of the segment that follows it
+	listed   map[string]bool   // URLs listed after #EXTINF in media playlists
+
+	hits, misses, prefetches, evictions uint64
+}
+
+// SegmentCacheStats holds HLS segment cache counters.
+type SegmentCacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Prefetches uint64 `json:"prefetches"`
+	Evictions  uint64 `json:"evictions"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	Budget     int64  `json:"budget"`
+}
+
+var segments = newSegmentCache(DefaultSegmentCacheSize)
+
+func newSegmentCache(budget int64) *segmentCache {
+	return &segmentCache{
+		budget:   budget,
+		maxSize:  DefaultSegmentMaxSize,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*segmentCall),
+		next:     make(map[string]string),
+		listed:   make(map[string]bool),
+	}
+}
+
+// SetSegmentCacheSize changes byte budget of HLS segment cache. Zero disables caching.
+func SetSegmentCacheSize(budget int64) {
+	segments.mu.Lock()
+	segments.budget = budget
+	segments.evict()
+	segments.mu.Unlock()
+}
+
+// SetSegmentMaxSize changes size limit of a single segment kept in memory. Larger responses are
+// passed through to clients without caching.
+func SetSegmentMaxSize(max int64) {
+	segments.mu.Lock()
+	segments.maxSize = max
+	segments.mu.Unlock()
+}
+
+// GetSegmentCacheStats returns current HLS segment cache counters.
+func GetSegmentCacheStats() SegmentCacheStats {
+	segments.mu.Lock()
+	defer segments.mu.Unlock()
+	return SegmentCacheStats{
+		Hits:       segments.hits,
+		Misses:     segments.misses,
+		Prefetches: segments.prefetches,
+		Evictions:  segments.evictions,
+		Entries:    segments.lru.Len(),
+		Bytes:      segments.size,
+		Budget:     segments.budget,
+	}
+}
+
+// isSegment reports whether channel's relative path points to a media segment that can be cached:
+// a known media type, or a link listed after #EXTINF in a media playlist. Other links may be
+// playlists or continuous streams.
+func (c *segmentCache) isSegment(suffix, link string) bool {
+	p := strings.ToLower(suffix)
+	if i := strings.IndexByte(p, '?'); i > -1 {
+		p = p[:i]
+	}
+	for _, ext := range segmentExtensions {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listed[link]
+}
+
+// get returns segment from cache, or fetches it from upstream. Concurrent misses of the same
+// segment result in a single upstream request.
+func (c *segmentCache) get(client *http.Client, link string) (*segment, error) {
+	seg, call := c.fetch(client, link, false)
+	if seg != nil {
+		return seg, nil
+	}
+	return call.result(link)
+}
+
+// fetch returns cached segment, or upstream fetch of it, starting one if none is in progress.
+func (c *segmentCache) fetch(client *http.Client, link string, prefetch bool) (*segment, *segmentCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[link]; found {
+		c.lru.MoveToFront(el)
+		if !prefetch {
+			c.hits++
+		}
+		return el.Value.(*segment), nil
+	}
+	if call, found := c.inflight[link]; found {
+		if !prefetch {
+			c.hits++ // Served by a fetch that is already in progress
+		}
+		return nil, call
+	}
+	if prefetch {
+		c.prefetches++
+	} else {
+		c.misses++
+	}
+	call := &segmentCall{}
+	call.cond = sync.NewCond(&call.mu)
+	c.inflight[link] = call
+	go c.fill(call, client, link, c.maxSize)
+	return nil, call
+}
+
+// fill downloads segment into call's buffer, and caches it once complete. Download stops once
+// segment exceeds maxSize, and requests continue on their own (see passThrough).
+func (c *segmentCache) fill(call *segmentCall, client *http.Client, link string, maxSize int64) {
+	err := func() error {
+		resp, err := response(client, link)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		call.mu.Lock()
+		call.ready = true
+		call.contentType = resp.Header.Get("Content-Type")
+		call.mu.Unlock()
+		call.cond.Broadcast()
+
+		// Reading one byte past the limit tells whether limit was exceeded
+		body := io.LimitReader(resp.Body, maxSize+1)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				call.mu.Lock()
+				if int64(len(call.data)+n) > maxSize {
+					call.mu.Unlock()
+					return errSegmentTooLarge
+				}
+				call.data = append(call.data, buf[:n]...)
+				call.mu.Unlock()
+				call.cond.Broadcast()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}()
+
+	call.mu.Lock()
+	call.ready, call.done, call.err = true, true, err
+	call.mu.Unlock()
+	call.cond.Broadcast()
+
+	c.mu.Lock()
+	delete(c.inflight, link)
+	if err == nil {
+		c.add(&segment{link: link, contentType: call.contentType, data: call.data})
+	}
+	c.mu.Unlock()
+}
+
+// headers waits for upstream response headers and returns its content type.
+func (call *segmentCall) headers() (string, error) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	for !call.ready {
+		call.cond.Wait()
+	}
+	if call.done && call.err != nil && len(call.data) == 0 {
+		return "", call.err
+	}
+	return call.contentType, nil
+}
+
+// result waits for the whole segment.
+func (call *segmentCall) result(link string) (*segment, error) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	for !call.done {
+		call.cond.Wait()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return &segment{link: link, contentType: call.contentType, data: call.data}, nil
+}
+
+// copyTo writes segment to w as it's being downloaded. Returns number of bytes written, and
+// errSegmentTooLarge if w needs the rest of segment to be passed through.
+func (call *segmentCall) copyTo(w io.Writer) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	var off int
+	for {
+		call.mu.Lock()
+		for off == len(call.data) && !call.done {
+			call.cond.Wait()
+		}
+		chunk, done, err := call.data[off:], call.done, call.err
+		call.mu.Unlock()
+
+		if len(chunk) == 0 && done {
+			return int64(off), err
+		}
+		n, werr := w.Write(chunk)
+		off += n
+		if werr != nil {
+			return int64(off), werr
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// passThrough writes the rest of a segment that is too large to be buffered, starting at 'offset'.
+// Range is requested, so the rest continues where buffered data ended. If origin ignores it,
+// already written part of a file is skipped, while live streams (of unknown length) just continue.
+func passThrough(client *http.Client, link string, offset int64, w io.Writer) error {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := conditionalResponse(client, link, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent && resp.ContentLength > 0 {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// add stores segment in cache. Must be called with 'mu' locked.
+func (c *segmentCache) add(seg *segment) {
+	if getLinkType(seg.contentType) == linkTypeHLS || int64(len(seg.data)) > c.budget/2 {
+		return // Playlists must not be cached; segments this big would flush the whole cache
+	}
+	if _, found := c.entries[seg.link]; found {
+		return
+	}
+	c.entries[seg.link] = c.lru.PushFront(seg)
+	c.size += int64(len(seg.data))
+	c.evict()
+}
+
+// evict removes least recently used segments until cache fits into budget. Must be called with 'mu' locked.
+func (c *segmentCache) evict() {
+	for c.size > c.budget && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		seg := el.Value.(*segment)
+		c.lru.Remove(el)
+		delete(c.entries, seg.link)
+		c.size -= int64(len(seg.data))
+		c.evictions++
+	}
+}
+
+// announce remembers segments listed in a media playlist as cacheable, and their order, so the
+// next one can be prefetched.
+func (c *segmentCache) announce(links []string) {
+	if len(links) == 0 {
+		return
+	}
+	c.mu.Lock()
+	if len(c.next) > maxNextSegments {
+		c.next = make(map[string]string)
+	}
+	if len(c.listed) > maxNextSegments {
+		c.listed = make(map[string]bool)
+	}
+	for i := 0; i < len(links)-1; i++ {
+		c.next[links[i]] = links[i+1]
+	}
+	for _, link := range links {
+		c.listed[link] = true
+	}
+	c.mu.Unlock()
+}
+
+// prefetchAfter fetches the segment that follows given one in background.
+func (c *segmentCache) prefetchAfter(client *http.Client, link string) {
+	c.mu.Lock()
+	next, found := c.next[link]
+	c.mu.Unlock()
+	if !found {
+		return
+	}
+	c.fetch(client, next, true)
+}
@@ -0,0 +1,301 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmenterTargetDuration = 4.0              // Seconds; segments are cut on the first keyframe after this
+	segmenterWindow         = 6                // Segments listed in sliding-window playlist
+	segmenterMinSegments    = 2                // Segments to wait for before the first playlist is served
+	segmenterStartTimeout   = 20 * time.Second // Max wait for the first segments
+	segmenterIdleTimeout    = 30 * time.Second // Segmenter stops if nobody requests the channel for this long
+	segmenterMaxSegmentSize = 16 << 20         // Cut segment regardless of keyframes when it grows this big
+)
+
+// tsSegment is a single HLS segment cut out of MPEG-TS stream.
+type tsSegment struct {
+	seq      int
+	duration float64
+	data     []byte
+}
+
+// tsSegmenter turns shared raw MPEG-TS stream of a channel into sliding window of HLS segments.
+type tsSegmenter struct {
+	channel *Channel
+	cancel  context.CancelFunc
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	segments   []*tsSegment
+	nextSeq    int
+	lastAccess time.Time
+	done       bool
+
+	// Cutter state, used only by run()
+	cur      []byte
+	curDur   float64
+	lastPCR  int64
+	pmtPID   uint16
+	videoPID uint16
+	pat, pmt []byte // Last seen PAT and PMT packets, repeated at the start of every segment
+}
+
+var (
+	segmentersMu sync.Mutex
+	segmenters   = map[*Channel]*tsSegmenter{}
+)
+
+// getSegmenter returns running segmenter of a channel, or starts a new one on top of channel's
+// shared stream, using 'open' to connect to upstream.
+func getSegmenter(ch *Channel, open func() (*http.Response, error)) (*tsSegmenter, error) {
+	if sg := lookupSegmenter(ch); sg != nil {
+		return sg, nil
+	}
+
+	b, err := joinBroadcast(ch, open)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentersMu.Lock()
+	if sg, found := segmenters[ch]; found && !sg.isDone() {
+		// Someone else was faster
+		segmentersMu.Unlock()
+		b.leave()
+		sg.touch()
+		return sg, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sg := &tsSegmenter{channel: ch, cancel: cancel, lastAccess: time.Now(), lastPCR: -1}
+	sg.cond = sync.NewCond(&sg.mu)
+	segmenters[ch] = sg
+	segmentersMu.Unlock()
+
+	go sg.run(ctx, b)
+	go sg.watchIdle(ctx)
+	return sg, nil
+}
+
+// lookupSegmenter returns running segmenter of a channel or nil.
+func lookupSegmenter(ch *Channel) *tsSegmenter {
+	segmentersMu.Lock()
+	sg, found := segmenters[ch]
+	segmentersMu.Unlock()
+	if !found || sg.isDone() {
+		return nil
+	}
+	sg.touch()
+	return sg
+}
+
+func (sg *tsSegmenter) isDone() bool {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.done
+}
+
+func (sg *tsSegmenter) touch() {
+	sg.mu.Lock()
+	sg.lastAccess = time.Now()
+	sg.mu.Unlock()
+}
+
+// watchIdle stops segmenter once clients stop requesting its playlist and segments.
+func (sg *tsSegmenter) watchIdle(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sg.mu.Lock()
+			idle := time.Since(sg.lastAccess) > segmenterIdleTimeout
+			sg.mu.Unlock()
+			if idle {
+				sg.cancel()
+				return
+			}
+		}
+	}
+}
+
+// run reads shared stream and cuts it into segments until stream ends or segmenter is stopped.
+func (sg *tsSegmenter) run(ctx context.Context, b *broadcaster) {
+	defer b.leave()
+	defer sg.finish()
+
+	v := b.newViewer(ctx)
+	defer v.close()
+
+	buf := make([]byte, 64*tsPacketSize)
+	var pending []byte
+	for {
+		n, err := v.Read(buf)
+		pending = append(pending, buf[:n]...)
+		for len(pending) >= tsPacketSize {
+			if pending[0] != tsSyncByte {
+				// Lost packet alignment - find next sync byte
+				i := bytes.IndexByte(pending[1:], tsSyncByte)
+				if i < 0 {
+					pending = pending[:0]
+					break
+				}
+				pending = pending[i+1:]
+				continue
+			}
+			sg.handlePacket(tsPacket(pending[:tsPacketSize]))
+			pending = pending[tsPacketSize:]
+		}
+		pending = append([]byte(nil), pending...)
+
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Printf("Segmenter of '%s' stopped: %v", sg.channel.StalkerChannel.Title, err)
+			}
+			return
+		}
+	}
+}
+
+// handlePacket appends packet to current segment, cutting segment on keyframe once it's long enough.
+func (sg *tsSegmenter) handlePacket(p tsPacket) {
+	pid := p.pid()
+	switch {
+	case pid == tsPIDPAT:
+		if pmtPID, ok := parsePAT(p.psiSection()); ok {
+			sg.pmtPID = pmtPID
+			sg.pat = append(sg.pat[:0], p...)
+		}
+	case pid == sg.pmtPID && sg.pmtPID != 0:
+		if videoPID, ok := parsePMTVideoPID(p.psiSection()); ok {
+			sg.videoPID = videoPID
+			sg.pmt = append(sg.pmt[:0], p...)
+		}
+	}
+
+	if pcr, ok := p.pcr(); ok {
+		// Ignore PCR discontinuities and wrap-arounds
+		if d := pcr - sg.lastPCR; sg.lastPCR >= 0 && d > 0 && d < 10*pcrClock {
+			sg.curDur += float64(d) / pcrClock
+		}
+		sg.lastPCR = pcr
+	}
+
+	boundary := p.payloadStart() && (sg.videoPID == 0 || pid == sg.videoPID)
+	keyframe := boundary && p.randomAccess()
+	if len(sg.cur) > 0 && ((keyframe && sg.curDur >= segmenterTargetDuration) ||
+		(boundary && sg.curDur >= 3*segmenterTargetDuration) ||
+		len(sg.cur) >= segmenterMaxSegmentSize) {
+		sg.emit()
+	}
+
+	if len(sg.cur) == 0 && pid != tsPIDPAT && pid != sg.pmtPID {
+		sg.cur = append(sg.cur, sg.pat...)
+		sg.cur = append(sg.cur, sg.pmt...)
+	}
+	sg.cur = append(sg.cur, p...)
+}
+
+// emit publishes current segment and starts a new one.
+func (sg *tsSegmenter) emit() {
+	duration := sg.curDur
+	if duration <= 0 {
+		duration = segmenterTargetDuration
+	}
+	sg.mu.Lock()
+	sg.segments = append(sg.segments, &tsSegment{seq: sg.nextSeq, duration: duration, data: sg.cur})
+	sg.nextSeq++
+	if len(sg.segments) > segmenterWindow {
+		sg.segments = sg.segments[len(sg.segments)-segmenterWindow:]
+	}
+	sg.mu.Unlock()
+	sg.cond.Broadcast()
+
+	sg.cur = nil
+	sg.curDur = 0
+}
+
+// finish marks segmenter as done and removes it from the registry.
+func (sg *tsSegmenter) finish() {
+	sg.cancel()
+	sg.mu.Lock()
+	sg.done = true
+	sg.mu.Unlock()
+	sg.cond.Broadcast()
+
+	segmentersMu.Lock()
+	if segmenters[sg.channel] == sg {
+		delete(segmenters, sg.channel)
+	}
+	segmentersMu.Unlock()
+}
+
+// segment returns segment by its sequence number, or nil if it's not in the window anymore.
+func (sg *tsSegmenter) segment(seq int) *tsSegment {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	for _, seg := range sg.segments {
+		if seg.seq == seq {
+			return seg
+		}
+	}
+	return nil
+}
+
+// segmenterPrefix returns prefix of segment links of a channel.
+func segmenterPrefix(r *http.Request, title string) string {
+	return requestOrigin(r) + "/hls/" + url.PathEscape(title) + "/"
+}
+
+// writePlaylist writes sliding-window media playlist. Segment links are prefixed with 'prefix'.
+func (sg *tsSegmenter) writePlaylist(w http.ResponseWriter, prefix string) {
+	timer := time.AfterFunc(segmenterStartTimeout, func() {
+		sg.mu.Lock()
+		sg.mu.Unlock()
+		sg.cond.Broadcast()
+	})
+	deadline := time.Now().Add(segmenterStartTimeout)
+
+	sg.mu.Lock()
+	for len(sg.segments) < segmenterMinSegments && !sg.done && time.Now().Before(deadline) {
+		sg.cond.Wait()
+	}
+	window := append([]*tsSegment(nil), sg.segments...)
+	sg.mu.Unlock()
+	timer.Stop()
+
+	if len(window) == 0 {
+		http.Error(w, "stream is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	targetDuration := 0.0
+	for _, seg := range window {
+		targetDuration = math.Max(targetDuration, seg.duration)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&sb, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	fmt.Fprintf(&sb, "#EXT-X-MEDIA-SEQUENCE:%d\n", window[0].seq)
+	for _, seg := range window {
+		fmt.Fprintf(&sb, "#EXTINF:%.3f,\n%s%d.ts\n", seg.duration, prefix, seg.seq)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, sb.String())
+}
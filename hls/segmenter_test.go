@@ -0,0 +1,216 @@
+package hls
+
+import (
+	"sync"
+	"testing"
+)
+
+const (
+	testPMTPID   = 0x100
+	testVideoPID = 0x101
+	testAudioPID = 0x102
+)
+
+// testPacket builds MPEG-TS packet with optional adaptation field and payload.
+func testPacket(pid uint16, start bool, adaptation, payload []byte) tsPacket {
+	p := make(tsPacket, tsPacketSize)
+	for i := range p {
+		p[i] = 0xff
+	}
+	p[0] = tsSyncByte
+	p[1] = byte(pid>>8) & 0x1f
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	p[3] = 0x10
+	i := 4
+	if adaptation != nil {
+		p[3] |= 0x20
+		p[4] = byte(len(adaptation))
+		copy(p[5:], adaptation)
+		i += 1 + len(adaptation)
+	}
+	copy(p[i:], payload)
+	return p
+}
+
+// psiPacket builds packet carrying a PSI section.
+func psiPacket(pid uint16, section []byte) tsPacket {
+	return testPacket(pid, true, nil, append([]byte{0}, section...))
+}
+
+// patSection builds PAT listing given PMT PIDs as programs 1, 2, ...; PID 0 is a network PID.
+func patSection(pmtPIDs ...uint16) []byte {
+	length := 5 + 4*len(pmtPIDs) + 4
+	s := []byte{0x00, 0xb0 | byte(length>>8), byte(length), 0, 1, 0xc1, 0, 0}
+	for i, pid := range pmtPIDs {
+		program := i + 1
+		if pid == 0 {
+			program = 0
+		}
+		s = append(s, byte(program>>8), byte(program), 0xe0|byte(pid>>8), byte(pid))
+	}
+	return append(s, 0, 0, 0, 0) // CRC is not checked
+}
+
+// pmtSection builds PMT listing streams given as type and PID pairs.
+func pmtSection(streams ...[2]int) []byte {
+	length := 9 + 5*len(streams) + 4
+	s := []byte{0x02, 0xb0 | byte(length>>8), byte(length), 0, 1, 0xc1, 0, 0, 0xe0 | byte(testVideoPID>>8), byte(testVideoPID & 0xff), 0xf0, 0}
+	for _, st := range streams {
+		s = append(s, byte(st[0]), 0xe0|byte(st[1]>>8), byte(st[1]), 0xf0, 0)
+	}
+	return append(s, 0, 0, 0, 0)
+}
+
+// videoPacket builds packet starting a video frame with PCR at 'seconds'.
+func videoPacket(seconds float64, keyframe bool) tsPacket {
+	flags := byte(0x10) // PCR
+	if keyframe {
+		flags |= 0x40
+	}
+	pcr := int64(seconds * pcrClock)
+	adaptation := []byte{flags, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7e, 0}
+	return testPacket(testVideoPID, true, adaptation, []byte{0, 0, 1, 0xe0})
+}
+
+func TestParsePAT(t *testing.T) {
+	tests := []struct {
+		name    string
+		section []byte
+		pid     uint16
+		ok      bool
+	}{
+		{"single program", patSection(testPMTPID), testPMTPID, true},
+		{"network PID is skipped", patSection(0, 0x200), 0x200, true},
+		{"only network PID", patSection(0), 0, false},
+		{"not a PAT", append([]byte{0x02}, patSection(testPMTPID)[1:]...), 0, false},
+		{"truncated", patSection(testPMTPID)[:10], 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, ok := parsePAT(tt.section)
+			if pid != tt.pid || ok != tt.ok {
+				t.Errorf("parsePAT() = %#x, %v; want %#x, %v", pid, ok, tt.pid, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParsePMTVideoPID(t *testing.T) {
+	tests := []struct {
+		name    string
+		section []byte
+		pid     uint16
+		ok      bool
+	}{
+		{"H.264", pmtSection([2]int{0x1b, testVideoPID}), testVideoPID, true},
+		{"H.265 after audio", pmtSection([2]int{0x0f, testAudioPID}, [2]int{0x24, testVideoPID}), testVideoPID, true},
+		{"MPEG-2", pmtSection([2]int{0x02, testVideoPID}), testVideoPID, true},
+		{"audio only", pmtSection([2]int{0x0f, testAudioPID}, [2]int{0x03, 0x103}), 0, false},
+		{"not a PMT", patSection(testPMTPID, testPMTPID), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, ok := parsePMTVideoPID(tt.section)
+			if pid != tt.pid || ok != tt.ok {
+				t.Errorf("parsePMTVideoPID() = %#x, %v; want %#x, %v", pid, ok, tt.pid, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPacketPCR(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet tsPacket
+		pcr    int64
+		ok     bool
+	}{
+		{"zero", videoPacket(0, false), 0, true},
+		{"odd base", videoPacket(1.0/pcrClock, false), 1, true},
+		{"one hour", videoPacket(3600, true), 3600 * pcrClock, true},
+		{"no adaptation field", testPacket(testVideoPID, true, nil, nil), 0, false},
+		{"no PCR flag", testPacket(testVideoPID, true, []byte{0x40}, nil), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcr, ok := tt.packet.pcr()
+			if pcr != tt.pcr || ok != tt.ok {
+				t.Errorf("pcr() = %d, %v; want %d, %v", pcr, ok, tt.pcr, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSegmenterCuts(t *testing.T) {
+	type frame struct {
+		at       float64 // PCR in seconds
+		keyframe bool
+	}
+	// every returns frames once a second from 'from' to 'to' (exclusive), keyframes at 'keys'.
+	every := func(from, to int, keys ...int) []frame {
+		var out []frame
+		for s := from; s < to; s++ {
+			key := false
+			for _, k := range keys {
+				key = key || k == s
+			}
+			out = append(out, frame{float64(s), key})
+		}
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		frames    []frame
+		durations []float64 // Of emitted segments
+	}{
+		{"cut on keyframe after target duration", every(0, 6, 0, 4), []float64{4}},
+		{"keyframe before target duration does not cut", every(0, 7, 0, 2, 5), []float64{5}},
+		{"segments in a row", every(0, 10, 0, 4, 8), []float64{4, 4}},
+		{"cut without keyframe at 3x target duration", every(0, 14, 0), []float64{12}},
+		{"PCR jump is not counted", append(every(0, 3, 0), every(22, 26, 24)...), []float64{4}},
+		{"PCR going backwards is not counted", append(every(10, 13, 10), every(0, 3, 2)...), []float64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sg := &tsSegmenter{lastPCR: -1}
+			sg.cond = sync.NewCond(&sg.mu)
+			pat := psiPacket(tsPIDPAT, patSection(testPMTPID))
+			pmt := psiPacket(testPMTPID, pmtSection([2]int{0x0f, testAudioPID}, [2]int{0x1b, testVideoPID}))
+			sg.handlePacket(pat)
+			sg.handlePacket(pmt)
+			for _, f := range tt.frames {
+				sg.handlePacket(videoPacket(f.at, f.keyframe))
+				// Audio packets never start a segment
+				sg.handlePacket(testPacket(testAudioPID, true, nil, []byte{0, 0, 1, 0xc0}))
+			}
+
+			if sg.videoPID != testVideoPID {
+				t.Fatalf("video PID = %#x, want %#x", sg.videoPID, testVideoPID)
+			}
+			if len(sg.segments) != len(tt.durations) {
+				t.Fatalf("got %d segments, want %d", len(sg.segments), len(tt.durations))
+			}
+			for i, seg := range sg.segments {
+				if seg.seq != i {
+					t.Errorf("segment %d has sequence number %d", i, seg.seq)
+				}
+				if seg.duration != tt.durations[i] {
+					t.Errorf("segment %d lasts %gs, want %gs", i, seg.duration, tt.durations[i])
+				}
+				// Every segment must be decodable on its own
+				if len(seg.data) < 3*tsPacketSize || string(seg.data[:tsPacketSize]) != string(pat) ||
+					string(seg.data[tsPacketSize:2*tsPacketSize]) != string(pmt) {
+					t.Errorf("segment %d does not start with PAT and PMT", i)
+					continue
+				}
+				if p := tsPacket(seg.data[2*tsPacketSize : 3*tsPacketSize]); p.pid() != testVideoPID || !p.randomAccess() {
+					t.Errorf("segment %d does not start with a keyframe", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package hls
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sessionKickBan      = time.Minute      // Kicked client can't reopen the same channel this long
+	sessionBitrateCycle = 10 * time.Second // Bitrate is averaged over at least this long
+)
+
+// Session is a client watching a channel of a running profile.
+type Session struct {
+	ID          string    `json:"id"`
+	Source      string    `json:"source"` // "hls", "dvr" or "proxy"
+	ProfileID   int       `json:"profile_id"`
+	Channel     string    `json:"channel"`
+	ClientIP    string    `json:"client_ip"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Started     time.Time `json:"started"`
+	LastSeen    time.Time `json:"last_seen"`
+	Connections int       `json:"connections"` // Open connections; HLS clients reconnect for every segment
+	BytesSent   int64     `json:"bytes_sent"`
+	BitrateKbps int64     `json:"bitrate_kbps"`
+	Kickable    bool      `json:"kickable"`
+}
+
+var lastSessionID int64 // Accessed atomically
+
+// session collects statistics of a client of a stream. Fields other than bytes are guarded by
+// limiter's lock.
+type session struct {
+	id        int64
+	addr      string
+	userAgent string
+	started   time.Time
+	lastSeen  time.Time
+	bytes     int64 // Accessed atomically
+
+	sampleBytes int64 // Bytes sent at sampleTime, used for bitrate
+	sampleTime  time.Time
+	bitrate     int64 // Kbps over the last completed cycle
+}
+
+// kickKey identifies a client of a channel.
+type kickKey struct {
+	channel *Channel
+	addr    string
+}
+
+func newSession(addr string, now time.Time) *session {
+	return &session{
+		id:         atomic.AddInt64(&lastSessionID, 1),
+		addr:       addr,
+		started:    now,
+		sampleTime: now,
+	}
+}
+
+// sample updates session's bitrate once a cycle is over. Must be called with limiter's lock held.
+func (sess *session) sample(now time.Time) {
+	elapsed := now.Sub(sess.sampleTime)
+	if elapsed < sessionBitrateCycle {
+		return
+	}
+	bytes := atomic.LoadInt64(&sess.bytes)
+	sess.bitrate = (bytes - sess.sampleBytes) * 8 / elapsed.Milliseconds()
+	sess.sampleBytes, sess.sampleTime = bytes, now
+}
+
+// writer counts bytes written to w as sent to the session's client.
+func (sess *session) writer(w io.Writer) io.Writer {
+	return countingWriter{w: w, n: &sess.bytes}
+}
+
+// responseWriter counts bytes written to w as sent to the session's client.
+func (sess *session) responseWriter(w http.ResponseWriter) http.ResponseWriter {
+	return countingResponseWriter{ResponseWriter: w, n: &sess.bytes}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// countingResponseWriter is countingWriter that keeps streaming responses flushable.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (cw countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+func (cw countingResponseWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sessions returns sessions of all streams, oldest first.
+func (l *streamLimiter) sessions(profileID int) []Session {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	var out []Session
+	for _, st := range l.streams {
+		conns := make(map[*session]int)
+		for c := range st.clients {
+			conns[c.session]++
+		}
+		for _, sess := range st.sessions {
+			sess.sample(now)
+			source := "hls"
+			if sess.addr == recordingClient {
+				source = "dvr"
+			}
+			out = append(out, Session{
+				ID:          "hls-" + strconv.FormatInt(sess.id, 10),
+				Source:      source,
+				ProfileID:   profileID,
+				Channel:     st.title,
+				ClientIP:    sess.addr,
+				UserAgent:   sess.userAgent,
+				Started:     sess.started,
+				LastSeen:    sess.lastSeen,
+				Connections: conns[sess],
+				BytesSent:   atomic.LoadInt64(&sess.bytes),
+				BitrateKbps: sess.bitrate,
+				Kickable:    true,
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// kick disconnects a session and bans its client from the channel for a while, as players
+// reconnect right away. Returns false if there is no such session.
+func (l *streamLimiter) kick(id int64) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch, st := range l.streams {
+		for addr, sess := range st.sessions {
+			if sess.id != id {
+				continue
+			}
+			for c := range st.clients {
+				if c.session == sess {
+					c.cancel()
+				}
+			}
+			delete(st.sessions, addr)
+			l.kicked[kickKey{ch, addr}] = now.Add(sessionKickBan)
+			log.Printf("Kicked %s from '%s'", addr, st.title)
+			return true
+		}
+	}
+	return false
+}
+
+// GetSessions returns active sessions of a running profile, or of all running profiles if
+// profileID is 0.
+func GetSessions(profileID int) []Session {
+	serversMu.RLock()
+	list := make([]*server, 0, len(servers))
+	for id, s := range servers {
+		if profileID == 0 || id == profileID {
+			list = append(list, s)
+		}
+	}
+	serversMu.RUnlock()
+
+	out := []Session{}
+	for _, s := range list {
+		out = append(out, s.streams.sessions(s.opts.ProfileID)...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// KickSession disconnects a session returned by GetSessions. Returns false if it's not active.
+func KickSession(id string) bool {
+	n, err := strconv.ParseInt(strings.TrimPrefix(id, "hls-"), 10, 64)
+	if err != nil || !strings.HasPrefix(id, "hls-") {
+		return false
+	}
+	serversMu.RLock()
+	defer serversMu.RUnlock()
+	for _, s := range servers {
+		if s.streams.kick(n) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of stream fetching timeouts
+const (
+	DefaultConnectTimeout   = 10 * time.Second
+	DefaultFirstByteTimeout = 15 * time.Second
+	DefaultIdleTimeout      = 20 * time.Second
+)
+
+// Phases of upstream request a stall was detected in
+const (
+	stallConnect   = "connect"
+	stallFirstByte = "first_byte"
+	stallIdle      = "idle"
+)
+
+// stallError is returned by requests and response bodies of stalled upstreams.
+type stallError struct {
+	phase string
+	after time.Duration
+}
+
+func (e *stallError) Error() string {
+	return "upstream stalled (" + e.phase + " timeout after " + e.after.String() + ")"
+}
+
+func (e *stallError) Timeout() bool   { return true }
+func (e *stallError) Temporary() bool { return true }
+
+// isStall reports whether err was caused by a stalled upstream.
+func isStall(err error) bool {
+	var se *stallError
+	return errors.As(err, &se)
+}
+
+// StallStats counts stalls of a channel's upstream by phase they were detected in.
+type StallStats struct {
+	Connect   uint64    `json:"connect"`    // Connection was not established in time
+	FirstByte uint64    `json:"first_byte"` // Response headers did not arrive in time
+	Idle      uint64    `json:"idle"`       // Body stopped flowing mid-stream
+	Last      time.Time `json:"last"`
+	LastPhase string    `json:"last_phase"`
+}
+
+// stallStats holds stall counters of a profile's channels by title, so they survive channel list
+// updates.
+type stallStats struct {
+	mu     sync.Mutex
+	byChan map[string]*StallStats
+}
+
+func (st *stallStats) record(title, phase string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.byChan == nil {
+		st.byChan = make(map[string]*StallStats)
+	}
+	c, found := st.byChan[title]
+	if !found {
+		c = &StallStats{}
+		st.byChan[title] = c
+	}
+	switch phase {
+	case stallConnect:
+		c.Connect++
+	case stallFirstByte:
+		c.FirstByte++
+	case stallIdle:
+		c.Idle++
+	}
+	c.Last = time.Now()
+	c.LastPhase = phase
+}
+
+// get returns stall counters of a channel, or nil if it never stalled.
+func (st *stallStats) get(title string) *StallStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if c, found := st.byChan[title]; found {
+		out := *c
+		return &out
+	}
+	return nil
+}
+
+// withConnectTimeout returns copy of transport whose dials fail after 'timeout'. Transports that
+// are not *http.Transport are returned as they are.
+func withConnectTimeout(transport http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t, ok := transport.(*http.Transport)
+	if !ok || timeout <= 0 {
+		return transport
+	}
+	t = t.Clone()
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := dial(ctx, network, addr)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return nil, &stallError{stallConnect, timeout}
+		}
+		return conn, err
+	}
+	if t.TLSHandshakeTimeout == 0 || t.TLSHandshakeTimeout > timeout {
+		t.TLSHandshakeTimeout = timeout
+	}
+	return t
+}
+
+// stallTransport fails upstream requests whose response headers don't arrive within firstByte,
+// and response bodies that deliver nothing for idle. Every stall is reported to onStall.
+type stallTransport struct {
+	base      http.RoundTripper
+	firstByte time.Duration
+	idle      time.Duration
+	onStall   func(phase string)
+}
+
+func (t stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	// Whichever comes first, response or first byte timeout, claims the request. Once response
+	// claimed it, timer no longer cancels its context, so the body stays readable.
+	var state int32 // 0 pending, 1 timed out, 2 responded
+	var timer *time.Timer
+	if t.firstByte > 0 {
+		timer = time.AfterFunc(t.firstByte, func() {
+			if atomic.CompareAndSwapInt32(&state, 0, 1) {
+				cancel()
+			}
+		})
+	}
+	resp, err := base.RoundTrip(req.WithContext(ctx))
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		t.onStall(stallFirstByte)
+		return nil, &stallError{stallFirstByte, t.firstByte}
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		cancel()
+		if isStall(err) {
+			t.onStall(stallConnect)
+		}
+		return nil, err
+	}
+	if t.idle > 0 {
+		b := &stallBody{ReadCloser: resp.Body, t: t, cancel: cancel}
+		b.timer = time.AfterFunc(t.idle, b.fire)
+		b.timer.Stop() // Armed by reads only
+		resp.Body = b
+	} else {
+		resp.Body = cancelBody{resp.Body, cancel}
+	}
+	return resp, nil
+}
+
+// stallBody aborts reads that deliver nothing for transport's idle timeout. Time spent between
+// reads, e.g. while writing to a slow client, does not count.
+type stallBody struct {
+	since int64 // Start of current read in Unix nanoseconds, set atomically; first for 64-bit alignment
+	io.ReadCloser
+	t      stallTransport
+	cancel context.CancelFunc
+	timer  *time.Timer
+	state  int32 // Set atomically: 0 idle, 1 reading, 2 stalled
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&b.state, 0, 1) {
+		return 0, &stallError{stallIdle, b.t.idle}
+	}
+	atomic.StoreInt64(&b.since, time.Now().UnixNano())
+	b.timer.Reset(b.t.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	// Read that returned before the timer claimed it is delivered as it is
+	if !atomic.CompareAndSwapInt32(&b.state, 1, 0) {
+		return n, &stallError{stallIdle, b.t.idle}
+	}
+	return n, err
+}
+
+func (b *stallBody) fire() {
+	// Late timer of a previous read must not abort the current one
+	if time.Now().UnixNano()-atomic.LoadInt64(&b.since) < int64(b.t.idle) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&b.state, 1, 2) {
+		b.t.onStall(stallIdle)
+		b.cancel() // Unblocks pending read
+	}
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// cancelBody releases request's context once body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// streamTimeouts returns stream fetching timeouts of the service with defaults applied. Negative
+// options disable their timeout.
+func (s *server) streamTimeouts() (connect, firstByte, idle time.Duration) {
+	pick := func(d, def time.Duration) time.Duration {
+		switch {
+		case d == 0:
+			return def
+		case d < 0:
+			return 0
+		}
+		return d
+	}
+	return pick(s.opts.ConnectTimeout, DefaultConnectTimeout),
+		pick(s.opts.FirstByteTimeout, DefaultFirstByteTimeout),
+		pick(s.opts.IdleTimeout, DefaultIdleTimeout)
+}
+
+// stallTransport wraps transport of channel's upstream requests with stall detection.
+func (s *server) stallTransport(title string, base http.RoundTripper) http.RoundTripper {
+	_, firstByte, idle := s.streamTimeouts()
+	return stallTransport{
+		base:      base,
+		firstByte: firstByte,
+		idle:      idle,
+		onStall: func(phase string) {
+			log.Printf("Upstream of '%s' stalled (%s)", title, phase)
+			s.stalls.record(title, phase)
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package hls
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallServer serves "/fast" at once, "/slow-headers" after a delay, "/stops" that sends one chunk
+// and then nothing, and "/steady" that sends a chunk every 20ms.
+func stallServer(done chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fast":
+			w.Write([]byte("abc"))
+		case "/slow-headers":
+			select {
+			case <-time.After(300 * time.Millisecond):
+			case <-r.Context().Done():
+			case <-done:
+			}
+		case "/stops":
+			w.Write([]byte("abc"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		case "/steady":
+			for i := 0; i < 5; i++ {
+				w.Write([]byte{'a' + byte(i)})
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}))
+}
+
+func TestStallTransport(t *testing.T) {
+	done := make(chan struct{})
+	srv := stallServer(done)
+	defer srv.Close()
+	defer close(done)
+
+	tests := []struct {
+		name    string
+		path    string
+		between time.Duration // Pause of consumer between reads
+		body    string        // Read before error, if any
+		phase   string        // Stall detected, if any
+	}{
+		{"timely response", "/fast", 0, "abc", ""},
+		{"slow headers", "/slow-headers", 0, "", stallFirstByte},
+		{"body stops mid-stream", "/stops", 0, "abc", stallIdle},
+		{"steady body", "/steady", 0, "abcde", ""},
+		{"slow consumer is not a stall", "/steady", 150 * time.Millisecond, "abcde", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stalls stallStats
+			client := &http.Client{Transport: stallTransport{
+				base:      srv.Client().Transport,
+				firstByte: 100 * time.Millisecond,
+				idle:      100 * time.Millisecond,
+				onStall:   func(phase string) { stalls.record(tt.name, phase) },
+			}}
+
+			var body strings.Builder
+			resp, err := client.Get(srv.URL + tt.path)
+			if err == nil {
+				buf := make([]byte, 16)
+				for {
+					var n int
+					n, err = resp.Body.Read(buf)
+					body.Write(buf[:n])
+					if err != nil {
+						break
+					}
+					time.Sleep(tt.between)
+				}
+				resp.Body.Close()
+			}
+
+			if body.String() != tt.body {
+				t.Errorf("read %q, want %q", body.String(), tt.body)
+			}
+			var se *stallError
+			if errors.As(err, &se) != (tt.phase != "") || se != nil && se.phase != tt.phase {
+				t.Errorf("error = %v, want stall %q", err, tt.phase)
+			}
+			got := stalls.get(tt.name)
+			if (got != nil) != (tt.phase != "") || got != nil && got.LastPhase != tt.phase {
+				t.Errorf("recorded stalls %+v, want stall %q", got, tt.phase)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package hls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stitchStartSegments   = 3 // Continuous stream starts this many segments behind live edge
+	stitchMaxFailures     = 5 // Stream ends after this many consecutive playlist reload failures
+	stitchDefaultDuration = 10 * time.Second
+)
+
+// mediaSegment is a segment listed in HLS media playlist.
+type mediaSegment struct {
+	seq           int
+	link          string
+	duration      time.Duration
+	discontinuity bool
+}
+
+// mediaPlaylist is a parsed HLS media playlist.
+type mediaPlaylist struct {
+	targetDuration time.Duration
+	mediaSequence  int
+	segments       []mediaSegment
+	endList        bool
+}
+
+// parsePlaylist parses HLS playlist. If it's a master playlist, link of its first variant is
+// returned instead.
+func parsePlaylist(body io.Reader, base *url.URL) (*mediaPlaylist, string, error) {
+	pl := &mediaPlaylist{targetDuration: stitchDefaultDuration}
+	var duration time.Duration
+	discontinuity, variant := false, false
+
+	resolve := func(link string) string {
+		u, err := url.Parse(link)
+		if err != nil {
+			return link
+		}
+		return base.ResolveReference(u).String()
+	}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			variant = true
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if v, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil && v > 0 {
+				pl.targetDuration = time.Duration(v) * time.Second
+			}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			pl.mediaSequence, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.IndexByte(v, ','); i > -1 {
+				v = v[:i]
+			}
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				duration = time.Duration(f * float64(time.Second))
+			}
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case line == "#EXT-X-ENDLIST":
+			pl.endList = true
+		case strings.HasPrefix(line, "#"):
+		case variant:
+			return nil, resolve(line), nil
+		default:
+			pl.segments = append(pl.segments, mediaSegment{
+				seq:           pl.mediaSequence + len(pl.segments),
+				link:          resolve(line),
+				duration:      duration,
+				discontinuity: discontinuity,
+			})
+			duration, discontinuity = 0, false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	return pl, "", nil
+}
+
+// loadMediaPlaylist downloads media playlist. Master playlists are resolved to the variant picked
+// by policy. Returns playlist and its link, which should be used for reloads.
+func loadMediaPlaylist(client *http.Client, link string, policy VariantPolicy) (*mediaPlaylist, string, error) {
+	for i := 0; i < 3; i++ {
+		resp, err := response(client, link)
+		if err != nil {
+			return nil, "", err
+		}
+		lines, err := readPlaylistLines(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		if v := policy.pick(parseVariants(lines)); v != nil {
+			u, err := resp.Request.URL.Parse(v.link)
+			if err != nil {
+				return nil, "", err
+			}
+			link = u.String()
+			continue
+		}
+		pl, _, err := parsePlaylist(strings.NewReader(strings.Join(lines, "\n")), resp.Request.URL)
+		if err != nil {
+			return nil, "", err
+		}
+		return pl, link, nil
+	}
+	return nil, "", errors.New("too many nested master playlists at " + link)
+}
+
+// handleContentHLSStream serves HLS channel as a single continuous MPEG-TS stream. It follows
+// upstream media playlist and writes its segments in order.
+func handleContentHLSStream(cr *ContentRequest) error {
+	client := cr.Channel.client
+	pl, link, err := loadMediaPlaylist(client, cr.Channel.HLSLink, cr.Variants)
+	if err != nil {
+		return err
+	}
+
+	w := cr.ResponseWriter
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.WriteHeader(http.StatusOK)
+
+	if err := stitch(cr.Request.Context(), client, cr.Title, pl, link, flushWriter{w}); err != nil {
+		log.Printf("Continuous stream of '%s' ended: %v", cr.Title, err)
+	}
+	return nil
+}
+
+// stitch writes segments of HLS media playlist to w in order, reloading playlist from 'link'
+// until it ends or ctx is done. Returns error if writing fails or playlist can't be reloaded.
+func stitch(ctx context.Context, client *http.Client, title string, pl *mediaPlaylist, link string, w io.Writer) error {
+	next := -1             // Media sequence number of the next segment to write
+	discontinuity := false // Next written segment does not continue the previous one
+	failures := 0
+	for {
+		if end := pl.mediaSequence + len(pl.segments); next < pl.mediaSequence || next > end {
+			// Start near live edge. Also restart there if we fell out of playlist window or
+			// upstream restarted its sequence numbers.
+			if next >= 0 {
+				discontinuity = true
+			}
+			next = end - stitchStartSegments
+			if next < pl.mediaSequence {
+				next = pl.mediaSequence
+			}
+		}
+
+		wrote := false
+		for _, ms := range pl.segments[next-pl.mediaSequence:] {
+			if ctx.Err() != nil {
+				return nil
+			}
+			next = ms.seq + 1
+			seg, err := segments.get(client, ms.link)
+			if err != nil || getLinkType(seg.contentType) == linkTypeHLS {
+				if err != nil {
+					log.Printf("Skipping segment of '%s': %v", title, err)
+				}
+				discontinuity = true
+				continue
+			}
+
+			data := seg.data
+			if discontinuity || ms.discontinuity {
+				data = markDiscontinuity(data)
+				discontinuity = false
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			wrote = true
+		}
+
+		if pl.endList {
+			return nil
+		}
+
+		// Reload playlist after a target duration, or sooner if it had nothing new
+		wait := pl.targetDuration
+		if !wrote {
+			wait /= 2
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		reloaded, _, err := loadMediaPlaylist(client, link, VariantPolicy{})
+		if err != nil {
+			failures++
+			if failures >= stitchMaxFailures {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		pl = reloaded
+	}
+}
+
+// flushWriter flushes every write, so stream reaches the client as it goes.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// markDiscontinuity returns copy of MPEG-TS data with discontinuity indicator set on the first
+// packet of every PID that has an adaptation field, so decoders reset their clocks and continuity
+// counters. Packets without one are left as they are, as adding it would shift their payload.
+func markDiscontinuity(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	seen := make(map[uint16]bool)
+	for i := 0; i+tsPacketSize <= len(out); i += tsPacketSize {
+		p := tsPacket(out[i : i+tsPacketSize])
+		if p[0] != tsSyncByte || seen[p.pid()] || !p.hasAdaptation() {
+			continue
+		}
+		seen[p.pid()] = true
+		p[5] |= 0x80
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package hls
+
+import "testing"
+
+func TestMarkDiscontinuity(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []tsPacket
+		marked  []bool // By packet
+	}{
+		{
+			"first packet of every PID",
+			[]tsPacket{videoPacket(0, true), testPacket(testAudioPID, true, []byte{0}, nil), videoPacket(1, false)},
+			[]bool{true, true, false},
+		},
+		{
+			"first packet with adaptation field",
+			[]tsPacket{testPacket(testAudioPID, true, nil, nil), testPacket(testAudioPID, false, []byte{0}, nil), testPacket(testAudioPID, false, []byte{0}, nil)},
+			[]bool{false, true, false},
+		},
+		{
+			"empty adaptation field is left as it is",
+			[]tsPacket{testPacket(testAudioPID, true, []byte{}, []byte{1}), testPacket(testAudioPID, false, []byte{0}, nil)},
+			[]bool{false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data []byte
+			for _, p := range tt.packets {
+				data = append(data, p...)
+			}
+			in := string(data)
+			out := markDiscontinuity(data)
+			if string(data) != in {
+				t.Error("input data was modified")
+			}
+			for i, want := range tt.marked {
+				p := tsPacket(out[i*tsPacketSize : (i+1)*tsPacketSize])
+				if marked := p.hasAdaptation() && p[5]&0x80 != 0; marked != want {
+					t.Errorf("packet %d marked = %v, want %v", i, marked, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies applied when a new stream would exceed profile's stream limit
+const (
+	PolicyReject          = "reject"           // New viewer gets HTTP 503
+	PolicyPreemptOldest   = "preempt-oldest"   // Stream that started first is stopped
+	PolicyPreemptPriority = "preempt-priority" // Stream of the lowest-priority client is stopped, if it's lower than new client's
+)
+
+const (
+	streamIdleWindow = 20 * time.Second // Stream without open connections stays active this long, as HLS clients reconnect for every segment
+	preemptCooldown  = 30 * time.Second // Preempted clients can't preempt other streams this long, so two TVs don't take turns endlessly
+)
+
+var (
+	errStreamLimit = errors.New("stream limit of this profile is reached")
+	errKicked      = errors.New("session was ended by administrator")
+)
+
+// streamClient is an open client connection of a stream.
+type streamClient struct {
+	session *session
+	cancel  context.CancelFunc
+}
+
+// activeStream is an upstream stream used by one or more clients. Viewers of the same channel
+// share upstream, so they count as one stream.
+type activeStream struct {
+	channel  *Channel
+	title    string
+	started  time.Time
+	lastSeen time.Time
+	priority int // Highest priority of its clients
+	clients  map[*streamClient]bool
+	sessions map[string]*session // Client address -> its session, kept between HLS requests
+}
+
+// clientRule is a setting of a client address (or recordingClient) or of a network.
+type clientRule struct {
+	addr    string
+	network *net.IPNet
+	value   int64
+}
+
+// clientRules holds per-client settings keyed by IP address or CIDR network.
+type clientRules []clientRule
+
+func parseClientRules(m map[string]int64) clientRules {
+	var rules clientRules
+	for k, v := range m {
+		if _, network, err := net.ParseCIDR(k); err == nil {
+			rules = append(rules, clientRule{network: network, value: v})
+		} else {
+			rules = append(rules, clientRule{addr: k, value: v})
+		}
+	}
+	return rules
+}
+
+// match returns setting of a client. Exact addresses win over networks, and more specific
+// networks over broader ones.
+func (rules clientRules) match(addr string) (int64, bool) {
+	var best int64
+	bestOnes := -1
+	ip := net.ParseIP(addr)
+	for _, r := range rules {
+		if r.addr != "" {
+			if r.addr == addr {
+				return r.value, true
+			}
+			continue
+		}
+		if ones, _ := r.network.Mask.Size(); ip != nil && r.network.Contains(ip) && ones > bestOnes {
+			best, bestOnes = r.value, ones
+		}
+	}
+	return best, bestOnes > -1
+}
+
+// streamLimiter keeps track of profile's upstream streams and enforces its stream limit.
+type streamLimiter struct {
+	max        int
+	policy     string
+	priorities clientRules
+	allow      func(addr string) error // Checks whether a client may start a new session, if set
+
+	mu        sync.Mutex
+	streams   map[*Channel]*activeStream
+	probes    map[*Channel]context.CancelFunc // Running health probes, which hold a stream slot
+	preempted map[string]time.Time            // Client address -> end of its cooldown
+	kicked    map[kickKey]time.Time           // Kicked client of a channel -> end of its ban
+}
+
+func newStreamLimiter(max int, policy string, priorities map[string]int) *streamLimiter {
+	l := &streamLimiter{
+		max:       max,
+		policy:    policy,
+		streams:   make(map[*Channel]*activeStream),
+		probes:    make(map[*Channel]context.CancelFunc),
+		preempted: make(map[string]time.Time),
+		kicked:    make(map[kickKey]time.Time),
+	}
+	switch l.policy {
+	case PolicyReject, PolicyPreemptOldest, PolicyPreemptPriority:
+	case "":
+		l.policy = PolicyReject
+	default:
+		log.Printf("Unknown stream policy '%s', rejecting new streams over the limit instead", policy)
+		l.policy = PolicyReject
+	}
+	rules := make(map[string]int64, len(priorities))
+	for k, v := range priorities {
+		rules[k] = int64(v)
+	}
+	l.priorities = parseClientRules(rules)
+	return l
+}
+
+// priority returns priority of a client. Unknown clients have priority 0.
+func (l *streamLimiter) priority(addr string) int {
+	p, _ := l.priorities.match(addr)
+	return int(p)
+}
+
+// admit registers a client of channel's stream. If the stream is not running yet and profile's
+// stream limit is reached, another stream is preempted according to policy, or errStreamLimit is
+// returned. Returned context is cancelled if the stream gets preempted or client's session gets
+// kicked; release must be called once client is done.
+func (l *streamLimiter) admit(parent context.Context, ch *Channel, title, addr, userAgent string) (context.Context, *session, func(), error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	if now.Before(l.kicked[kickKey{ch, addr}]) {
+		return nil, nil, nil, errKicked
+	}
+
+	st, found := l.streams[ch]
+	if l.allow != nil && (!found || st.sessions[addr] == nil) {
+		if err := l.allow(addr); err != nil {
+			log.Printf("Rejected '%s' for %s: %v", title, addr, err)
+			return nil, nil, nil, err
+		}
+	}
+
+	prio := l.priority(addr)
+	if !found {
+		// Viewers take precedence over health probes
+		if probe, probing := l.probes[ch]; probing {
+			probe()
+			delete(l.probes, ch)
+		}
+		for other, probe := range l.probes {
+			if l.max <= 0 || len(l.streams)+len(l.probes) < l.max {
+				break
+			}
+			probe()
+			delete(l.probes, other)
+		}
+		if l.max > 0 && len(l.streams)+len(l.probes) >= l.max {
+			victim := l.victim(addr, prio, now)
+			if victim == nil {
+				log.Printf("Rejected '%s' for %s: %v", title, addr, errStreamLimit)
+				return nil, nil, nil, errStreamLimit
+			}
+			log.Printf("Preempting '%s' for '%s' of %s (policy %s)", victim.title, title, addr, l.policy)
+			l.preempt(victim, now)
+		}
+		st = &activeStream{
+			channel:  ch,
+			title:    title,
+			started:  now,
+			priority: prio,
+			clients:  make(map[*streamClient]bool),
+			sessions: make(map[string]*session),
+		}
+		l.streams[ch] = st
+	}
+
+	sess, found := st.sessions[addr]
+	if !found {
+		sess = newSession(addr, now)
+		st.sessions[addr] = sess
+	}
+	if userAgent != "" {
+		sess.userAgent = userAgent
+	}
+	sess.lastSeen = now
+
+	ctx, cancel := context.WithCancel(parent)
+	c := &streamClient{session: sess, cancel: cancel}
+	st.clients[c] = true
+	st.lastSeen = now
+	if prio > st.priority {
+		st.priority = prio
+	}
+
+	release := func() {
+		l.mu.Lock()
+		delete(st.clients, c)
+		st.lastSeen = time.Now()
+		sess.lastSeen = st.lastSeen
+		l.mu.Unlock()
+		cancel()
+	}
+	return ctx, sess, release, nil
+}
+
+// reserveProbe takes a stream slot for a health probe of a channel. Returns false if the channel
+// is being watched or profile's stream limit is reached, so the probe must be skipped. Returned
+// context is cancelled once a viewer needs the slot; release must be called once probe is done.
+func (l *streamLimiter) reserveProbe(parent context.Context, ch *Channel) (context.Context, func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(time.Now())
+	if _, watched := l.streams[ch]; watched {
+		return nil, nil, false
+	}
+	if l.max > 0 && len(l.streams)+len(l.probes) >= l.max {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(parent)
+	l.probes[ch] = cancel
+	release := func() {
+		l.mu.Lock()
+		delete(l.probes, ch)
+		l.mu.Unlock()
+		cancel()
+	}
+	return ctx, release, true
+}
+
+// victim returns stream to preempt for a new client, or nil if policy doesn't allow it. Must be
+// called with lock held.
+func (l *streamLimiter) victim(addr string, prio int, now time.Time) *activeStream {
+	if l.policy == PolicyReject || now.Before(l.preempted[addr]) {
+		return nil
+	}
+	var victim *activeStream
+	for _, st := range l.streams {
+		switch {
+		case victim == nil:
+			victim = st
+		case l.policy == PolicyPreemptPriority && st.priority != victim.priority:
+			if st.priority < victim.priority {
+				victim = st
+			}
+		case st.started.Before(victim.started):
+			victim = st
+		}
+	}
+	if victim != nil && l.policy == PolicyPreemptPriority && victim.priority >= prio {
+		return nil
+	}
+	return victim
+}
+
+// preempt disconnects all clients of a stream and drops channel's upstream state, as portal stops
+// serving it once another stream starts. Must be called with lock held.
+func (l *streamLimiter) preempt(st *activeStream, now time.Time) {
+	for c := range st.clients {
+		c.cancel()
+	}
+	for addr := range st.sessions {
+		l.preempted[addr] = now.Add(preemptCooldown)
+	}
+	delete(l.streams, st.channel)
+
+	go func(ch *Channel) {
+		if sg := lookupSegmenter(ch); sg != nil {
+			sg.cancel()
+		}
+		ch.Mux.Lock()
+		ch.lastAccess = time.Time{} // Request a new link next time
+		ch.Mux.Unlock()
+	}(st.channel)
+}
+
+// prune forgets streams and sessions that have no open connections and were not requested for
+// a while. Must be called with lock held.
+func (l *streamLimiter) prune(now time.Time) {
+	for ch, st := range l.streams {
+		if len(st.clients) == 0 && now.Sub(st.lastSeen) > streamIdleWindow {
+			delete(l.streams, ch)
+			continue
+		}
+		for addr, sess := range st.sessions {
+			if !st.connected(sess) && now.Sub(sess.lastSeen) > streamIdleWindow {
+				delete(st.sessions, addr)
+			}
+		}
+	}
+	for k, until := range l.kicked {
+		if now.After(until) {
+			delete(l.kicked, k)
+		}
+	}
+	for addr, until := range l.preempted {
+		if now.After(until) {
+			delete(l.preempted, addr)
+		}
+	}
+}
+
+// connected reports whether session has open connections to the stream. Must be called with
+// limiter's lock held.
+func (st *activeStream) connected(sess *session) bool {
+	for c := range st.clients {
+		if c.session == sess {
+			return true
+		}
+	}
+	return false
+}
+
+// admitStream admits a client to channel's stream (see streamLimiter.admit) and attributes
+// traffic of client's request to the channel. Stream counts against limit of the profile the
+// channel belongs to, which is another profile while failover is active.
+func (s *server) admitStream(r *http.Request, ch *Channel, title string) (context.Context, *session, func(), error) {
+	setMeterChannel(r.Context(), title)
+	owner := s
+	if ch.server != nil && ch.server != s {
+		owner, title = ch.server, ch.StalkerChannel.Title
+	}
+	return owner.streams.admit(r.Context(), ch, title, clientAddr(r), r.UserAgent())
+}
+
+// streamError responds to a client that was not admitted to a stream.
+func streamError(w http.ResponseWriter, err error) {
+	status := http.StatusServiceUnavailable
+	switch err {
+	case errKicked:
+		status = http.StatusForbidden
+	case errQuota:
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// clientAddr returns IP address of request's client.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.Trim(r.RemoteAddr, "[]")
+	}
+	return host
+}
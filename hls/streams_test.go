@@ -0,0 +1,196 @@
+package hls
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPriorities = map[string]int{
+	"10.0.0.1":       1,
+	"10.0.0.9":       9,
+	"192.168.0.0/16": 5,
+}
+
+func testChannels(n int) []*Channel {
+	chs := make([]*Channel, n)
+	for i := range chs {
+		chs[i] = &Channel{Mux: &sync.Mutex{}}
+	}
+	return chs
+}
+
+func TestClientRulesMatch(t *testing.T) {
+	rules := parseClientRules(map[string]int64{
+		"10.1.2.3":    1,
+		"10.0.0.0/8":  2,
+		"10.1.0.0/16": 3,
+		"::1":         4,
+	})
+	tests := []struct {
+		addr  string
+		value int64
+		found bool
+	}{
+		{"10.1.2.3", 1, true},
+		{"10.1.9.9", 3, true},
+		{"10.2.0.1", 2, true},
+		{"::1", 4, true},
+		{"192.168.1.1", 0, false},
+		{"not an address", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			value, found := rules.match(tt.addr)
+			if value != tt.value || found != tt.found {
+				t.Errorf("match(%q) = %d, %v; want %d, %v", tt.addr, value, found, tt.value, tt.found)
+			}
+		})
+	}
+}
+
+func TestStreamLimiterPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		existing []string // Client addresses of running streams, oldest first
+		channel  int      // Channel index requested by the new client
+		addr     string   // Address of the new client
+		wantErr  error
+		victim   int // Index of preempted stream, or -1
+	}{
+		{"reject", PolicyReject, []string{"10.0.0.1", "10.0.0.1"}, 2, "10.0.0.9", errStreamLimit, -1},
+		{"unknown policy rejects", "bogus", []string{"10.0.0.1", "10.0.0.1"}, 2, "10.0.0.9", errStreamLimit, -1},
+		{"under limit", PolicyReject, []string{"10.0.0.1"}, 2, "10.0.0.9", nil, -1},
+		{"joining running stream is not a new stream", PolicyReject, []string{"10.0.0.1", "10.0.0.1"}, 0, "10.0.0.9", nil, -1},
+		{"oldest is preempted", PolicyPreemptOldest, []string{"10.0.0.9", "10.0.0.1"}, 2, "10.0.0.1", nil, 0},
+		{"lowest priority is preempted", PolicyPreemptPriority, []string{"192.168.1.5", "10.0.0.1"}, 2, "10.0.0.9", nil, 1},
+		{"oldest of equal priority is preempted", PolicyPreemptPriority, []string{"10.0.0.1", "10.0.0.1"}, 2, "192.168.1.5", nil, 0},
+		{"equal priority does not preempt", PolicyPreemptPriority, []string{"192.168.1.5", "192.168.2.5"}, 2, "192.168.3.5", errStreamLimit, -1},
+		{"unknown client has lowest priority", PolicyPreemptPriority, []string{"10.0.0.1", "10.0.0.1"}, 2, "172.16.0.1", errStreamLimit, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newStreamLimiter(2, tt.policy, testPriorities)
+			chs := testChannels(3)
+			now := time.Now()
+			var ctxs []context.Context
+			for i, addr := range tt.existing {
+				ctx, _, release, err := l.admit(context.Background(), chs[i], "existing", addr, "")
+				if err != nil {
+					t.Fatalf("stream %d was not admitted: %v", i, err)
+				}
+				defer release()
+				l.streams[chs[i]].started = now.Add(time.Duration(i-len(tt.existing)) * time.Minute)
+				ctxs = append(ctxs, ctx)
+			}
+
+			_, _, release, err := l.admit(context.Background(), chs[tt.channel], "new", tt.addr, "")
+			if err != tt.wantErr {
+				t.Fatalf("admit() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				release()
+			}
+			for i, ctx := range ctxs {
+				if preempted := ctx.Err() != nil; preempted != (i == tt.victim) {
+					t.Errorf("stream %d preempted = %v, want victim %d", i, preempted, tt.victim)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamLimiterPreemptCooldown(t *testing.T) {
+	l := newStreamLimiter(1, PolicyPreemptOldest, nil)
+	chs := testChannels(2)
+
+	_, _, release, err := l.admit(context.Background(), chs[0], "first", "10.0.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	_, _, release, err = l.admit(context.Background(), chs[1], "second", "10.0.0.2", "")
+	if err != nil {
+		t.Fatalf("second stream did not preempt the first: %v", err)
+	}
+	defer release()
+
+	// Preempted client must not take the stream back right away
+	if _, _, _, err := l.admit(context.Background(), chs[0], "first", "10.0.0.1", ""); err != errStreamLimit {
+		t.Errorf("preempted client got error %v, want %v", err, errStreamLimit)
+	}
+}
+
+func TestStreamLimiterProbes(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		watched   int  // Channels being watched before the probe
+		probeOK   bool // Probe gets a slot
+		viewerErr error
+	}{
+		{"free slot", 2, 0, true, nil},
+		{"no limit", 0, 1, true, nil},
+		{"limit reached", 1, 1, false, errStreamLimit},
+		{"viewer takes probe's slot", 1, 0, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newStreamLimiter(tt.max, PolicyReject, nil)
+			chs := testChannels(3)
+			for i := 0; i < tt.watched; i++ {
+				_, _, release, err := l.admit(context.Background(), chs[i], "watched", "10.0.0.1", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer release()
+			}
+
+			probeCh := chs[tt.watched]
+			ctx, releaseProbe, ok := l.reserveProbe(context.Background(), probeCh)
+			if ok != tt.probeOK {
+				t.Fatalf("reserveProbe() = %v, want %v", ok, tt.probeOK)
+			}
+			if ok {
+				defer releaseProbe()
+			}
+
+			// Viewer of another channel preempts the probe if it holds the last slot
+			_, _, release, err := l.admit(context.Background(), chs[2], "viewer", "10.0.0.2", "")
+			if err != tt.viewerErr {
+				t.Fatalf("admit() error = %v, want %v", err, tt.viewerErr)
+			}
+			if err == nil {
+				release()
+			}
+			if ok {
+				wantCancelled := tt.max > 0 && tt.watched+2 > tt.max
+				if cancelled := ctx.Err() != nil; cancelled != wantCancelled {
+					t.Errorf("probe cancelled = %v, want %v", cancelled, wantCancelled)
+				}
+			}
+		})
+	}
+
+	// Watched channel is never probed, and its viewer cancels a running probe
+	l := newStreamLimiter(0, PolicyReject, nil)
+	ch := testChannels(1)[0]
+	ctx, releaseProbe, ok := l.reserveProbe(context.Background(), ch)
+	if !ok {
+		t.Fatal("probe of idle channel was refused")
+	}
+	defer releaseProbe()
+	_, _, release, err := l.admit(context.Background(), ch, "viewer", "10.0.0.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if ctx.Err() == nil {
+		t.Error("probe of a channel was not cancelled by its viewer")
+	}
+	if _, _, ok := l.reserveProbe(context.Background(), ch); ok {
+		t.Error("watched channel got probed")
+	}
+}
@@ -1,18 +1,21 @@
 package hls
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"net/http/cookiejar"
 	"strconv"
 	"strings"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
 const userAgent = "Mozilla/5.0 (QtEmbedded; U; Linux; C) AppleWebKit/533.3 (KHTML, like Gecko) MAG200 stbapp ver: 4 rev: 2116 Mobile Safari/533.3"
 
-func download(link string) (content []byte, contentType string, err error) {
-	resp, err := response(link)
+func download(client *http.Client, link string) (content []byte, contentType string, err error) {
+	resp, err := response(client, link)
 	if err != nil {
 		return nil, "", err
 	}
@@ -26,45 +29,105 @@ func download(link string) (content []byte, contentType string, err error) {
 // This is because by default it adds "Referrer" to the header, which causes
 // 404 HTTP error in some backends. With below code such header is not added
 // and redirects should be performed manually.
-var httpClient = &http.Client{
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	},
-}
+var httpClient = newHTTPClient(nil)
 
-func response(link string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", link, nil)
-	if err != nil {
-		return nil, err
+// newHTTPClient returns HTTP client that does not follow redirects and uses given transport
+// (or default one if nil).
+func newHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
+}
 
-	req.Header.Set("User-Agent", userAgent)
+// channelClient returns client for upstream requests of a channel, which counts their traffic and
+// detects stalls. Its cookie jar keeps cookies CDNs set (often on redirects) for the channel's
+// playlist and segment requests.
+func (s *server) channelClient(title string) *http.Client {
+	client := *s.client
+	client.Transport = meteredTransport{s.stallTransport(title, s.streamTransport), usageKey{ProfileID: s.opts.ProfileID, Channel: title}}
+	client.Jar, _ = cookiejar.New(nil)
+	return &client
+}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
+// maxRedirects limits redirects followed by response
+const maxRedirects = 10
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return resp, nil
-	}
+func response(client *http.Client, link string) (*http.Response, error) {
+	return conditionalResponse(client, link, nil)
+}
 
-	defer resp.Body.Close()
+// conditionalResponse works like response, but sends additional request headers. If any are
+// given, "304 Not Modified" is returned as a valid response too.
+//
+// Redirects are followed up to maxRedirects hops, each with a fresh request, so no Referer is
+// sent. Cookies set on redirect hops are kept if client has a cookie jar.
+func conditionalResponse(client *http.Client, link string, header http.Header) (*http.Response, error) {
+	return contextResponse(context.Background(), client, link, header)
+}
+
+// contextResponse works like conditionalResponse, but requests are aborted once ctx is done.
+func contextResponse(ctx context.Context, client *http.Client, link string, header http.Header) (*http.Response, error) {
+	visited := make(map[string]bool)
+	for redirects := 0; ; redirects++ {
+		visited[link] = true
+
+		req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("User-Agent", userAgent)
 
-	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
-		linkURL, err := url.Parse(link)
+		resp, err := client.Do(req)
 		if err != nil {
-			return nil, errors.New("unknown error occurred")
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if resp.StatusCode == http.StatusNotModified && len(header) > 0 {
+			return resp, nil
 		}
-		redirectURL, err := url.Parse(resp.Header.Get("Location"))
+
+		resp.Body.Close()
+
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+			return nil, errors.New(link + " returned HTTP code " + strconv.Itoa(resp.StatusCode))
+		}
+
+		if redirects >= maxRedirects {
+			return nil, errors.New("stopped after " + strconv.Itoa(maxRedirects) + " redirects at " + link)
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return nil, errors.New(link + " returned HTTP code " + strconv.Itoa(resp.StatusCode) + " without location")
+		}
+		redirectURL, err := req.URL.Parse(location)
 		if err != nil {
-			return nil, errors.New("unknown error occurred")
+			return nil, errors.New(link + " redirected to invalid location: " + err.Error())
+		}
+		link = redirectURL.String()
+		if visited[link] {
+			return nil, errors.New("redirect loop at " + link)
 		}
-		newLink := linkURL.ResolveReference(redirectURL)
-		return response(newLink.String())
 	}
+}
 
-	return nil, errors.New(link + " returned HTTP code " + strconv.Itoa(resp.StatusCode))
+// requestOrigin returns scheme://host of request, followed by its access token prefix if any, so
+// generated links keep the scheme client connected with and the token.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + stalker.LinkPrefix(r.Context())
 }
 
 func addHeaders(from, to http.Header, contentLength bool) {
@@ -14,10 +14,16 @@ func deleteAfterLastSlash(str string) string {
 
 var reURILinkExtract = regexp.MustCompile(`URI="([^"]*)"`)
 
-func rewriteLinks(rbody *io.ReadCloser, prefix, linkRoot string) string {
+// rewriteLinks rewrites links of HLS playlist to point to this service. It also returns upstream
+// links of media segments listed in the playlist, in playlist order.
+func rewriteLinks(rbody *io.ReadCloser, prefix, linkRoot string) (string, []string) {
 	var sb strings.Builder
+	var segmentLinks []string
+	afterExtinf := false
 	scanner := bufio.NewScanner(*rbody)
 	linkRootURL, _ := url.Parse(linkRoot) // It will act as a base URL for full URLs
+	prefixURL, _ := url.Parse(prefix)
+	prefixURI := prefixURL.RequestURI()
 
 	modifyLink := func(link string) string {
 		var l string
@@ -42,8 +48,15 @@ func rewriteLinks(rbody *io.ReadCloser, prefix, linkRoot string) string {
 
 	for scanner.Scan() {
 		line := scanner.Text()
-		if !strings.HasPrefix(line, "#") {
+		if strings.HasPrefix(line, "#EXTINF") {
+			afterExtinf = true
+		}
+		if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
 			line = modifyLink(line)
+			if afterExtinf {
+				segmentLinks = append(segmentLinks, linkRoot+strings.TrimPrefix(line, prefixURI))
+				afterExtinf = false
+			}
 		} else if strings.Contains(line, "URI=\"") && !strings.Contains(line, "URI=\"\"") {
 			link := reURILinkExtract.FindStringSubmatch(line)[1]
 			line = reURILinkExtract.ReplaceAllString(line, `URI="`+modifyLink(link)+`"`)
@@ -52,5 +65,5 @@ func rewriteLinks(rbody *io.ReadCloser, prefix, linkRoot string) string {
 		sb.WriteByte('\n')
 	}
 
-	return sb.String()
+	return sb.String(), segmentLinks
 }
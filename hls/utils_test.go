@@ -0,0 +1,113 @@
+package hls
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// redirectServer serves "/hop/<n>" that redirects n times before reaching "/ok", "/loop/a" and
+// "/loop/b" that redirect to each other, and "/cookie" that sets a cookie required by "/ok".
+func redirectServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "" {
+			t.Errorf("%s was requested with Referer %q", r.URL.Path, r.Header.Get("Referer"))
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/hop/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+			target := "/ok"
+			if n > 1 {
+				target = "/hop/" + strconv.Itoa(n-1)
+			}
+			http.Redirect(w, r, target, http.StatusFound)
+		case r.URL.Path == "/loop/a":
+			http.Redirect(w, r, "b", http.StatusMovedPermanently)
+		case r.URL.Path == "/loop/b":
+			http.Redirect(w, r, "a", http.StatusTemporaryRedirect)
+		case r.URL.Path == "/cookie":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/"})
+			http.Redirect(w, r, "/private", http.StatusFound)
+		case r.URL.Path == "/private":
+			if _, err := r.Cookie("session"); err != nil {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("private"))
+		case r.URL.Path == "/nowhere":
+			w.WriteHeader(http.StatusFound)
+		case r.URL.Path == "/cached":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("fresh"))
+		case r.URL.Path == "/ok":
+			w.Write([]byte("ok"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestConditionalResponse(t *testing.T) {
+	srv := redirectServer(t)
+	defer srv.Close()
+
+	jarClient := newHTTPClient(nil)
+	jarClient.Jar, _ = cookiejar.New(nil)
+
+	tests := []struct {
+		name    string
+		client  *http.Client
+		path    string
+		header  http.Header
+		status  int    // Of returned response
+		errPart string // Expected in error, if any
+	}{
+		{"no redirect", httpClient, "/ok", nil, http.StatusOK, ""},
+		{"single redirect", httpClient, "/hop/1", nil, http.StatusOK, ""},
+		{"redirect limit", httpClient, "/hop/" + strconv.Itoa(maxRedirects), nil, http.StatusOK, ""},
+		{"over redirect limit", httpClient, "/hop/" + strconv.Itoa(maxRedirects+1), nil, 0, "stopped after"},
+		{"redirect loop", httpClient, "/loop/a", nil, 0, "redirect loop"},
+		{"redirect without location", httpClient, "/nowhere", nil, 0, "without location"},
+		{"error status", httpClient, "/missing", nil, 0, "returned HTTP code 404"},
+		{"cookies kept across redirects", jarClient, "/cookie", nil, http.StatusOK, ""},
+		{"cookies need a jar", httpClient, "/cookie", nil, 0, "returned HTTP code 403"},
+		{"not modified", httpClient, "/cached", http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified, ""},
+		{"modified", httpClient, "/cached", http.Header{"If-None-Match": {`"v0"`}}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := conditionalResponse(tt.client, srv.URL+tt.path, tt.header)
+			if tt.errPart != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+					t.Fatalf("error = %v, want error containing %q", err, tt.errPart)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestContextResponseCancelled(t *testing.T) {
+	srv := redirectServer(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := contextResponse(ctx, httpClient, srv.URL+"/ok", nil); err == nil {
+		t.Error("request of cancelled context succeeded")
+	}
+}
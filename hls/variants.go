@@ -0,0 +1,268 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Variant pins of VariantPolicy
+const (
+	PinHighest = "highest"
+	PinLowest  = "lowest"
+)
+
+const playlistMaxSize = 1 << 20 // Playlists larger than this are truncated when filtered
+
+// VariantPolicy selects which variants of upstream HLS master playlists are offered to clients.
+// If no variant fits the limits, the one with the lowest bandwidth is kept, so channel still plays.
+type VariantPolicy struct {
+	MaxHeight    int    // Variants with taller picture are dropped; 0 means no limit
+	MaxBandwidth int64  // Variants above this many bits per second are dropped; 0 means no limit
+	Pin          string // PinHighest or PinLowest keeps only a single variant of the allowed ones
+	Collapse     bool   // Media playlist of the pinned (by default highest) variant is served instead of master playlist
+}
+
+var (
+	reVariantBandwidth  = regexp.MustCompile(`[:,]BANDWIDTH=(\d+)`)
+	reVariantResolution = regexp.MustCompile(`[:,]RESOLUTION=(\d+)x(\d+)`)
+)
+
+// hlsVariant is a variant stream listed in master playlist.
+type hlsVariant struct {
+	link      string // As written in playlist
+	bandwidth int64  // 0 if unknown
+	height    int    // 0 if unknown
+	infLine   int    // Index of #EXT-X-STREAM-INF line
+	linkLine  int    // Index of link line
+}
+
+func (p VariantPolicy) active() bool {
+	return p.MaxHeight > 0 || p.MaxBandwidth > 0 || p.Pin != "" || p.Collapse
+}
+
+// parseVariants returns variants of master playlist given as lines. Media playlists have none.
+func parseVariants(lines []string) []hlsVariant {
+	var out []hlsVariant
+	inf := -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			inf = i
+		case line == "" || strings.HasPrefix(line, "#"):
+		case inf > -1:
+			v := hlsVariant{link: line, infLine: inf, linkLine: i}
+			if m := reVariantBandwidth.FindStringSubmatch(lines[inf]); m != nil {
+				v.bandwidth, _ = strconv.ParseInt(m[1], 10, 64)
+			}
+			if m := reVariantResolution.FindStringSubmatch(lines[inf]); m != nil {
+				v.height, _ = strconv.Atoi(m[2])
+			}
+			out = append(out, v)
+			inf = -1
+		}
+	}
+	return out
+}
+
+// allowed returns variants that fit policy's limits, ordered by bandwidth.
+func (p VariantPolicy) allowed(variants []hlsVariant) []hlsVariant {
+	sorted := append([]hlsVariant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].bandwidth < sorted[j].bandwidth })
+
+	var out []hlsVariant
+	for _, v := range sorted {
+		if p.MaxHeight > 0 && v.height > p.MaxHeight {
+			continue
+		}
+		if p.MaxBandwidth > 0 && v.bandwidth > p.MaxBandwidth {
+			continue
+		}
+		out = append(out, v)
+	}
+	if len(out) == 0 && len(sorted) > 0 {
+		out = sorted[:1]
+	}
+	return out
+}
+
+// pick returns the single variant to play, or nil if there are no variants. Without a policy, the
+// first listed variant is played, as players do.
+func (p VariantPolicy) pick(variants []hlsVariant) *hlsVariant {
+	if len(variants) == 0 {
+		return nil
+	}
+	if !p.active() {
+		return &variants[0]
+	}
+	allowed := p.allowed(variants)
+	if p.Pin == PinLowest {
+		return &allowed[0]
+	}
+	return &allowed[len(allowed)-1]
+}
+
+// filterMaster drops variants of master playlist (given as lines) that are not allowed by policy,
+// or all but the pinned one.
+func (p VariantPolicy) filterMaster(lines []string, variants []hlsVariant) []string {
+	keep := p.allowed(variants)
+	if p.Pin != "" {
+		keep = []hlsVariant{*p.pick(variants)}
+	}
+	drop := make(map[int]bool)
+	for _, v := range variants {
+		drop[v.infLine], drop[v.linkLine] = true, true
+	}
+	for _, v := range keep {
+		drop[v.infLine], drop[v.linkLine] = false, false
+	}
+
+	out := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if !drop[i] {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// readPlaylistLines reads playlist body as lines.
+func readPlaylistLines(r io.Reader) ([]string, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, playlistMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(content), "\r\n"), "\n"), nil
+}
+
+// rebasePlaylist makes links of a media playlist loaded from 'base' relative to 'linkRoot', so it
+// can be served in place of the master playlist at 'linkRoot'. Links to other hosts are made
+// absolute.
+func rebasePlaylist(lines []string, base *url.URL, linkRoot string) []string {
+	rootURL, _ := url.Parse(linkRoot)
+	rebase := func(link string) string {
+		u, err := url.Parse(link)
+		if err != nil {
+			return link
+		}
+		abs := base.ResolveReference(u)
+		if s := abs.String(); strings.HasPrefix(s, linkRoot) {
+			return strings.TrimPrefix(s, linkRoot)
+		}
+		if rootURL != nil && abs.Scheme == rootURL.Scheme && abs.Host == rootURL.Host {
+			return abs.RequestURI()
+		}
+		return abs.String()
+	}
+
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed != "" && !strings.HasPrefix(trimmed, "#"):
+			line = rebase(trimmed)
+		case strings.Contains(line, `URI="`) && !strings.Contains(line, `URI=""`):
+			link := reURILinkExtract.FindStringSubmatch(line)[1]
+			line = reURILinkExtract.ReplaceAllLiteralString(line, `URI="`+rebase(link)+`"`)
+		}
+		out[i] = line
+	}
+	return out
+}
+
+// applyVariants applies request's variant policy to upstream HLS playlist loaded from 'link'.
+// Media playlists are returned as they are.
+func applyVariants(cr *ContentRequest, body io.Reader, link string) ([]string, error) {
+	lines, err := readPlaylistLines(body)
+	if err != nil {
+		return nil, err
+	}
+	variants := parseVariants(lines)
+	if len(variants) == 0 {
+		return lines, nil
+	}
+	if !cr.Variants.Collapse {
+		return cr.Variants.filterMaster(lines, variants), nil
+	}
+
+	base, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	variantURL, err := base.Parse(cr.Variants.pick(variants).link)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := response(cr.Channel.client, variantURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	media, err := readPlaylistLines(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(parseVariants(media)) > 0 {
+		return nil, errors.New("variant is a master playlist too")
+	}
+	return rebasePlaylist(media, resp.Request.URL, cr.Channel.HLSLinkRoot), nil
+}
+
+// parseVariantQuery overrides policy with query parameters of a channel request: maxres=720,
+// maxbw=3000000 (or 3000k, 3M), variant=highest|lowest and collapse=1.
+func parseVariantQuery(q url.Values, p VariantPolicy) (VariantPolicy, error) {
+	if v := q.Get("maxres"); v != "" {
+		h, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(v), "p"))
+		if err != nil || h < 0 {
+			return p, fmt.Errorf("invalid maxres '%s'", v)
+		}
+		p.MaxHeight = h
+	}
+	if v := q.Get("maxbw"); v != "" {
+		bw, err := parseBandwidth(v)
+		if err != nil {
+			return p, err
+		}
+		p.MaxBandwidth = bw
+	}
+	switch v := q.Get("variant"); v {
+	case "":
+	case PinHighest, PinLowest:
+		p.Pin = v
+	case "all":
+		p.Pin = ""
+	default:
+		return p, fmt.Errorf("invalid variant '%s'", v)
+	}
+	if v := q.Get("collapse"); v != "" {
+		collapse, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid collapse '%s'", v)
+		}
+		p.Collapse = collapse
+	}
+	return p, nil
+}
+
+// parseBandwidth parses bits per second, optionally with k or M suffix.
+func parseBandwidth(s string) (int64, error) {
+	v, mult := s, int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"), strings.HasSuffix(v, "K"):
+		mult, v = 1000, v[:len(v)-1]
+	case strings.HasSuffix(v, "m"), strings.HasSuffix(v, "M"):
+		mult, v = 1000000, v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid maxbw '" + s + "'")
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,158 @@
+package hls
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMaster = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360
+360p.m3u8
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=5000000,RESOLUTION=1920x1080
+1080p.m3u8`
+
+func TestParseVariants(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     []hlsVariant
+	}{
+		{"master", testMaster, []hlsVariant{
+			{link: "720p.m3u8", bandwidth: 2500000, height: 720, infLine: 2, linkLine: 3},
+			{link: "360p.m3u8", bandwidth: 800000, height: 360, infLine: 4, linkLine: 5},
+			{link: "1080p.m3u8", bandwidth: 5000000, height: 1080, infLine: 6, linkLine: 7},
+		}},
+		{"attributes unknown", "#EXTM3U\n#EXT-X-STREAM-INF:CODECS=\"avc1\"\n\nlive.m3u8", []hlsVariant{
+			{link: "live.m3u8", infLine: 1, linkLine: 3},
+		}},
+		{"media playlist", "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\n1.ts\n#EXTINF:10,\n2.ts", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseVariants(strings.Split(tt.playlist, "\n")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVariants() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantPolicyPick(t *testing.T) {
+	variants := parseVariants(strings.Split(testMaster, "\n"))
+	tests := []struct {
+		name   string
+		policy VariantPolicy
+		want   string
+	}{
+		{"no policy plays first listed", VariantPolicy{}, "720p.m3u8"},
+		{"highest by default", VariantPolicy{Collapse: true}, "1080p.m3u8"},
+		{"lowest", VariantPolicy{Pin: PinLowest}, "360p.m3u8"},
+		{"highest within height", VariantPolicy{MaxHeight: 720}, "720p.m3u8"},
+		{"highest within bandwidth", VariantPolicy{MaxBandwidth: 1000000}, "360p.m3u8"},
+		{"lowest if none fits", VariantPolicy{MaxHeight: 240}, "360p.m3u8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.pick(variants); got == nil || got.link != tt.want {
+				t.Errorf("pick() = %+v, want %s", got, tt.want)
+			}
+		})
+	}
+	if got := (VariantPolicy{Pin: PinHighest}).pick(nil); got != nil {
+		t.Errorf("pick() of media playlist = %+v, want nil", got)
+	}
+}
+
+func TestVariantPolicyFilterMaster(t *testing.T) {
+	lines := strings.Split(testMaster, "\n")
+	variants := parseVariants(lines)
+	tests := []struct {
+		name   string
+		policy VariantPolicy
+		want   []string // Kept variant links, in playlist order
+	}{
+		{"max height", VariantPolicy{MaxHeight: 720}, []string{"720p.m3u8", "360p.m3u8"}},
+		{"max bandwidth", VariantPolicy{MaxBandwidth: 3000000}, []string{"720p.m3u8", "360p.m3u8"}},
+		{"pin highest", VariantPolicy{Pin: PinHighest}, []string{"1080p.m3u8"}},
+		{"pin lowest within limit", VariantPolicy{Pin: PinLowest, MaxHeight: 1080}, []string{"360p.m3u8"}},
+		{"nothing fits", VariantPolicy{MaxBandwidth: 1}, []string{"360p.m3u8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := tt.policy.filterMaster(lines, variants)
+			var links []string
+			for _, v := range parseVariants(out) {
+				links = append(links, v.link)
+			}
+			if !reflect.DeepEqual(links, tt.want) {
+				t.Errorf("filterMaster() kept %v, want %v", links, tt.want)
+			}
+			if out[0] != "#EXTM3U" || out[1] != "#EXT-X-VERSION:3" {
+				t.Errorf("filterMaster() dropped playlist header: %v", out[:2])
+			}
+		})
+	}
+}
+
+func TestParseVariantQuery(t *testing.T) {
+	base := VariantPolicy{MaxHeight: 1080, Pin: PinHighest}
+	tests := []struct {
+		name    string
+		query   string
+		want    VariantPolicy
+		wantErr bool
+	}{
+		{"no overrides", "", base, false},
+		{"max resolution", "maxres=720p", VariantPolicy{MaxHeight: 720, Pin: PinHighest}, false},
+		{"bandwidth in kbps", "maxbw=3000k", VariantPolicy{MaxHeight: 1080, MaxBandwidth: 3000000, Pin: PinHighest}, false},
+		{"bandwidth in Mbps", "maxbw=3M", VariantPolicy{MaxHeight: 1080, MaxBandwidth: 3000000, Pin: PinHighest}, false},
+		{"all variants", "variant=all&collapse=1", VariantPolicy{MaxHeight: 1080, Collapse: true}, false},
+		{"invalid resolution", "maxres=hd", base, true},
+		{"invalid bandwidth", "maxbw=-1", base, true},
+		{"invalid variant", "variant=middle", base, true},
+		{"invalid collapse", "collapse=maybe", base, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			got, err := parseVariantQuery(q, base)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVariantQuery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseVariantQuery() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebasePlaylist(t *testing.T) {
+	base, _ := url.Parse("http://cdn.example.com/live/ch1/720p/index.m3u8")
+	media := []string{
+		"#EXTM3U",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin"`,
+		"#EXTINF:10,",
+		"seg1.ts",
+		"#EXTINF:10,",
+		"/other/seg2.ts",
+		"#EXTINF:10,",
+		"http://edge.example.com/seg3.ts",
+	}
+	want := []string{
+		"#EXTM3U",
+		`#EXT-X-KEY:METHOD=AES-128,URI="720p/key.bin"`,
+		"#EXTINF:10,",
+		"720p/seg1.ts",
+		"#EXTINF:10,",
+		"/other/seg2.ts",
+		"#EXTINF:10,",
+		"http://edge.example.com/seg3.ts",
+	}
+	if got := rebasePlaylist(media, base, "http://cdn.example.com/live/ch1/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("rebasePlaylist() = %q, want %q", got, want)
+	}
+}
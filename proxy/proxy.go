@@ -8,17 +8,36 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
-var (
-	destination string
+// server holds the state of a single proxy service (one per profile).
+type server struct {
+	profileID int
+	config    *stalker.Config
+	client    *http.Client // Client for requests to the portal, shares TLS settings with the portal
+
+	mu       sync.RWMutex
+	channels map[string]*stalker.Channel // Channels by CMD field
+
+	// Playlist rules and lookups derived from channel list, used to customize portal responses
+	rules          *stalker.RuleSet
+	genres         map[string]string // Genre ID -> title
+	censoredGenres map[string]bool
+	channelIDs     map[string]bool // IDs of channels that are kept by playlist rules
 
-	config *stalker.Config
+	sessions sessionList
 
-	channels map[string]*stalker.Channel
+	access *stalker.AccessGuard
+}
+
+var (
+	serversMu sync.RWMutex
+	servers   = map[int]*server{} // Running proxy services by profile ID
 )
 
 // Start starts main routine.
@@ -28,35 +47,53 @@ func Start(c *stalker.Config, chs map[string]*stalker.Channel) {
 
 // StartWithContext starts main routine with graceful shutdown support.
 func StartWithContext(ctx context.Context, c *stalker.Config, chs map[string]*stalker.Channel) {
-	config = c
+	StartProfile(ctx, 0, c, chs, nil)
+}
 
-	// Channels will be matched by CMD field, not by title
-	newChannels := make(map[string]*stalker.Channel)
-	for _, v := range chs {
-		newChannels[v.CMD] = v
+// StartProfile starts main routine of a profile's proxy service with graceful shutdown support.
+// Channel lists, genres and EPG sent by portal are customized according to given playlist rules
+// (which may be nil).
+func StartProfile(ctx context.Context, profileID int, c *stalker.Config, chs map[string]*stalker.Channel, rules *stalker.RuleSet) {
+	s := &server{profileID: profileID, config: c, client: HTTPClient, rules: rules}
+	if c.Portal.Client != nil {
+		s.client = c.Portal.Client
 	}
-	channels = newChannels
-
-	// extract scheme://hostname:port from given URL, so we don't have to do it later
-	link, err := url.Parse(config.Portal.Location)
+	guard, err := stalker.NewAccessGuard("Proxy of profile "+strconv.Itoa(profileID), c.Proxy.Access)
 	if err != nil {
+		log.Printf("Proxy service not started: %v", err)
+		return
+	}
+	s.access = guard
+	s.setChannels(chs)
+
+	if _, err := url.Parse(c.Portal.URL()); err != nil {
 		log.Fatalln(err)
 	}
-	destination = link.Scheme + "://" + link.Host
+
+	serversMu.Lock()
+	servers[profileID] = s
+	serversMu.Unlock()
+	defer func() {
+		serversMu.Lock()
+		if servers[profileID] == s {
+			delete(servers, profileID)
+		}
+		serversMu.Unlock()
+	}()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", requestHandler)
+	mux.HandleFunc("/", s.requestHandler)
 
 	server := &http.Server{
-		Addr:    config.Proxy.Bind,
-		Handler: mux,
+		Addr:    c.Proxy.Bind,
+		Handler: s.access.Wrap(mux),
 	}
 
 	log.Println("Proxy service should be started!")
 
 	// Start server in goroutine
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := stalker.ListenAndServe(server, c.Proxy.TLS); err != nil && err != http.ErrServerClosed {
 			log.Printf("Proxy server error: %v", err)
 		}
 	}()
@@ -74,8 +111,68 @@ func StartWithContext(ctx context.Context, c *stalker.Config, chs map[string]*st
 	}
 }
 
-func requestHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+// setChannels replaces channel list. Channels will be matched by CMD field, not by title.
+func (s *server) setChannels(chs map[string]*stalker.Channel) {
+	newChannels := make(map[string]*stalker.Channel, len(chs))
+	channelIDs := make(map[string]bool, len(chs))
+	genres, censoredGenres := map[string]string{}, map[string]bool{}
+	for _, v := range chs {
+		newChannels[v.CMD] = v
+		channelIDs[v.CMD_ID] = true
+		if v.Genres != nil {
+			genres = *v.Genres
+		}
+		if v.CensoredGenres != nil {
+			censoredGenres = *v.CensoredGenres
+		}
+	}
+	s.mu.Lock()
+	s.channels = newChannels
+	s.channelIDs = channelIDs
+	s.genres = genres
+	s.censoredGenres = censoredGenres
+	s.mu.Unlock()
+}
+
+// UpdateChannels replaces channel list of a running profile's proxy service. Returns false if
+// the profile has no running proxy service.
+func UpdateChannels(profileID int, chs map[string]*stalker.Channel) bool {
+	serversMu.RLock()
+	s, found := servers[profileID]
+	serversMu.RUnlock()
+	if !found {
+		return false
+	}
+	s.setChannels(chs)
+	return true
+}
+
+// GetAccessStats returns counters of requests rejected by access rules of a running profile's
+// proxy service. Returns false if the profile has no running proxy service.
+func GetAccessStats(profileID int) (stalker.AccessStats, bool) {
+	serversMu.RLock()
+	s, found := servers[profileID]
+	serversMu.RUnlock()
+	if !found {
+		return stalker.AccessStats{}, false
+	}
+	return s.access.Stats(), true
+}
+
+// portalOrigin extracts scheme://hostname:port from portal's active URL.
+func portalOrigin(p *stalker.Portal) string {
+	link, err := url.Parse(p.URL())
+	if err != nil {
+		return ""
+	}
+	return link.Scheme + "://" + link.Host
+}
+
+func (s *server) requestHandler(w http.ResponseWriter, r *http.Request) {
+	config := s.config
+
+	log.Println(r.URL.RequestURI())
+	s.sessions.seen(r)
 
 	query := r.URL.Query()
 
@@ -141,7 +238,9 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Find Stalker channel
-		channel, found := channels[tagCMD]
+		s.mu.RLock()
+		channel, found := s.channels[tagCMD]
+		s.mu.RUnlock()
 		if !found {
 			log.Println("STB requested 'create_link', but gave invalid CMD:", tagCMD)
 			http.Error(w, "bad request", http.StatusBadRequest)
@@ -151,7 +250,7 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		// We must give full path to IPTV stream. Serve at root without "/iptv".
 		requestHost, _, _ := net.SplitHostPort(r.Host)
 		_, portHLS, _ := net.SplitHostPort(config.HLS.Bind)
-		destination = "http://" + requestHost + ":" + portHLS + "/" + url.PathEscape(channel.Title)
+		destination := config.HLS.TLS.Scheme() + "://" + requestHost + ":" + portHLS + config.HLS.Access.LinkPrefix() + "/" + url.PathEscape(channel.Title)
 
 		w.WriteHeader(http.StatusOK)
 
@@ -163,6 +262,23 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// STB tunes into a channel that it will stream directly from the portal
+	if tagAction == "create_link" && tagCMD != "" {
+		s.mu.RLock()
+		channel, found := s.channels[tagCMD]
+		s.mu.RUnlock()
+		if found {
+			s.sessions.tuned(s.profileID, r, channel.Title)
+		}
+	}
+
+	// EPG of channels hidden by playlist rules
+	if tagAction == "get_short_epg" && s.hiddenEPG(query.Get("ch_id")) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"js":[]}`))
+		return
+	}
+
 	// ################################################
 	// Rewrite some URL query values
 
@@ -189,22 +305,26 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	// ################################################
 	// Proxy modified request to real Stalker portal and return the response
 
-	// Build (modified) URL
-	finalLink := destination + r.URL.Path
+	// Build (modified) URL against the active portal mirror
+	finalLink := portalOrigin(config.Portal) + r.URL.Path
 
 	if len(r.URL.RawQuery) != 0 {
 		finalLink += "?" + query.Encode()
 	}
 
 	// Perform request
-	resp, err := getRequest(finalLink, r)
+	resp, err := getRequest(s.client, config, finalLink, r)
 	if err != nil {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Send response
+	// Send response, customized by playlist rules if needed
+	if s.shouldFilter(tagType, tagAction) {
+		s.writeFiltered(w, resp, tagAction)
+		return
+	}
 	addHeaders(resp.Header, w.Header())
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// filteredActions lists portal responses that are customized according to profile's playlist rules.
+var filteredActions = map[string]bool{
+	"get_all_channels":     true,
+	"get_ordered_list":     true,
+	"get_all_fav_channels": true,
+	"get_genres":           true,
+	"get_epg_info":         true,
+}
+
+// SetRules replaces playlist rules of a running profile's proxy service. Returns false if the
+// profile has no running proxy service.
+func SetRules(profileID int, rules *stalker.RuleSet) bool {
+	serversMu.RLock()
+	s, found := servers[profileID]
+	serversMu.RUnlock()
+	if !found {
+		return false
+	}
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+	return true
+}
+
+// shouldFilter reports whether response to given request must be customized by playlist rules.
+func (s *server) shouldFilter(tagType, tagAction string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rules != nil && tagType == "itv" && filteredActions[tagAction]
+}
+
+// writeFiltered sends portal's response with channel lists, genres and EPG customized by playlist rules.
+func (s *server) writeFiltered(w http.ResponseWriter, resp *http.Response, tagAction string) {
+	body := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Unfiltered lists would reveal hidden channels, so they are never sent
+	if resp.StatusCode == http.StatusOK {
+		filtered, err := s.filter(tagAction, content)
+		if err != nil {
+			log.Printf("Unable to apply playlist rules to %s response: %v", tagAction, err)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		content = filtered
+	}
+
+	addHeaders(resp.Header, w.Header())
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(content)
+}
+
+// filter applies playlist rules to portal's JSON response. Unknown response formats are returned as error.
+func (s *server) filter(tagAction string, content []byte) ([]byte, error) {
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(content, &root); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var js interface{}
+	var err error
+	switch tagAction {
+	case "get_genres":
+		js, err = s.filterGenres(root["js"])
+	case "get_epg_info":
+		js, err = s.filterEPG(root["js"])
+	default:
+		js, err = s.filterChannels(root["js"], tagAction == "get_all_channels")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if root["js"], err = json.Marshal(js); err != nil {
+		return nil, err
+	}
+	return json.Marshal(root)
+}
+
+// filterChannels drops, renames and numbers channels of portal's channel list. Entries are
+// reordered only if the whole list is given at once.
+func (s *server) filterChannels(raw json.RawMessage, reorder bool) (interface{}, error) {
+	var js map[string]interface{}
+	if err := decodeJSON(raw, &js); err != nil {
+		return nil, err
+	}
+	data, ok := js["data"].([]interface{})
+	if !ok {
+		if js["data"] != nil {
+			return nil, errors.New("unknown channel list format")
+		}
+		return js, nil
+	}
+
+	kept := make([]interface{}, 0, len(data))
+	for _, el := range data {
+		entry, ok := el.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		genreID := fmt.Sprint(entry["tv_genre_id"])
+		genre, found := s.genres[genreID]
+		if !found {
+			genre = "Other"
+		}
+		censored := flag(entry["censored"]) || s.censoredGenres[genreID]
+		title, keep := s.rules.Channel(fmt.Sprint(entry["name"]), genre, censored)
+		if !keep {
+			continue
+		}
+		entry["name"] = title
+		if n := s.rules.Number(title); n > 0 {
+			entry["number"] = strconv.Itoa(n)
+		}
+		kept = append(kept, entry)
+	}
+
+	if reorder {
+		rank := func(el interface{}) (int, bool) {
+			return s.rules.Rank(fmt.Sprint(el.(map[string]interface{})["name"]))
+		}
+		sort.SliceStable(kept, func(i, j int) bool {
+			ri, pi := rank(kept[i])
+			rj, pj := rank(kept[j])
+			return pi && (!pj || ri < rj)
+		})
+	}
+
+	js["data"] = kept
+	if _, found := js["total_items"]; found {
+		js["total_items"] = len(kept)
+	}
+	return js, nil
+}
+
+// filterGenres drops and renames genres of portal's genre list.
+func (s *server) filterGenres(raw json.RawMessage) (interface{}, error) {
+	var js []map[string]interface{}
+	if err := decodeJSON(raw, &js); err != nil {
+		return nil, err
+	}
+	kept := make([]map[string]interface{}, 0, len(js))
+	for _, entry := range js {
+		id := fmt.Sprint(entry["id"])
+		if id == "*" { // "All channels"
+			kept = append(kept, entry)
+			continue
+		}
+		group, keep := s.rules.Genre(fmt.Sprint(entry["title"]), flag(entry["censored"]) || s.censoredGenres[id])
+		if !keep {
+			continue
+		}
+		entry["title"] = group
+		kept = append(kept, entry)
+	}
+	return kept, nil
+}
+
+// filterEPG drops EPG of channels that are hidden by playlist rules.
+func (s *server) filterEPG(raw json.RawMessage) (interface{}, error) {
+	var js map[string]interface{}
+	if err := decodeJSON(raw, &js); err != nil {
+		return nil, err
+	}
+	data, ok := js["data"].(map[string]interface{})
+	if !ok {
+		if list, isList := js["data"].([]interface{}); js["data"] != nil && (!isList || len(list) > 0) {
+			return nil, errors.New("unknown EPG format")
+		}
+		return js, nil
+	}
+	for id := range data {
+		if !s.channelIDs[id] {
+			delete(data, id)
+		}
+	}
+	return js, nil
+}
+
+// hiddenEPG reports whether EPG of a channel was requested that is hidden by playlist rules.
+func (s *server) hiddenEPG(chID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rules != nil && chID != "" && !s.channelIDs[chID]
+}
+
+// decodeJSON decodes JSON keeping numbers as they are, so IDs are not turned into floats.
+func decodeJSON(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// flag decodes portal's boolean-ish JSON values ("1", 1, true).
+func flag(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case json.Number:
+		return v != "0"
+	case string:
+		return v != "" && v != "0" && v != "false"
+	}
+	return false
+}
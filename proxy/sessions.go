@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionTimeout ends a session once its STB stops talking to the portal (it sends watchdog
+// events every minute or two while playing).
+const sessionTimeout = 3 * time.Minute
+
+// Session is an STB that tuned into a channel through the proxy. Its stream goes directly from
+// the portal to the STB, so it's not counted in bytes and can't be kicked.
+type Session struct {
+	ID        string    `json:"id"`
+	ProfileID int       `json:"profile_id"`
+	Channel   string    `json:"channel"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Started   time.Time `json:"started"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+var (
+	sessionsMu    sync.Mutex
+	lastSessionID int
+)
+
+// sessionList keeps the current session of every STB of a proxy service.
+type sessionList struct {
+	mu       sync.Mutex
+	byClient map[string]*Session // Client IP -> session
+}
+
+// tuned starts a new session of a client, replacing its previous one, as an STB plays one
+// channel at a time.
+func (l *sessionList) tuned(profileID int, r *http.Request, channel string) {
+	sessionsMu.Lock()
+	lastSessionID++
+	id := lastSessionID
+	sessionsMu.Unlock()
+
+	now := time.Now()
+	addr := clientAddr(r)
+	l.mu.Lock()
+	if l.byClient == nil {
+		l.byClient = make(map[string]*Session)
+	}
+	l.byClient[addr] = &Session{
+		ID:        "proxy-" + strconv.Itoa(id),
+		ProfileID: profileID,
+		Channel:   channel,
+		ClientIP:  addr,
+		UserAgent: r.UserAgent(),
+		Started:   now,
+		LastSeen:  now,
+	}
+	l.mu.Unlock()
+}
+
+// seen keeps client's session alive.
+func (l *sessionList) seen(r *http.Request) {
+	l.mu.Lock()
+	if sess, found := l.byClient[clientAddr(r)]; found {
+		sess.LastSeen = time.Now()
+	}
+	l.mu.Unlock()
+}
+
+// list returns sessions that are still alive.
+func (l *sessionList) list() []Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]Session, 0, len(l.byClient))
+	for addr, sess := range l.byClient {
+		if time.Since(sess.LastSeen) > sessionTimeout {
+			delete(l.byClient, addr)
+			continue
+		}
+		out = append(out, *sess)
+	}
+	return out
+}
+
+// GetSessions returns channels STBs of a running profile (or of all running profiles, if
+// profileID is 0) tuned into through the proxy without link rewriting. With rewriting, streams go
+// through HLS service, which keeps track of them.
+func GetSessions(profileID int) []Session {
+	serversMu.RLock()
+	list := make([]*server, 0, len(servers))
+	for id, s := range servers {
+		if profileID == 0 || id == profileID {
+			list = append(list, s)
+		}
+	}
+	serversMu.RUnlock()
+
+	out := []Session{}
+	for _, s := range list {
+		out = append(out, s.sessions.list()...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// clientAddr returns IP address of request's client.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
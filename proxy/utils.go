@@ -5,6 +5,8 @@ import (
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
 // HTTPClient with connection pooling for proxy package
@@ -17,7 +19,7 @@ var HTTPClient = &http.Client{
 	},
 }
 
-func getRequest(link string, originalRequest *http.Request) (*http.Response, error) {
+func getRequest(client *http.Client, config *stalker.Config, link string, originalRequest *http.Request) (*http.Response, error) {
 	req, err := http.NewRequest("GET", link, nil)
 	if err != nil {
 		return nil, err
@@ -37,7 +39,7 @@ func getRequest(link string, originalRequest *http.Request) (*http.Response, err
 		}
 	}
 
-	return HTTPClient.Do(req)
+	return client.Do(req)
 }
 
 func addHeaders(from, to http.Header) {
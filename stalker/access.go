@@ -0,0 +1,199 @@
+package stalker
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenPathPrefix = "/t/"          // Starts paths that carry an access token: /t/<token>/...
+	tokenQueryParam = "access_token" // Query parameter that carries an access token; "token" belongs to the portal
+)
+
+// AccessRules restricts who may use a listener (HLS or proxy).
+type AccessRules struct {
+	Allow []string `yaml:"allow" json:"allow,omitempty"` // Client IP addresses or CIDR networks; empty allows everyone
+	Token string   `yaml:"token" json:"token,omitempty"` // Required as /t/<token>/ path prefix or ?access_token= query parameter
+}
+
+// LinkPrefix returns path prefix that carries the token, or empty string if no token is required.
+// Links generated for clients start with it, so the token is propagated to every request.
+func (a AccessRules) LinkPrefix() string {
+	if a.Token == "" {
+		return ""
+	}
+	return tokenPathPrefix + url.PathEscape(a.Token)
+}
+
+// AccessStats counts requests rejected by a listener.
+type AccessStats struct {
+	NotAllowed uint64    `json:"not_allowed"` // Client address is not in the allowlist
+	BadToken   uint64    `json:"bad_token"`   // Token is missing or wrong
+	LastClient string    `json:"last_client,omitempty"`
+	Last       time.Time `json:"last,omitempty"`
+}
+
+// AccessGuard enforces access rules of a listener.
+type AccessGuard struct {
+	name  string // Listener name used in logs
+	rules AccessRules
+	nets  []*net.IPNet
+
+	mu    sync.Mutex
+	stats AccessStats
+}
+
+type linkPrefixKey struct{}
+
+// NewAccessGuard returns guard enforcing given rules. Name identifies the listener in logs.
+func NewAccessGuard(name string, rules AccessRules) (*AccessGuard, error) {
+	g := &AccessGuard{name: name, rules: rules}
+	for _, a := range rules.Allow {
+		a = strings.TrimSpace(a)
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, errors.New("invalid allowed address '" + a + "'")
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			g.nets = append(g.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, errors.New("invalid allowed network '" + a + "'")
+		}
+		g.nets = append(g.nets, n)
+	}
+	return g, nil
+}
+
+// Stats returns counters of rejected requests.
+func (g *AccessGuard) Stats() AccessStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
+
+// Wrap rejects requests of clients outside the allowlist, or without the token, with "403
+// Forbidden". Token path prefix is removed from accepted requests, so handlers see the usual paths.
+func (g *AccessGuard) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		if !g.allowed(addr) {
+			g.reject(w, addr, "address is not allowed", &g.stats.NotAllowed)
+			return
+		}
+		if g.rules.Token != "" {
+			var ok bool
+			if r, ok = g.takeToken(r); !ok {
+				g.reject(w, addr, "missing or wrong token", &g.stats.BadToken)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), linkPrefixKey{}, g.rules.LinkPrefix()))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (g *AccessGuard) allowed(addr string) bool {
+	if len(g.nets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range g.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeToken checks request's token and returns the request with token removed from its URL. The
+// rest of the URL is kept as it is, as it might be forwarded to the portal.
+func (g *AccessGuard) takeToken(r *http.Request) (*http.Request, bool) {
+	u := *r.URL
+	var token string
+	if escaped := u.EscapedPath(); strings.HasPrefix(escaped, tokenPathPrefix) {
+		// Token is split off the escaped path, so tokens containing "/" stay in one piece
+		rest := strings.TrimPrefix(escaped, tokenPathPrefix)
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			i = len(rest)
+		}
+		var err error
+		if token, err = url.PathUnescape(rest[:i]); err != nil {
+			return r, false
+		}
+		rawPath := "/" + strings.TrimPrefix(rest[i:], "/")
+		if u.Path, err = url.PathUnescape(rawPath); err != nil {
+			return r, false
+		}
+		u.RawPath = rawPath
+	} else {
+		token, u.RawQuery = takeQueryParam(u.RawQuery, tokenQueryParam)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(g.rules.Token)) != 1 {
+		return r, false
+	}
+	r2 := r.WithContext(r.Context())
+	r2.URL = &u
+	return r2, true
+}
+
+// takeQueryParam returns value of a query parameter and the raw query without it. Other
+// parameters are left untouched.
+func takeQueryParam(rawQuery, name string) (string, string) {
+	var value string
+	kept := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, v := pair, ""
+		if i := strings.IndexByte(pair, '='); i > -1 {
+			key, v = pair[:i], pair[i+1:]
+		}
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			if value == "" {
+				value, _ = url.QueryUnescape(v)
+			}
+			continue
+		}
+		if pair != "" {
+			kept = append(kept, pair)
+		}
+	}
+	return value, strings.Join(kept, "&")
+}
+
+func (g *AccessGuard) reject(w http.ResponseWriter, addr, reason string, counter *uint64) {
+	g.mu.Lock()
+	*counter++
+	g.stats.LastClient = addr
+	g.stats.Last = time.Now()
+	g.mu.Unlock()
+	log.Printf("%s: rejected %s: %s", g.name, addr, reason)
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
+// LinkPrefix returns path prefix that carries the token of an accepted request, so links
+// generated for it keep the token. It's empty if the listener requires no token.
+func LinkPrefix(ctx context.Context) string {
+	prefix, _ := ctx.Value(linkPrefixKey{}).(string)
+	return prefix
+}
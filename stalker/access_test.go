@@ -0,0 +1,136 @@
+package stalker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAccessGuard(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		wantErr bool
+	}{
+		{"addresses and networks", []string{"192.168.1.10", " 10.0.0.0/8 ", "::1", "fd00::/8"}, false},
+		{"invalid address", []string{"192.168.1"}, true},
+		{"invalid network", []string{"10.0.0.0/33"}, true},
+		{"hostname", []string{"localhost"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAccessGuard("test", AccessRules{Allow: tt.allow})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAccessGuard() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccessGuardAllowlist(t *testing.T) {
+	g, err := NewAccessGuard("test", AccessRules{Allow: []string{"192.168.1.10", "10.0.0.0/8", "fd00::/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		want   int
+	}{
+		{"listed address", "192.168.1.10:5000", http.StatusOK},
+		{"other address of the same network", "192.168.1.11:5000", http.StatusForbidden},
+		{"address in network", "10.20.30.40:5000", http.StatusOK},
+		{"IPv6 address in network", "[fd12::1]:5000", http.StatusOK},
+		{"IPv6 address outside network", "[2001:db8::1]:5000", http.StatusForbidden},
+		{"unparsable address", "unknown", http.StatusForbidden},
+	}
+	h := g.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/iptv", nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+	if stats := g.Stats(); stats.NotAllowed != 3 || stats.LastClient != "unknown" {
+		t.Errorf("Stats() = %+v, want 3 rejections, last of 'unknown'", stats)
+	}
+}
+
+func TestAccessGuardToken(t *testing.T) {
+	const token = "s3cret/tok en"
+	g, err := NewAccessGuard("test", AccessRules{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := AccessRules{Token: token}.LinkPrefix()
+	if prefix != "/t/s3cret%2Ftok%20en" {
+		t.Fatalf("LinkPrefix() = %q", prefix)
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		want       int
+		path       string // Path seen by the handler
+		escaped    string // Escaped path seen by the handler
+		query      string // Raw query seen by the handler
+		linkPrefix string
+	}{
+		{"path token", prefix + "/iptv/BBC%20One?b=2", http.StatusOK, "/iptv/BBC One", "/iptv/BBC%20One", "b=2", prefix},
+		{"path token only", prefix, http.StatusOK, "/", "/", "", prefix},
+		{"escaped slash in path is kept", prefix + "/iptv/AC%2FDC", http.StatusOK, "/iptv/AC/DC", "/iptv/AC%2FDC", "", prefix},
+		{"query token", "/iptv?token=portal&access_token=s3cret%2Ftok+en&z=%41", http.StatusOK, "/iptv", "/iptv", "token=portal&z=%41", prefix},
+		{"portal token is not an access token", "/iptv?token=" + "s3cret%2Ftok+en", http.StatusForbidden, "", "", "", ""},
+		{"wrong path token", "/t/s3cret/iptv", http.StatusForbidden, "", "", "", ""},
+		{"missing token", "/iptv", http.StatusForbidden, "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen *http.Request
+			h := g.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r }))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if seen.URL.Path != tt.path || seen.URL.EscapedPath() != tt.escaped || seen.URL.RawQuery != tt.query {
+				t.Errorf("handler saw path %q (%q), query %q; want %q (%q), %q",
+					seen.URL.Path, seen.URL.EscapedPath(), seen.URL.RawQuery, tt.path, tt.escaped, tt.query)
+			}
+			if got := LinkPrefix(seen.Context()); got != tt.linkPrefix {
+				t.Errorf("LinkPrefix() = %q, want %q", got, tt.linkPrefix)
+			}
+		})
+	}
+}
+
+func TestTakeQueryParam(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantValue string
+		wantQuery string
+	}{
+		{"absent", "a=1&b=2", "", "a=1&b=2"},
+		{"first of many", "access_token=x&a=1&access_token=y", "x", "a=1"},
+		{"escaped", "a=%2F&access_token=a%2Bb%20c", "a+b c", "a=%2F"},
+		{"escaped name", "access%5Ftoken=x&a", "x", "a"},
+		{"empty query", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, query := takeQueryParam(tt.query, tokenQueryParam)
+			if value != tt.wantValue || query != tt.wantQuery {
+				t.Errorf("takeQueryParam(%q) = %q, %q; want %q, %q", tt.query, value, query, tt.wantValue, tt.wantQuery)
+			}
+		})
+	}
+}
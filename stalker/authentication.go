@@ -16,7 +16,7 @@ func (p *Portal) handshake() error {
 	}
 	var tmp tmpStruct
 
-	req, err := http.NewRequest("GET", p.Location+"?type=stb&action=handshake&token="+p.Token+"&JsHttpRequest=1-xml", nil)
+	req, err := http.NewRequest("GET", p.URL()+"?type=stb&action=handshake&token="+p.Token+"&JsHttpRequest=1-xml", nil)
 	if err != nil {
 		return err
 	}
@@ -25,7 +25,7 @@ func (p *Portal) handshake() error {
 	req.Header.Set("X-User-Agent", "Model: "+p.Model+"; Link: Ethernet")
 	req.Header.Set("Cookie", "sn="+p.SerialNumber+"; mac="+p.MAC+"; stb_lang=en; timezone="+p.TimeZone)
 
-	resp, err := HTTPClient.Do(req)
+	resp, err := p.client().Do(req)
 	if err != nil {
 		return err
 	}
@@ -60,7 +60,7 @@ func (p *Portal) authenticate() (err error) {
 	}
 	var tmp tmpStruct
 
-	content, err := p.httpRequest(p.Location + "?type=stb&action=do_auth&login=" + p.Username + "&password=" + p.Password + "&device_id=" + p.DeviceID + "&device_id2=" + p.DeviceID2 + "&JsHttpRequest=1-xml")
+	content, err := p.httpRequest(p.URL() + "?type=stb&action=do_auth&login=" + p.Username + "&password=" + p.Password + "&device_id=" + p.DeviceID + "&device_id2=" + p.DeviceID2 + "&JsHttpRequest=1-xml")
 	if err != nil {
 		log.Println("HTTP authentication request failed")
 		return err
@@ -96,7 +96,7 @@ func (p *Portal) authenticateWithDeviceIDs() (err error) {
 	var tmp tmpStruct
 
 	log.Println("Authenticating with DeviceId and DeviceId2")
-	content, err := p.httpRequest(p.Location + "?type=stb&action=get_profile&JsHttpRequest=1-xml&hd=1&sn=" + p.SerialNumber + "&stb_type=" + p.Model + "&device_id=" + p.DeviceID + "&device_id2=" + p.DeviceID2 + "&auth_second_step=1")
+	content, err := p.httpRequest(p.URL() + "?type=stb&action=get_profile&JsHttpRequest=1-xml&hd=1&sn=" + p.SerialNumber + "&stb_type=" + p.Model + "&device_id=" + p.DeviceID + "&device_id2=" + p.DeviceID2 + "&auth_second_step=1")
 
 	if err != nil {
 		log.Println("HTTP authentication request failed")
@@ -16,6 +16,15 @@ type Channel struct {
 	Portal   *Portal            // Reference to portal from where this channel is taken from
 	GenreID  string             // Stores genre ID (category ID)
 	Genres   *map[string]string // Stores mappings for genre ID -> genre title
+	XMLTVID  string             // Channel's EPG identifier (tvg-id), if portal provides one
+	Censored bool               // Channel is marked as adult content by portal
+	Number   int                // Channel number given by portal (or pinned by playlist rules)
+
+	CensoredGenres *map[string]bool // Stores IDs of genres marked as adult content
+
+	// Set by playlist rules (see RuleSet.Apply)
+	Group    string // Group title to show instead of genre title
+	Position int    // Position in customized channel list; zero if list is not customized
 
 	CMD_ID    string // Used for Proxy service to generate fake response to new URL request
 	CMD_CH_ID string // Used for Proxy service to generate fake response to new URL request
@@ -30,8 +39,6 @@ func (c *Channel) NewLink(retry bool) (string, error) {
 	}
 	var tmp tmpStruct
 
-	link := c.Portal.Location + "?action=create_link&type=itv&cmd=" + url.PathEscape(c.CMD) + "&JsHttpRequest=1-xml"
-
 	// Use retry logic for link retrieval
 	retryConfig := RetryConfig{
 		MaxRetries: 3,
@@ -41,6 +48,8 @@ func (c *Channel) NewLink(retry bool) (string, error) {
 
 	var content []byte
 	err := RetryWithBackoff(retryConfig, func() error {
+		// Build link on every attempt, as portal might switch to another mirror meanwhile
+		link := c.Portal.URL() + "?action=create_link&type=itv&cmd=" + url.PathEscape(c.CMD) + "&JsHttpRequest=1-xml"
 		var err error
 		content, err = c.Portal.httpRequest(link)
 		return err
@@ -82,11 +91,14 @@ func (c *Channel) Logo() string {
 	if c.LogoLink == "" {
 		return ""
 	}
-	return c.Portal.Location + "misc/logos/320/" + c.LogoLink // hardcoded path - fixme?
+	return c.Portal.URL() + "misc/logos/320/" + c.LogoLink // hardcoded path - fixme?
 }
 
-// Genre returns a genre title
+// Genre returns a genre title, or group title set by playlist rules
 func (c *Channel) Genre() string {
+	if c.Group != "" {
+		return c.Group
+	}
 	g, ok := (*c.Genres)[c.GenreID]
 	if !ok {
 		g = "Other"
@@ -94,16 +106,24 @@ func (c *Channel) Genre() string {
 	return strings.Title(g)
 }
 
+// IsAdult reports whether channel or its genre is marked as adult content by portal.
+func (c *Channel) IsAdult() bool {
+	return c.Censored || (c.CensoredGenres != nil && (*c.CensoredGenres)[c.GenreID])
+}
+
 // RetrieveChannels retrieves all TV channels from stalker portal.
 func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 	type tmpStruct struct {
 		Js struct {
 			Data []struct {
-				Name    string `json:"name"`        // Title of channel
-				Cmd     string `json:"cmd"`         // Some sort of URL used to request channel real URL
-				Logo    string `json:"logo"`        // Link to logo
-				GenreID string `json:"tv_genre_id"` // Genre ID
-				CMDs    []struct {
+				Name     string     `json:"name"`        // Title of channel
+				Cmd      string     `json:"cmd"`         // Some sort of URL used to request channel real URL
+				Logo     string     `json:"logo"`        // Link to logo
+				GenreID  string     `json:"tv_genre_id"` // Genre ID
+				XMLTVID  string     `json:"xmltv_id"`    // EPG identifier
+				Censored flexString `json:"censored"`    // Adult content flag
+				Number   flexString `json:"number"`      // Channel number
+				CMDs     []struct {
 					ID    string `json:"id"`    // Used for Proxy service to generate fake response to new URL request
 					CH_ID string `json:"ch_id"` // Used for Proxy service to generate fake response to new URL request
 				} `json:"cmds"`
@@ -112,7 +132,7 @@ func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 	}
 	var tmp tmpStruct
 
-	content, err := p.httpRequest(p.Location + "?type=itv&action=get_all_channels&JsHttpRequest=1-xml")
+	content, err := p.httpRequest(p.URL() + "?type=itv&action=get_all_channels&JsHttpRequest=1-xml")
 	if err != nil {
 		return nil, err
 	}
@@ -124,7 +144,7 @@ func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 		log.Fatalln(string(content))
 	}
 
-	genres, err := p.getGenres()
+	genres, censoredGenres, err := p.getGenres()
 	if err != nil {
 		return nil, err
 	}
@@ -133,12 +153,17 @@ func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 	channels := make(map[string]*Channel, len(tmp.Js.Data))
 	for _, v := range tmp.Js.Data {
 		channels[v.Name] = &Channel{
-			Title:     v.Name,
-			CMD:       v.Cmd,
-			LogoLink:  v.Logo,
-			Portal:    p,
-			GenreID:   v.GenreID,
-			Genres:    &genres,
+			Title:    v.Name,
+			CMD:      v.Cmd,
+			LogoLink: v.Logo,
+			Portal:   p,
+			GenreID:  v.GenreID,
+			Genres:   &genres,
+			XMLTVID:  v.XMLTVID,
+			Censored: v.Censored.bool(),
+
+			CensoredGenres: &censoredGenres,
+
 			CMD_CH_ID: v.CMDs[0].ID,
 			CMD_ID:    v.CMDs[0].CH_ID,
 		}
@@ -147,18 +172,19 @@ func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 	return channels, nil
 }
 
-func (p *Portal) getGenres() (map[string]string, error) {
+func (p *Portal) getGenres() (map[string]string, map[string]bool, error) {
 	type tmpStruct struct {
 		Js []struct {
-			ID    string `json:"id"`
-			Title string `json:"title"`
+			ID       string     `json:"id"`
+			Title    string     `json:"title"`
+			Censored flexString `json:"censored"`
 		} `json:"js"`
 	}
 	var tmp tmpStruct
 
-	content, err := p.httpRequest(p.Location + "?action=get_genres&type=itv&JsHttpRequest=1-xml")
+	content, err := p.httpRequest(p.URL() + "?action=get_genres&type=itv&JsHttpRequest=1-xml")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := json.Unmarshal(content, &tmp); err != nil {
@@ -166,9 +192,13 @@ func (p *Portal) getGenres() (map[string]string, error) {
 	}
 
 	genres := make(map[string]string, len(tmp.Js))
+	censored := make(map[string]bool)
 	for _, el := range tmp.Js {
 		genres[el.ID] = el.Title
+		if el.Censored.bool() {
+			censored[el.ID] = true
+		}
 	}
 
-	return genres, nil
+	return genres, censored, nil
 }
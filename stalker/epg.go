@@ -0,0 +1,55 @@
+package stalker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Programme is a single EPG entry of a channel.
+type Programme struct {
+	ID    string    `json:"id"`
+	Title string    `json:"title"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// EPG retrieves current and upcoming programmes of a channel from portal.
+func (c *Channel) EPG() ([]Programme, error) {
+	type tmpStruct struct {
+		Js []struct {
+			ID    flexString `json:"id"`
+			Name  string     `json:"name"`
+			Start flexString `json:"start_timestamp"`
+			Stop  flexString `json:"stop_timestamp"`
+		} `json:"js"`
+	}
+	var tmp tmpStruct
+
+	if c.CMD_ID == "" {
+		return nil, errors.New("portal did not give channel ID of '" + c.Title + "'")
+	}
+	content, err := c.Portal.httpRequest(c.Portal.URL() + "?type=itv&action=get_short_epg&ch_id=" + url.QueryEscape(c.CMD_ID) + "&size=10&JsHttpRequest=1-xml")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &tmp); err != nil {
+		return nil, errors.New("unexpected EPG response: " + err.Error())
+	}
+
+	programmes := make([]Programme, 0, len(tmp.Js))
+	for _, v := range tmp.Js {
+		start, stop := v.Start.int(), v.Stop.int()
+		if start == 0 || stop <= start {
+			continue
+		}
+		programmes = append(programmes, Programme{
+			ID:    string(v.ID),
+			Title: v.Name,
+			Start: time.Unix(int64(start), 0),
+			End:   time.Unix(int64(stop), 0),
+		})
+	}
+	return programmes, nil
+}
@@ -18,13 +18,17 @@ import (
 type Config struct {
 	Portal *Portal `yaml:"portal"`
 	HLS    struct {
-		Enabled bool   `yaml:"enabled"`
-		Bind    string `yaml:"bind"`
+		Enabled bool        `yaml:"enabled"`
+		Bind    string      `yaml:"bind"`
+		TLS     ListenerTLS `yaml:"tls"`
+		Access  AccessRules `yaml:"access"`
 	} `yaml:"hls"`
 	Proxy struct {
-		Enabled bool   `yaml:"enabled"`
-		Bind    string `yaml:"bind"`
-		Rewrite bool   `yaml:"rewrite"`
+		Enabled bool        `yaml:"enabled"`
+		Bind    string      `yaml:"bind"`
+		Rewrite bool        `yaml:"rewrite"`
+		TLS     ListenerTLS `yaml:"tls"`
+		Access  AccessRules `yaml:"access"`
 	} `yaml:"proxy"`
 }
 
@@ -40,19 +44,35 @@ var HTTPClient = &http.Client{
 
 // Portal represents Stalker portal
 type Portal struct {
-	Model        string `yaml:"model"`
-	SerialNumber string `yaml:"serial_number"`
-	DeviceID     string `yaml:"device_id"`
-	DeviceID2    string `yaml:"device_id2"`
-	Signature    string `yaml:"signature"`
-	MAC          string `yaml:"mac"`
-	Username     string `yaml:"username"`
-	Password     string `yaml:"password"`
-	Location     string `yaml:"url"`
-	TimeZone     string `yaml:"time_zone"`
-	Token        string `yaml:"token"`
-	WatchDogTime int    `yaml:"watchdog"`
-	DeviceIdAuth bool   `yaml:"device_id_auth"`
+	Model        string   `yaml:"model"`
+	SerialNumber string   `yaml:"serial_number"`
+	DeviceID     string   `yaml:"device_id"`
+	DeviceID2    string   `yaml:"device_id2"`
+	Signature    string   `yaml:"signature"`
+	MAC          string   `yaml:"mac"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password"`
+	Location     string   `yaml:"url"`     // URL of the active mirror
+	Mirrors      []string `yaml:"mirrors"` // Ordered list of portal URLs; overrides Location if given
+	TimeZone     string   `yaml:"time_zone"`
+	Token        string   `yaml:"token"`
+	WatchDogTime int      `yaml:"watchdog"`
+	DeviceIdAuth bool     `yaml:"device_id_auth"`
+
+	OnEvent        func(WatchdogEvent) `yaml:"-"` // Called for every event received during watchdog updates
+	OnMirrorChange func(string)        `yaml:"-"` // Called when portal switches to another mirror
+
+	Client *http.Client `yaml:"-"` // HTTP client for portal requests; HTTPClient is used if nil
+
+	mirror mirrorState
+}
+
+// client returns HTTP client to be used for requests to the portal.
+func (p *Portal) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return HTTPClient
 }
 
 // ReadConfig returns configuration from the file in Portal object
@@ -104,7 +124,7 @@ func (c *Config) validateWithDefaults() error {
 
 	/* Username and password fields are optional */
 
-	if c.Portal.Location == "" {
+	if c.Portal.Location == "" && len(c.Portal.Mirrors) == 0 {
 		return errors.New("empty portal url")
 	}
 
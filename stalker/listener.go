@@ -0,0 +1,254 @@
+package stalker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	certCAValidity     = 10 * 365 * 24 * time.Hour
+	certServerValidity = 365 * 24 * time.Hour
+	certRenewBefore    = 30 * 24 * time.Hour // Generated server certificate is replaced this long before it expires
+)
+
+// ListenerTLS configures TLS of a local listener (WebUI, HLS or proxy). Certificate and key files
+// take precedence over Auto.
+type ListenerTLS struct {
+	CertFile string `yaml:"cert_file" json:"cert_file,omitempty"` // PEM certificate (chain) file
+	KeyFile  string `yaml:"key_file" json:"key_file,omitempty"`   // PEM private key file
+	Auto     bool   `yaml:"auto" json:"auto,omitempty"`           // Use certificate issued by self-signed CA of the data directory
+}
+
+// Enabled reports whether listener serves HTTPS.
+func (o ListenerTLS) Enabled() bool {
+	return o.Auto || o.CertFile != "" || o.KeyFile != ""
+}
+
+// Scheme returns URL scheme of the listener.
+func (o ListenerTLS) Scheme() string {
+	if o.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+var (
+	certMu  sync.Mutex
+	certDir = filepath.Join("data", "tls")
+	autoCrt *tls.Certificate
+)
+
+// SetCertDir sets directory where self-signed CA and certificate of ListenerTLS.Auto are kept.
+func SetCertDir(dir string) {
+	certMu.Lock()
+	certDir = dir
+	autoCrt = nil
+	certMu.Unlock()
+}
+
+// Config builds TLS configuration of the listener.
+func (o ListenerTLS) Config() (*tls.Config, error) {
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	if !o.Auto {
+		return nil, errors.New("listener TLS is not enabled")
+	}
+	// Certificate is generated up front so that errors show on startup. Later handshakes pick up renewed certificate.
+	if _, err := autoCertificate(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return autoCertificate()
+	}}, nil
+}
+
+// ListenAndServe serves srv over HTTPS if TLS is enabled, or plain HTTP otherwise.
+func ListenAndServe(srv *http.Server, o ListenerTLS) error {
+	if !o.Enabled() {
+		return srv.ListenAndServe()
+	}
+	c, err := o.Config()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = c
+	return srv.ListenAndServeTLS("", "")
+}
+
+// autoCertificate returns server certificate issued by self-signed CA of certificate directory.
+// CA is generated once, so clients need to trust ca.pem only once. Server certificate is
+// regenerated before it expires, and whenever it does not cover addresses of this host.
+func autoCertificate() (*tls.Certificate, error) {
+	certMu.Lock()
+	defer certMu.Unlock()
+	if autoCrt != nil && time.Until(autoCrt.Leaf.NotAfter) > certRenewBefore {
+		return autoCrt, nil
+	}
+	if err := os.MkdirAll(certDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	caCert, caKey, err := loadOrCreateCA()
+	if err != nil {
+		return nil, err
+	}
+
+	certPath, keyPath := filepath.Join(certDir, "server.pem"), filepath.Join(certDir, "server-key.pem")
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > certRenewBefore && leaf.CheckSignatureFrom(caCert) == nil && coversHost(leaf) {
+			cert.Leaf = leaf
+			autoCrt = &cert
+			return autoCrt, nil
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	names := []string{"localhost"}
+	if hostname != "" {
+		names = append(names, hostname)
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "stalkerhek"},
+		DNSNames:    names,
+		IPAddresses: localIPs(),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	key, der, err := issueCertificate(tmpl, certServerValidity, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", key); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated TLS certificate %s; clients should trust %s", certPath, filepath.Join(certDir, "ca.pem"))
+	autoCrt = &cert
+	return autoCrt, nil
+}
+
+// loadOrCreateCA returns self-signed CA of certificate directory, creating it if there is none.
+func loadOrCreateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(certDir, "ca.pem"), filepath.Join(certDir, "ca-key.pem")
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		caCert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		caKey, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New(keyPath + " is not an ECDSA key")
+		}
+		return caCert, caKey, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "stalkerhek local CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	key, der, err := issueCertificate(tmpl, certCAValidity, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", key); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Generated TLS CA %s", certPath)
+	return loadOrCreateCA()
+}
+
+// issueCertificate generates a key and signs certificate of it with CA, or self-signs it if CA is
+// nil. Returns DER encoded key and certificate.
+func issueCertificate(tmpl *x509.Certificate, validity time.Duration, ca *x509.Certificate, caKey *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(validity)
+
+	parent, signer := ca, caKey
+	if ca == nil {
+		parent, signer = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyDER, der, nil
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600)
+}
+
+// localIPs returns addresses of this host's network interfaces.
+func localIPs() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// coversHost reports whether certificate is valid for all current addresses of this host.
+func coversHost(cert *x509.Certificate) bool {
+	for _, ip := range localIPs() {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
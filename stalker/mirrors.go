@@ -0,0 +1,113 @@
+package stalker
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// mirrorFailThreshold defines after how many consecutive failed requests portal switches to the next mirror.
+const mirrorFailThreshold = 3
+
+// mirrorState keeps track of the active portal mirror.
+type mirrorState struct {
+	mu        sync.RWMutex
+	fails     int  // Consecutive failed requests against active mirror
+	switching bool // Mirror switch is in progress; requests made by it are not counted
+}
+
+// URL returns the portal URL of the active mirror.
+func (p *Portal) URL() string {
+	p.mirror.mu.RLock()
+	defer p.mirror.mu.RUnlock()
+	return p.Location
+}
+
+// mirrors returns ordered list of portal URLs. Location is used if no mirrors are configured.
+func (p *Portal) mirrors() []string {
+	if len(p.Mirrors) == 0 {
+		return []string{p.Location}
+	}
+	return p.Mirrors
+}
+
+func (p *Portal) setLocation(location string) {
+	p.mirror.mu.Lock()
+	changed := p.Location != location
+	p.Location = location
+	p.mirror.fails = 0
+	p.mirror.mu.Unlock()
+
+	if changed && p.OnMirrorChange != nil {
+		p.OnMirrorChange(location)
+	}
+}
+
+// connect performs handshake against the first healthy mirror in order.
+func (p *Portal) connect() error {
+	var lastErr error
+	for _, m := range p.mirrors() {
+		p.setLocation(m)
+		if lastErr = p.handshake(); lastErr == nil {
+			return nil
+		}
+		log.Printf("Portal mirror %s is not available: %v", m, lastErr)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no portal URL given")
+	}
+	return lastErr
+}
+
+// reportResult records the outcome of a request against active mirror and switches to the next
+// mirror after too many consecutive failures.
+func (p *Portal) reportResult(err error) {
+	p.mirror.mu.Lock()
+	if p.mirror.switching || len(p.Mirrors) < 2 {
+		p.mirror.mu.Unlock()
+		return
+	}
+	if err == nil {
+		p.mirror.fails = 0
+		p.mirror.mu.Unlock()
+		return
+	}
+	p.mirror.fails++
+	if p.mirror.fails < mirrorFailThreshold {
+		p.mirror.mu.Unlock()
+		return
+	}
+	p.mirror.switching = true
+	current := p.Location
+	p.mirror.mu.Unlock()
+
+	p.switchMirror(current)
+
+	p.mirror.mu.Lock()
+	p.mirror.switching = false
+	p.mirror.mu.Unlock()
+}
+
+// switchMirror moves on to the next mirror after the current one, which accepts a new session.
+func (p *Portal) switchMirror(current string) {
+	mirrors := p.mirrors()
+	start := 0
+	for i, m := range mirrors {
+		if m == current {
+			start = i + 1
+			break
+		}
+	}
+	for i := 0; i < len(mirrors); i++ {
+		m := mirrors[(start+i)%len(mirrors)]
+		log.Printf("Portal mirror %s keeps failing, switching to %s", current, m)
+		p.setLocation(m)
+		if err := p.reconnect(); err != nil {
+			log.Printf("Portal mirror %s is not available: %v", m, err)
+			continue
+		}
+		return
+	}
+	// Nothing works - stay on the original mirror and try again later
+	p.setLocation(current)
+}
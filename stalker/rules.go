@@ -0,0 +1,226 @@
+package stalker
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PlaylistRules customizes channel list of a profile. Filters are matched against titles and
+// genres given by portal; ordering and numbering are matched against titles after renaming.
+type PlaylistRules struct {
+	Include       []string          `yaml:"include" json:"include,omitempty"`               // Keep only channels whose title matches one of these regexes
+	Exclude       []string          `yaml:"exclude" json:"exclude,omitempty"`               // Drop channels whose title matches any of these regexes
+	IncludeGenres []string          `yaml:"include_genres" json:"include_genres,omitempty"` // Keep only channels of these genres
+	ExcludeGenres []string          `yaml:"exclude_genres" json:"exclude_genres,omitempty"` // Drop channels of these genres
+	Rename        []RenameRule      `yaml:"rename" json:"rename,omitempty"`                 // Regex substitutions applied to titles, in order
+	Groups        map[string]string `yaml:"groups" json:"groups,omitempty"`                 // Genre -> group title to show instead
+	Order         []string          `yaml:"order" json:"order,omitempty"`                   // Titles pinned to the top of the list, in this order
+	Numbers       map[string]int    `yaml:"numbers" json:"numbers,omitempty"`               // Title -> channel number
+	HideAdult     bool              `yaml:"hide_adult" json:"hide_adult,omitempty"`         // Drop channels and genres marked as censored by portal
+}
+
+// RenameRule replaces matches of regex Match in channel title with Replace ($1 etc. are expanded).
+type RenameRule struct {
+	Match   string `yaml:"match" json:"match"`
+	Replace string `yaml:"replace" json:"replace"`
+}
+
+// IsZero reports whether no rules are set, so channel list is used as given by portal.
+func (r PlaylistRules) IsZero() bool {
+	return len(r.Include) == 0 && len(r.Exclude) == 0 && len(r.IncludeGenres) == 0 && len(r.ExcludeGenres) == 0 &&
+		len(r.Rename) == 0 && len(r.Groups) == 0 && len(r.Order) == 0 && len(r.Numbers) == 0 && !r.HideAdult
+}
+
+// RuleSet is compiled PlaylistRules. Nil RuleSet keeps channel list unchanged.
+type RuleSet struct {
+	hideAdult     bool
+	include       []*regexp.Regexp
+	exclude       []*regexp.Regexp
+	rename        []*regexp.Regexp
+	replace       []string
+	includeGenres map[string]bool // Lowercase genre titles
+	excludeGenres map[string]bool // Lowercase genre titles
+	groups        map[string]string
+	order         map[string]int
+	numbers       map[string]int
+}
+
+// Compile validates rules and prepares them for use. Returns nil RuleSet if no rules are set.
+func (r PlaylistRules) Compile() (*RuleSet, error) {
+	if r.IsZero() {
+		return nil, nil
+	}
+
+	compile := func(what string, exprs []string) ([]*regexp.Regexp, error) {
+		out := make([]*regexp.Regexp, 0, len(exprs))
+		for _, e := range exprs {
+			re, err := regexp.Compile(e)
+			if err != nil {
+				return nil, errors.New(what + " rule '" + e + "': " + err.Error())
+			}
+			out = append(out, re)
+		}
+		return out, nil
+	}
+	lower := func(arr []string) map[string]bool {
+		out := make(map[string]bool, len(arr))
+		for _, s := range arr {
+			out[strings.ToLower(strings.TrimSpace(s))] = true
+		}
+		return out
+	}
+
+	rs := &RuleSet{
+		hideAdult:     r.HideAdult,
+		includeGenres: lower(r.IncludeGenres),
+		excludeGenres: lower(r.ExcludeGenres),
+		groups:        make(map[string]string, len(r.Groups)),
+		order:         make(map[string]int, len(r.Order)),
+		numbers:       r.Numbers,
+	}
+	var err error
+	if rs.include, err = compile("include", r.Include); err != nil {
+		return nil, err
+	}
+	if rs.exclude, err = compile("exclude", r.Exclude); err != nil {
+		return nil, err
+	}
+	for _, rr := range r.Rename {
+		re, err := regexp.Compile(rr.Match)
+		if err != nil {
+			return nil, errors.New("rename rule '" + rr.Match + "': " + err.Error())
+		}
+		rs.rename = append(rs.rename, re)
+		rs.replace = append(rs.replace, rr.Replace)
+	}
+	for genre, group := range r.Groups {
+		rs.groups[strings.ToLower(strings.TrimSpace(genre))] = group
+	}
+	for i, title := range r.Order {
+		if _, exists := rs.order[title]; !exists {
+			rs.order[title] = i
+		}
+	}
+	return rs, nil
+}
+
+// Genre reports whether channels of given genre are kept and returns group title to show for it.
+func (rs *RuleSet) Genre(genre string, censored bool) (string, bool) {
+	if rs == nil {
+		return genre, true
+	}
+	key := strings.ToLower(genre)
+	if (rs.hideAdult && censored) || (len(rs.includeGenres) > 0 && !rs.includeGenres[key]) || rs.excludeGenres[key] {
+		return "", false
+	}
+	if group, found := rs.groups[key]; found {
+		return group, true
+	}
+	return genre, true
+}
+
+// Channel reports whether channel is kept and returns its title after renaming.
+func (rs *RuleSet) Channel(title, genre string, censored bool) (string, bool) {
+	if rs == nil {
+		return title, true
+	}
+	if _, keep := rs.Genre(genre, censored); !keep {
+		return "", false
+	}
+	if len(rs.include) > 0 && !matchAny(rs.include, title) {
+		return "", false
+	}
+	if matchAny(rs.exclude, title) {
+		return "", false
+	}
+	for i, re := range rs.rename {
+		title = re.ReplaceAllString(title, rs.replace[i])
+	}
+	return strings.TrimSpace(title), true
+}
+
+// Number returns pinned channel number of a (renamed) title, or 0 if none is set.
+func (rs *RuleSet) Number(title string) int {
+	if rs == nil {
+		return 0
+	}
+	return rs.numbers[title]
+}
+
+// Rank returns sort key of a (renamed) title that has pinned position. Titles listed in Order
+// come first, followed by titles with pinned numbers.
+func (rs *RuleSet) Rank(title string) (int, bool) {
+	if rs == nil {
+		return 0, false
+	}
+	if i, found := rs.order[title]; found {
+		return i, true
+	}
+	if n, found := rs.numbers[title]; found {
+		return len(rs.order) + n, true
+	}
+	return 0, false
+}
+
+// Apply returns customized copy of channel list. Returned channels are keyed by their new titles
+// and have Group, Number and Position set.
+func (rs *RuleSet) Apply(chs map[string]*Channel) map[string]*Channel {
+	if rs == nil {
+		return chs
+	}
+
+	out := make(map[string]*Channel, len(chs))
+	origin := make(map[string]string, len(chs)) // New title -> original title
+	for _, c := range chs {
+		genre := c.Genre()
+		title, keep := rs.Channel(c.Title, genre, c.IsAdult())
+		if !keep || title == "" {
+			continue
+		}
+		// Renaming may produce duplicate titles; keep the channel with alphabetically first original title
+		if prev, exists := origin[title]; exists && prev < c.Title {
+			continue
+		}
+		ch := *c
+		ch.Title = title
+		if group, _ := rs.Genre(genre, false); group != genre {
+			ch.Group = group
+		}
+		if n := rs.Number(title); n > 0 {
+			ch.Number = n
+		}
+		out[title] = &ch
+		origin[title] = c.Title
+	}
+
+	titles := make([]string, 0, len(out))
+	for title := range out {
+		titles = append(titles, title)
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		ri, pi := rs.Rank(titles[i])
+		rj, pj := rs.Rank(titles[j])
+		if pi != pj {
+			return pi
+		}
+		if pi && ri != rj {
+			return ri < rj
+		}
+		return titles[i] < titles[j]
+	})
+	for i, title := range titles {
+		out[title].Position = i + 1
+	}
+	return out
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package stalker
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPlaylistRulesCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   PlaylistRules
+		wantNil bool
+		wantErr bool
+	}{
+		{"no rules", PlaylistRules{}, true, false},
+		{"valid", PlaylistRules{Include: []string{"^BBC"}, Rename: []RenameRule{{` HD$`, ""}}}, false, false},
+		{"hide adult only", PlaylistRules{HideAdult: true}, false, false},
+		{"invalid include", PlaylistRules{Include: []string{"("}}, true, true},
+		{"invalid exclude", PlaylistRules{Exclude: []string{"[a-"}}, true, true},
+		{"invalid rename", PlaylistRules{Rename: []RenameRule{{"*", ""}}}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := tt.rules.Compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if (rs == nil) != tt.wantNil {
+				t.Errorf("Compile() = %v, want nil %v", rs, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestRuleSetChannel(t *testing.T) {
+	rs, err := PlaylistRules{
+		Include:       []string{`(?i)bbc|cnn|sky`},
+		Exclude:       []string{`(?i)\bradio\b`},
+		ExcludeGenres: []string{" Shopping "},
+		Rename:        []RenameRule{{`\s*(FHD|HD)$`, ""}, {`^BBC (\w+)`, "BBC-$1"}},
+		HideAdult:     true,
+	}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		title    string
+		genre    string
+		censored bool
+		want     string
+		keep     bool
+	}{
+		{"kept as is", "CNN", "News", false, "CNN", true},
+		{"renamed in order", "BBC One HD", "General", false, "BBC-One", true},
+		{"not included", "Eurosport", "Sports", false, "", false},
+		{"excluded", "BBC Radio 1", "Music", false, "", false},
+		{"genre excluded case-insensitively", "Sky Shop", "shopping", false, "", false},
+		{"adult hidden", "Sky Late", "Movies", true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			title, keep := rs.Channel(tt.title, tt.genre, tt.censored)
+			if title != tt.want || keep != tt.keep {
+				t.Errorf("Channel(%q) = %q, %v; want %q, %v", tt.title, title, keep, tt.want, tt.keep)
+			}
+		})
+	}
+}
+
+func TestRuleSetGenre(t *testing.T) {
+	rs, err := PlaylistRules{
+		IncludeGenres: []string{"News", "Sports", "Kids"},
+		Groups:        map[string]string{"sports": "Sport & Fitness"},
+		HideAdult:     true,
+	}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		genre    string
+		censored bool
+		want     string
+		keep     bool
+	}{
+		{"included", "News", false, "News", true},
+		{"grouped", "SPORTS", false, "Sport & Fitness", true},
+		{"not included", "Movies", false, "", false},
+		{"censored", "Kids", true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, keep := rs.Genre(tt.genre, tt.censored)
+			if group != tt.want || keep != tt.keep {
+				t.Errorf("Genre(%q) = %q, %v; want %q, %v", tt.genre, group, keep, tt.want, tt.keep)
+			}
+		})
+	}
+
+	var none *RuleSet
+	if group, keep := none.Genre("Movies", true); group != "Movies" || !keep {
+		t.Errorf("nil RuleSet Genre() = %q, %v; want genre kept", group, keep)
+	}
+}
+
+func TestRuleSetApply(t *testing.T) {
+	genres := map[string]string{"1": "news", "2": "sports", "3": "adult"}
+	censored := map[string]bool{"3": true}
+	channels := func(titles ...string) map[string]*Channel {
+		out := make(map[string]*Channel)
+		for i := 0; i+1 < len(titles); i += 2 {
+			out[titles[i]] = &Channel{Title: titles[i], GenreID: titles[i+1], Genres: &genres, CensoredGenres: &censored}
+		}
+		return out
+	}
+	type result struct {
+		Title    string
+		Group    string
+		Number   int
+		Position int
+	}
+	tests := []struct {
+		name  string
+		rules PlaylistRules
+		chs   map[string]*Channel
+		want  []result // By position
+	}{
+		{
+			"sorted by title without pins",
+			PlaylistRules{HideAdult: true},
+			channels("CNN", "1", "ESPN", "2", "Late", "3", "BBC", "1"),
+			[]result{{"BBC", "", 0, 1}, {"CNN", "", 0, 2}, {"ESPN", "", 0, 3}},
+		},
+		{
+			"order before numbers before the rest",
+			PlaylistRules{Order: []string{"ESPN", "CNN", "ESPN"}, Numbers: map[string]int{"BBC": 5}},
+			channels("BBC", "1", "CNN", "1", "ESPN", "2", "Al Jazeera", "1"),
+			[]result{{"ESPN", "", 0, 1}, {"CNN", "", 0, 2}, {"BBC", "", 5, 3}, {"Al Jazeera", "", 0, 4}},
+		},
+		{
+			"duplicate titles after renaming keep first original",
+			PlaylistRules{Rename: []RenameRule{{` (HD|SD)$`, ""}}},
+			channels("CNN SD", "1", "CNN HD", "1"),
+			[]result{{"CNN", "", 0, 1}},
+		},
+		{
+			"groups replace genres",
+			PlaylistRules{Groups: map[string]string{"Sports": "Sport"}},
+			channels("ESPN", "2", "CNN", "1"),
+			[]result{{"CNN", "", 0, 1}, {"ESPN", "Sport", 0, 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := tt.rules.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []result
+			for key, c := range rs.Apply(tt.chs) {
+				if key != c.Title {
+					t.Errorf("channel %q is keyed as %q", c.Title, key)
+				}
+				got = append(got, result{c.Title, c.Group, c.Number, c.Position})
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i].Position < got[j].Position })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package stalker
 
 import (
-	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
@@ -12,8 +11,8 @@ import (
 
 // Start connects to stalker portal, authenticates, starts watchdog etc.
 func (p *Portal) Start() error {
-	// Reserve token in Stalker portal
-	if err := p.handshake(); err != nil {
+	// Reserve token in Stalker portal, using the first healthy mirror
+	if err := p.connect(); err != nil {
 		return err
 	}
 
@@ -40,7 +39,7 @@ func (p *Portal) Start() error {
 			for {
 				time.Sleep(time.Duration(p.WatchDogTime) * time.Minute)
 				if err := p.watchdogUpdate(); err != nil {
-					log.Fatalln(err)
+					log.Println("Watchdog update failed:", err)
 				}
 			}
 		}()
@@ -64,15 +63,21 @@ func (p *Portal) httpRequest(link string) ([]byte, error) {
 
 	req.Header.Set("Cookie", cookieText)
 
-	resp, err := HTTPClient.Do(req)
+	resp, err := p.client().Do(req)
 	if err != nil {
+		p.reportResult(err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, errors.New("Site '" + link + "' returned " + resp.Status)
+		err = errors.New("Site '" + link + "' returned " + resp.Status)
+		if resp.StatusCode >= 500 {
+			p.reportResult(err)
+		}
+		return nil, err
 	}
+	p.reportResult(nil)
 
 	contents, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -81,27 +86,3 @@ func (p *Portal) httpRequest(link string) ([]byte, error) {
 
 	return contents, nil
 }
-
-// WatchdogUpdate performs watchdog update request.
-func (p *Portal) watchdogUpdate() error {
-	type wdStruct struct {
-		Js struct {
-			Data struct {
-				Msgs                   int `json:"msgs"`
-				Additional_services_on int `json:"additional_services_on"`
-			} `json:"data"`
-		} `json:"js"`
-		Text string `json:"text"`
-	}
-	var wd wdStruct
-	content, err := p.httpRequest(p.Location + "?action=get_events&event_active_id=0&init=0&type=watchdog&cur_play_type=1&JsHttpRequest=1-xml")
-	if err != nil {
-		return err
-	}
-
-	if err := json.Unmarshal(content, &wd); err != nil {
-		log.Fatalln("Watchdog update: " + string(content))
-	}
-
-	return nil
-}
@@ -0,0 +1,198 @@
+package stalker
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TLSOptions configures TLS of outbound connections (portal, stream origins, logos).
+type TLSOptions struct {
+	CAFile             string   `yaml:"ca_file" json:"ca_file,omitempty"`                           // PEM bundle of extra trusted CAs
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify" json:"insecure_skip_verify,omitempty"` // Accept any certificate
+	PinnedSHA256       []string `yaml:"pinned_sha256" json:"pinned_sha256,omitempty"`               // SHA-256 fingerprints of accepted certificates
+	ClientCert         string   `yaml:"client_cert" json:"client_cert,omitempty"`                   // PEM client certificate file
+	ClientKey          string   `yaml:"client_key" json:"client_key,omitempty"`                     // PEM client key file
+}
+
+// IsZero reports whether no TLS options are set, so defaults can be used.
+func (o TLSOptions) IsZero() bool {
+	return o.CAFile == "" && !o.InsecureSkipVerify && len(o.PinnedSHA256) == 0 && o.ClientCert == "" && o.ClientKey == ""
+}
+
+// Config builds TLS configuration out of given options.
+//
+// If fingerprints are pinned, certificate of server itself (the leaf) must match one of them. Chain is then
+// verified against CAs only if CA file is set, so self-signed certificates can be pinned without one.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + o.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if o.ClientCert != "" || o.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(o.PinnedSHA256) > 0 {
+		pins := make(map[string]bool, len(o.PinnedSHA256))
+		for _, p := range o.PinnedSHA256 {
+			p = strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(p))
+			if _, err := hex.DecodeString(p); err != nil || len(p) != sha256.Size*2 {
+				return nil, errors.New("invalid SHA-256 fingerprint '" + p + "'")
+			}
+			pins[p] = true
+		}
+		verifyChain := c.RootCAs != nil && !o.InsecureSkipVerify
+		roots := c.RootCAs
+		// Default verification is replaced by the one below, as it would reject self-signed certificates
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			if verifyChain {
+				intermediates := x509.NewCertPool()
+				for _, cert := range cs.PeerCertificates[1:] {
+					intermediates.AddCert(cert)
+				}
+				opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: cs.ServerName}
+				if _, err := leaf.Verify(opts); err != nil {
+					return err
+				}
+			}
+			sum := sha256.Sum256(leaf.Raw)
+			if !pins[hex.EncodeToString(sum[:])] {
+				return errors.New("server certificate does not match any pinned fingerprint")
+			}
+			return nil
+		}
+	}
+
+	return c, nil
+}
+
+// DNSOptions configures name resolution of outbound connections.
+type DNSOptions struct {
+	Hosts  map[string]string `yaml:"hosts" json:"hosts,omitempty"`   // Hostname -> IP overrides, like /etc/hosts
+	Server string            `yaml:"server" json:"server,omitempty"` // DNS server to use instead of system's, e.g. "1.1.1.1:53"
+}
+
+// resolver returns resolver that queries configured DNS server, or system resolver if none is set.
+func (o DNSOptions) resolver() *net.Resolver {
+	if o.Server == "" {
+		return net.DefaultResolver
+	}
+	server := o.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 5 * time.Second}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Resolve returns IP addresses of host and the source they were taken from.
+func (o DNSOptions) Resolve(ctx context.Context, host string) (ips []string, source string, err error) {
+	for h, ip := range o.Hosts {
+		if strings.EqualFold(h, host) {
+			return []string{ip}, "override", nil
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, "literal", nil
+	}
+	source = "system resolver"
+	if o.Server != "" {
+		source = "DNS server " + o.Server
+	}
+	ips, err = o.resolver().LookupHost(ctx, host)
+	return ips, source, err
+}
+
+// dialContext returns dial function that resolves hostnames according to DNS options.
+func (o DNSOptions) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(o.Hosts) == 0 && o.Server == "" {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, _, err := o.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error = errors.New("no addresses found for " + host)
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// NewTransport returns HTTP transport with connection pooling, configured with given TLS and DNS options.
+func NewTransport(tlsOpts TLSOptions, dnsOpts DNSOptions) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dnsOpts.dialContext(dialer),
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if !tlsOpts.IsZero() {
+		c, err := tlsOpts.Config()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = c
+	}
+	return t, nil
+}
+
+// NewHTTPClient returns HTTP client for portal requests that uses given transport.
+func NewHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: transport,
+	}
+}
@@ -0,0 +1,109 @@
+package stalker
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serverTemplate returns template of server certificate for 127.0.0.1.
+func serverTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+// testCertificate issues certificate of template, signed by CA or self-signed if CA is nil.
+func testCertificate(t *testing.T, tmpl *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	keyDER, der, err := issueCertificate(tmpl, time.Hour, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestTLSOptionsPinning(t *testing.T) {
+	caTmpl := &x509.Certificate{Subject: pkix.Name{CommonName: "CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	ca, caKey := testCertificate(t, caTmpl, nil, nil)
+	signed, signedKey := testCertificate(t, serverTemplate("signed"), ca, caKey)
+	self, selfKey := testCertificate(t, serverTemplate("self-signed"), nil, nil)
+	other, _ := testCertificate(t, serverTemplate("other"), nil, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := writePEM(caFile, "CERTIFICATE", ca.Raw); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate // Sent by server, leaf first
+		key   *ecdsa.PrivateKey
+		opts  TLSOptions
+		ok    bool
+	}{
+		{"pinned self-signed leaf", []*x509.Certificate{self}, selfKey, TLSOptions{PinnedSHA256: []string{fingerprint(self)}}, true},
+		{"pinned certificate after unpinned leaf", []*x509.Certificate{self, other}, selfKey, TLSOptions{PinnedSHA256: []string{fingerprint(other)}}, false},
+		{"no pin matches", []*x509.Certificate{self}, selfKey, TLSOptions{PinnedSHA256: []string{fingerprint(other)}}, false},
+		{"pinned leaf issued by CA", []*x509.Certificate{signed}, signedKey, TLSOptions{CAFile: caFile, PinnedSHA256: []string{fingerprint(signed)}}, true},
+		{"pinned leaf not issued by CA", []*x509.Certificate{self}, selfKey, TLSOptions{CAFile: caFile, PinnedSHA256: []string{fingerprint(self)}}, false},
+		{"pinned leaf with CA check skipped", []*x509.Certificate{self}, selfKey, TLSOptions{CAFile: caFile, InsecureSkipVerify: true, PinnedSHA256: []string{fingerprint(self)}}, true},
+		{"CA only", []*x509.Certificate{signed}, signedKey, TLSOptions{CAFile: caFile}, true},
+		{"unknown CA", []*x509.Certificate{self}, selfKey, TLSOptions{CAFile: caFile}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			cert := tls.Certificate{PrivateKey: tt.key}
+			for _, c := range tt.chain {
+				cert.Certificate = append(cert.Certificate, c.Raw)
+			}
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			srv.StartTLS()
+			defer srv.Close()
+
+			transport, err := NewTransport(tt.opts, DNSOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.CloseIdleConnections()
+			resp, err := NewHTTPClient(transport).Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("request error = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTLSOptionsInvalidPin(t *testing.T) {
+	if _, err := (TLSOptions{PinnedSHA256: []string{"3f:1a:9c"}}).Config(); err == nil {
+		t.Error("short fingerprint was accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package stalker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Watchdog events sent by Stalker portal.
+const (
+	EventSendMessage     = "send_msg"
+	EventSendMsgVideo    = "send_msg_with_video"
+	EventUpdateChannels  = "update_channels"
+	EventReboot          = "reboot"
+	EventReloadPortal    = "reload_portal"
+	EventCutOff          = "cut_off"
+	EventCutOn           = "cut_on"
+	EventUpdateSubscript = "update_subscription"
+)
+
+// WatchdogEvent represents an event received from portal during watchdog update.
+type WatchdogEvent struct {
+	ID            string    // Portal's event ID, used for confirmation
+	Event         string    // Event type, e.g. "send_msg" or "cut_off"
+	Message       string    // Text of operator's message (send_msg events only)
+	NeedConfirm   bool      // Portal expects the message to be confirmed by viewer
+	RebootAfterOK bool      // STB should reboot after the message is confirmed
+	SendTime      string    // Time when portal sent the event, as given by portal
+	Received      time.Time // Time when event was received
+}
+
+// flexString decodes JSON strings, numbers and booleans into a string. Portals are not consistent
+// about types of watchdog fields.
+type flexString string
+
+func (f *flexString) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*f = flexString(s)
+		return nil
+	}
+	if string(b) == "null" {
+		*f = ""
+		return nil
+	}
+	*f = flexString(strings.Trim(string(b), `"`))
+	return nil
+}
+
+func (f flexString) bool() bool {
+	return f != "" && f != "0" && f != "false"
+}
+
+func (f flexString) int() int {
+	n, _ := strconv.Atoi(string(f))
+	return n
+}
+
+// watchdogUpdate performs watchdog update request, decodes received event (if any) and acts on it.
+func (p *Portal) watchdogUpdate() error {
+	type wdStruct struct {
+		Js struct {
+			Data struct {
+				Msgs                 flexString `json:"msgs"`
+				ID                   flexString `json:"id"`
+				Event                flexString `json:"event"`
+				Msg                  flexString `json:"msg"`
+				NeedConfirm          flexString `json:"need_confirm"`
+				RebootAfterOK        flexString `json:"reboot_after_ok"`
+				SendTime             flexString `json:"send_time"`
+				AdditionalServicesOn flexString `json:"additional_services_on"`
+			} `json:"data"`
+		} `json:"js"`
+		Text string `json:"text"`
+	}
+	var wd wdStruct
+	content, err := p.httpRequest(p.URL() + "?action=get_events&event_active_id=0&init=0&type=watchdog&cur_play_type=1&JsHttpRequest=1-xml")
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(content, &wd); err != nil {
+		return fmt.Errorf("Watchdog update: %v (%.200q)", err, content)
+	}
+
+	data := wd.Js.Data
+	if data.Event == "" {
+		return nil
+	}
+
+	ev := WatchdogEvent{
+		ID:            string(data.ID),
+		Event:         string(data.Event),
+		Message:       string(data.Msg),
+		NeedConfirm:   data.NeedConfirm.bool(),
+		RebootAfterOK: data.RebootAfterOK.bool(),
+		SendTime:      string(data.SendTime),
+		Received:      time.Now(),
+	}
+	log.Printf("Watchdog event '%s' (id %s) received", ev.Event, ev.ID)
+
+	// Confirm event, otherwise portal keeps sending it over and over again
+	if ev.ID != "" {
+		if _, err := p.httpRequest(p.URL() + "?type=watchdog&action=confirm_event&event_active_id=" + url.QueryEscape(ev.ID) + "&JsHttpRequest=1-xml"); err != nil {
+			log.Println("Failed to confirm watchdog event:", err)
+		}
+	}
+
+	// Reboot of STB means new session for us
+	if ev.Event == EventReboot || ev.Event == EventReloadPortal {
+		if err := p.reconnect(); err != nil {
+			log.Println("Reconnecting after portal's reboot request failed:", err)
+		}
+	}
+
+	if p.OnEvent != nil {
+		p.OnEvent(ev)
+	}
+	return nil
+}
+
+// reconnect performs handshake and authentication again, as STB would do after reboot.
+func (p *Portal) reconnect() error {
+	if err := p.handshake(); err != nil {
+		return err
+	}
+	if p.Username != "" && p.Password != "" {
+		return p.authenticate()
+	} else if p.DeviceIdAuth {
+		return p.authenticateWithDeviceIDs()
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package webui
+
+import (
+	"net/http"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+	"github.com/CrazeeGhost/stalkerhek/proxy"
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+func init() {
+	// GET returns counters of requests rejected by access rules of profile's HLS and proxy services
+	registerProfileAPI("access", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		hlsStats, hlsOK := hls.GetAccessStats(p.ID)
+		proxyStats, proxyOK := proxy.GetAccessStats(p.ID)
+		if !hlsOK && !proxyOK {
+			http.Error(w, errNotRunning.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, map[string]stalker.AccessStats{"hls": hlsStats, "proxy": proxyStats})
+	})
+}
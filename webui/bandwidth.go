@@ -0,0 +1,26 @@
+package webui
+
+import (
+	"net/http"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+// RegisterBandwidthHandlers mounts /api/bandwidth: traffic of hourly or daily windows
+// (?window=hourly|daily), aggregated by profile, channel or client (?by=...), optionally of a
+// single profile (?profile=N)
+func RegisterBandwidthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		by := q.Get("by")
+		if by == "" {
+			by = "profile"
+		}
+		usage, err := hls.GetUsage(q.Get("window"), by, atoiSafe(q.Get("profile")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, usage)
+	})
+}
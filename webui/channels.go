@@ -0,0 +1,19 @@
+package webui
+
+import (
+	"net/http"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+func init() {
+	// GET returns channels of a running profile with results of their last health probes
+	registerProfileAPI("channels", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		chs, ok := hls.GetChannels(p.ID)
+		if !ok {
+			http.Error(w, errNotRunning.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, chs)
+	})
+}
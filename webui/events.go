@@ -0,0 +1,108 @@
+package webui
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// maxProfileEvents limits per-profile event history
+const maxProfileEvents = 100
+
+// ProfileEvent is a watchdog event received from portal and what was done about it
+type ProfileEvent struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Message  string    `json:"message,omitempty"`
+	SendTime string    `json:"send_time,omitempty"`
+	Action   string    `json:"action"`
+}
+
+var (
+	evMu   sync.RWMutex
+	events = map[int][]ProfileEvent{}
+)
+
+// AddProfileEvent appends event to profile's history, dropping the oldest ones
+func AddProfileEvent(id int, ev ProfileEvent) {
+	evMu.Lock()
+	defer evMu.Unlock()
+	arr := append(events[id], ev)
+	if len(arr) > maxProfileEvents {
+		arr = arr[len(arr)-maxProfileEvents:]
+	}
+	events[id] = arr
+}
+
+// ListProfileEvents returns a copy of profile's event history, newest first
+func ListProfileEvents(id int) []ProfileEvent {
+	evMu.RLock()
+	defer evMu.RUnlock()
+	arr := events[id]
+	out := make([]ProfileEvent, len(arr))
+	for i, ev := range arr {
+		out[len(arr)-1-i] = ev
+	}
+	return out
+}
+
+func init() {
+	registerProfileAPI("events", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		writeJSON(w, ListProfileEvents(p.ID))
+	})
+}
+
+// handleWatchdogEvent acts on event received from profile's portal
+func handleWatchdogEvent(p Profile, portal *stalker.Portal, ev stalker.WatchdogEvent) {
+	var action string
+	switch ev.Event {
+	case stalker.EventSendMessage, stalker.EventSendMsgVideo:
+		SetProfilePortalMessage(p.ID, ev.Message)
+		action = "message shown in dashboard"
+	case stalker.EventUpdateChannels, stalker.EventUpdateSubscript:
+		action = refreshChannels(p, portal)
+	case stalker.EventReboot, stalker.EventReloadPortal:
+		action = "portal session re-established"
+	case stalker.EventCutOff:
+		SetProfileBlocked(p.ID, true)
+		action = "profile marked as blocked"
+	case stalker.EventCutOn:
+		SetProfileBlocked(p.ID, false)
+		action = "profile unblocked"
+	default:
+		action = "ignored"
+	}
+	log.Printf("[PROFILE %s] Portal event '%s': %s", p.Name, ev.Event, action)
+	AddProfileEvent(p.ID, ProfileEvent{
+		Time:     ev.Received,
+		ID:       ev.ID,
+		Event:    ev.Event,
+		Message:  ev.Message,
+		SendTime: ev.SendTime,
+		Action:   action,
+	})
+}
+
+// refreshChannels retrieves channel list again and hands it to running services
+func refreshChannels(p Profile, portal *stalker.Portal) string {
+	chs, err := portal.RetrieveChannels()
+	if err != nil {
+		return "channel refresh failed: " + err.Error()
+	}
+	if len(chs) == 0 {
+		return "channel refresh returned no channels, keeping old list"
+	}
+	setRawChannels(p.ID, chs)
+	n, err := applyRules(p.ID)
+	if err == errNotRunning {
+		return "services not running, nothing to refresh"
+	}
+	if err != nil {
+		return "channel refresh failed: " + err.Error()
+	}
+	return "channel list refreshed (" + itoa(n) + " channels)"
+}
@@ -8,6 +8,8 @@ import (
 	"runtime"
 	"sync"
 	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
 )
 
 // Health represents overall service health
@@ -25,19 +27,20 @@ type Health struct {
 
 // Metrics represents runtime metrics
 type Metrics struct {
-	UptimeSeconds   int64   `json:"uptime_seconds"`
-	GoRoutines      int     `json:"goroutines"`
-	MemAllocMB      float64 `json:"mem_alloc_mb"`
-	MemTotalMB      float64 `json:"mem_total_mb"`
-	MemSysMB        float64 `json:"mem_sys_mb"`
-	GCPausesTotal   uint64  `json:"gc_pauses_total"`
-	NumGC           uint32  `json:"num_gc"`
-	ProfilesTotal   int     `json:"profiles_total"`
-	ProfilesRunning int     `json:"profiles_running"`
-	ProfilesError   int     `json:"profiles_error"`
-	RequestsTotal   uint64  `json:"requests_total"`
-	ErrorsTotal     uint64  `json:"errors_total"`
-	Timestamp       time.Time `json:"timestamp"`
+	UptimeSeconds   int64                 `json:"uptime_seconds"`
+	GoRoutines      int                   `json:"goroutines"`
+	MemAllocMB      float64               `json:"mem_alloc_mb"`
+	MemTotalMB      float64               `json:"mem_total_mb"`
+	MemSysMB        float64               `json:"mem_sys_mb"`
+	GCPausesTotal   uint64                `json:"gc_pauses_total"`
+	NumGC           uint32                `json:"num_gc"`
+	ProfilesTotal   int                   `json:"profiles_total"`
+	ProfilesRunning int                   `json:"profiles_running"`
+	ProfilesError   int                   `json:"profiles_error"`
+	RequestsTotal   uint64                `json:"requests_total"`
+	ErrorsTotal     uint64                `json:"errors_total"`
+	SegmentCache    hls.SegmentCacheStats `json:"segment_cache"`
+	Timestamp       time.Time             `json:"timestamp"`
 }
 
 var (
@@ -131,6 +134,7 @@ func RegisterHealthHandlers(mux *http.ServeMux) {
 			ProfilesError:   errors,
 			RequestsTotal:   reqCounter,
 			ErrorsTotal:     errCounter,
+			SegmentCache:    hls.GetSegmentCacheStats(),
 			Timestamp:       time.Now().UTC(),
 		}
 
@@ -0,0 +1,90 @@
+package webui
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+func init() {
+	// GET tells which channels have no logo in local logo pack
+	registerProfileAPI("logos", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		report, ok := hls.GetLogoReport(p.ID)
+		if !ok {
+			http.Error(w, errNotRunning.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, report)
+	})
+}
+
+// RegisterLogoHandlers mounts logo pack report page
+func RegisterLogoHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/logos", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := GetProfile(atoiSafe(r.URL.Query().Get("id")))
+		if !ok {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		report, running := hls.GetLogoReport(p.ID)
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		t := template.Must(template.New("logos").Parse(logosTpl))
+		_ = t.Execute(w, struct {
+			Profile
+			Host    string
+			Running bool
+			Report  hls.LogoReport
+		}{p, host, running, report})
+	})
+}
+
+const logosTpl = `<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Logos - {{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}}</title>
+  <style>
+    :root{--bg:#0a0f0a;--panel:#0d1410;--border:#1f2e23;--text:#e0e6e0;--muted:#9aaa9a;--brand:#2d7a4e;--brand-hover:#3a8f5e;--bad:#e85d4d}
+    *{box-sizing:border-box}
+    body{margin:0;font-family:system-ui,-apple-system,Segoe UI,Roboto,Ubuntu,Helvetica,Arial,sans-serif;background:linear-gradient(180deg, #0d1410 0%, #0a0f0a 100%);color:var(--text);min-height:100vh}
+    a{color:var(--brand);text-decoration:none} a:hover{color:var(--brand-hover);text-decoration:underline}
+    .wrap{max-width:900px;margin:0 auto;padding:16px 12px 60px}
+    h1{margin:0 0 6px 0;font-size:26px}
+    .sub{color:var(--muted);font-size:14px;line-height:1.4;margin-bottom:16px}
+    .card{background:linear-gradient(180deg, rgba(17,24,21,.96), rgba(13,20,16,.94));border:1px solid var(--border);border-radius:16px;padding:20px;box-shadow:0 12px 32px rgba(0,0,0,.4)}
+    .card h2{margin:0 0 12px 0;font-size:18px}
+    table{width:100%;border-collapse:collapse;font-size:13px}
+    td{text-align:left;padding:6px 8px;border-bottom:1px solid var(--border)}
+    img{width:48px;height:48px;object-fit:contain;vertical-align:middle}
+    .muted{color:var(--muted)}
+  </style>
+</head>
+<body>
+  <div class="wrap">
+    <h1>Logo pack</h1>
+    <div class="sub">{{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}} &middot; Channels without logo in the local logo pack get the portal's logo, or a generated placeholder. <a href="/dashboard">Back to dashboard</a></div>
+    <div class="card">
+    {{if not .Running}}
+      <div class="muted">Profile is not running.</div>
+    {{else if not .Report.Enabled}}
+      <div class="muted">No logo pack is configured. Start stalkerhek with <code>-logo-dir</code> (and optionally <code>-logo-map</code>).</div>
+    {{else}}
+      <h2>{{.Report.Matched}} matched, {{len .Report.Unmatched}} without logo</h2>
+      {{if .Report.Unmatched}}
+      <table>
+        {{range .Report.Unmatched}}<tr><td><img loading="lazy" src="{{$.HLSScheme}}://{{$.Host}}:{{$.HlsPort}}{{$.AccessPrefix}}/logo/{{.}}" alt=""></td><td>{{.}}</td></tr>
+        {{end}}
+      </table>
+      {{else}}<div class="muted">Every channel has a logo in the logo pack.</div>{{end}}
+    {{end}}
+    </div>
+  </div>
+</body>
+</html>`
@@ -0,0 +1,94 @@
+package webui
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+// Group modes of the aggregated playlist
+const (
+	PlaylistGroupsProfile = "profile" // Groups are prefixed with profile name, e.g. "Home: News"
+	PlaylistGroupsGenre   = "genre"   // Groups of all profiles are merged by genre
+)
+
+var (
+	playlistMu     sync.RWMutex
+	playlistGroups = PlaylistGroupsProfile
+)
+
+// SetPlaylistGroups sets default group mode of the aggregated playlist served at /playlist.m3u.
+func SetPlaylistGroups(mode string) error {
+	if mode != PlaylistGroupsProfile && mode != PlaylistGroupsGenre {
+		return errors.New("unknown playlist group mode '" + mode + "', expected '" + PlaylistGroupsProfile + "' or '" + PlaylistGroupsGenre + "'")
+	}
+	playlistMu.Lock()
+	playlistGroups = mode
+	playlistMu.Unlock()
+	return nil
+}
+
+func getPlaylistGroups() string {
+	playlistMu.RLock()
+	defer playlistMu.RUnlock()
+	return playlistGroups
+}
+
+// RegisterPlaylistHandlers mounts /playlist.m3u, which merges playlists of all running profiles.
+// Links point to each profile's own HLS port. Group mode can be overridden with ?groups=profile|genre.
+func RegisterPlaylistHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/playlist.m3u", func(w http.ResponseWriter, r *http.Request) {
+		mode := getPlaylistGroups()
+		if v := r.URL.Query().Get("groups"); v != "" {
+			if v != PlaylistGroupsProfile && v != PlaylistGroupsGenre {
+				http.Error(w, "groups must be '"+PlaylistGroupsProfile+"' or '"+PlaylistGroupsGenre+"'", http.StatusBadRequest)
+				return
+			}
+			mode = v
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		var entries bytes.Buffer
+		var epgURLs []string
+		for _, p := range ListProfiles() {
+			if !IsRunning(p.ID) {
+				continue
+			}
+			prefix := ""
+			if mode == PlaylistGroupsProfile {
+				name := p.Name
+				if name == "" {
+					name = "Profile " + strconv.Itoa(p.ID)
+				}
+				prefix = name + ": "
+			}
+			if !hls.WritePlaylistEntries(&entries, p.ID, net.JoinHostPort(host, strconv.Itoa(p.HlsPort)), prefix) {
+				continue
+			}
+			if p.EPGURL != "" {
+				epgURLs = append(epgURLs, p.EPGURL)
+			}
+		}
+
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if len(epgURLs) > 0 {
+			tvg := strings.NewReplacer("\"", "'", "\n", "", "\r", "").Replace(strings.Join(epgURLs, ","))
+			fmt.Fprintf(w, "#EXTM3U url-tvg=\"%s\" x-tvg-url=\"%s\"\n", tvg, tvg)
+		} else {
+			fmt.Fprintln(w, "#EXTM3U")
+		}
+		w.Write(entries.Bytes())
+	})
+}
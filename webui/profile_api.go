@@ -0,0 +1,45 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// profileAPIHandler serves a single resource of a profile, e.g. /api/profiles/{id}/events
+type profileAPIHandler func(w http.ResponseWriter, r *http.Request, p Profile)
+
+var profileAPI = map[string]profileAPIHandler{}
+
+// registerProfileAPI registers handler for /api/profiles/{id}/{resource}
+func registerProfileAPI(resource string, h profileAPIHandler) {
+	profileAPI[resource] = h
+}
+
+// RegisterProfileAPIHandlers mounts /api/profiles/{id}/{resource} endpoints
+func RegisterProfileAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/profiles/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/profiles/"), "/", 2)
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		h, ok := profileAPI[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		p, ok := GetProfile(atoiSafe(parts[0]))
+		if !ok {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		h(w, r, p)
+	})
+}
+
+// writeJSON encodes v as JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
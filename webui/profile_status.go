@@ -1,11 +1,16 @@
 package webui
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
@@ -19,6 +24,12 @@ type ProfileStatus struct {
 	HLS      string `json:"hls"`
 	Proxy    string `json:"proxy"`
 	Running  bool   `json:"running"`
+
+	Blocked       bool   `json:"blocked"`        // Portal cut off the account
+	PortalMessage string `json:"portal_message"` // Last message sent by portal operator
+	Mirror        string `json:"mirror"`         // Portal mirror currently in use
+
+	Resolved []string `json:"resolved,omitempty"` // How portal hostnames resolve, filled in by verification
 }
 
 var (
@@ -55,7 +66,53 @@ func SetProfileError(id int, name, msg string) {
 
 func SetProfileSuccess(id int, name string, channels int, hls, proxy string, running bool) {
 	psMu.Lock()
-	pstate[id] = ProfileStatus{ID: id, Name: name, Phase: "success", Message: "Verified", Channels: channels, HLS: hls, Proxy: proxy, Running: running}
+	s := pstate[id]
+	pstate[id] = ProfileStatus{ID: id, Name: name, Phase: "success", Message: "Verified", Channels: channels, HLS: hls, Proxy: proxy, Running: running, Blocked: s.Blocked, PortalMessage: s.PortalMessage, Mirror: s.Mirror, Resolved: s.Resolved}
+	psMu.Unlock()
+}
+
+// SetProfileBlocked marks profile as cut off (or restored) by portal
+func SetProfileBlocked(id int, blocked bool) {
+	psMu.Lock()
+	s := pstate[id]
+	s.ID, s.Blocked = id, blocked
+	pstate[id] = s
+	psMu.Unlock()
+}
+
+// SetProfilePortalMessage stores the last message sent by portal operator
+func SetProfilePortalMessage(id int, msg string) {
+	psMu.Lock()
+	s := pstate[id]
+	s.ID, s.PortalMessage = id, msg
+	pstate[id] = s
+	psMu.Unlock()
+}
+
+// SetProfileMirror records which portal mirror a profile uses
+func SetProfileMirror(id int, mirror string) {
+	psMu.Lock()
+	s := pstate[id]
+	s.ID, s.Mirror = id, mirror
+	pstate[id] = s
+	psMu.Unlock()
+}
+
+// SetProfileResolved records name resolution of profile's portal hostnames
+func SetProfileResolved(id int, resolved []string) {
+	psMu.Lock()
+	s := pstate[id]
+	s.ID, s.Resolved = id, resolved
+	pstate[id] = s
+	psMu.Unlock()
+}
+
+// SetProfileChannels updates channel count of a profile
+func SetProfileChannels(id int, channels int) {
+	psMu.Lock()
+	s := pstate[id]
+	s.ID, s.Channels = id, channels
+	pstate[id] = s
 	psMu.Unlock()
 }
 
@@ -127,37 +184,71 @@ func RegisterProfileStatusHandlers(mux *http.ServeMux) {
 		host := r.Host
 		go func(p Profile, host string) {
 			// Minimal verification without starting services
-			base := *DefaultPortal()
-			cfg := &stalker.Config{Portal: &base}
+			cfg := &stalker.Config{Portal: DefaultPortal()}
 			cfg.Portal.Location = p.PortalURL
+			cfg.Portal.Mirrors = p.Mirrors()
 			cfg.Portal.MAC = p.MAC
+			cfg.Portal.OnMirrorChange = func(m string) { SetProfileMirror(p.ID, m) }
+			transport, err := profileTransport(p)
+			if err != nil {
+				SetProfileError(p.ID, p.Name, "TLS settings: "+err.Error())
+				return
+			}
+			cfg.Portal.Client = stalker.NewHTTPClient(transport)
+			SetProfileResolved(p.ID, resolvePortalHosts(p))
 			if err := cfg.Portal.Start(); err != nil {
 				SetProfileError(p.ID, p.Name, err.Error())
 				return
 			}
+			SetProfileMirror(p.ID, cfg.Portal.URL())
 			chs, err := cfg.Portal.RetrieveChannels()
 			if err != nil {
 				SetProfileError(p.ID, p.Name, err.Error())
 				return
 			}
-			SetProfileSuccess(p.ID, p.Name, len(chs), linkForHost(host, p.HlsPort), linkForHost(host, p.ProxyPort), false)
+			setRawChannels(p.ID, chs)
+			SetProfileSuccess(p.ID, p.Name, len(chs), linkForHost(p.HLSScheme(), host, p.HlsPort, p.AccessPrefix()), linkForHost(p.ProxyScheme(), host, p.ProxyPort, p.AccessPrefix()), false)
 		}(p, host)
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 	})
 }
 
+// resolvePortalHosts describes how hostnames of profile's portal mirrors resolve, e.g.
+// "example.com -> 10.0.0.1 (override)"
+func resolvePortalHosts(p Profile) []string {
+	dns := p.dnsOptions()
+	out := make([]string, 0, len(p.Mirrors()))
+	seen := map[string]bool{}
+	for _, m := range p.Mirrors() {
+		u, err := url.Parse(m)
+		if err != nil || u.Hostname() == "" || seen[u.Hostname()] {
+			continue
+		}
+		seen[u.Hostname()] = true
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ips, source, err := dns.Resolve(ctx, u.Hostname())
+		cancel()
+		if err != nil {
+			out = append(out, u.Hostname()+" -> error: "+err.Error())
+			continue
+		}
+		out = append(out, u.Hostname()+" -> "+strings.Join(ips, ", ")+" ("+source+")")
+	}
+	return out
+}
+
 // helper: safe atoi
 func atoiSafe(s string) int { n := 0; for _, c := range s { if c < '0' || c > '9' { break }; n = n*10 + int(c-'0') }; return n }
 
-func itoa(n int) string { if n == 0 { return "0" }; s := ""; for n > 0 { s = string('0'+(n%10)) + s; n/=10 }; return s }
+func itoa(n int) string { return strconv.Itoa(n) }
 
-// linkForHost composes an http://host:port/ link given a raw host header
-func linkForHost(raw string, port int) string {
+// linkForHost composes a scheme://host:port/ link (with access token prefix) given a raw host header
+func linkForHost(scheme, raw string, port int, prefix string) string {
 	host := raw
 	if i := strings.Index(host, ":"); i > -1 {
 		host = host[:i]
 	}
-	return "http://" + host + ":" + itoa(port) + "/"
+	return scheme + "://" + host + ":" + itoa(port) + prefix + "/"
 }
 
 // DefaultPortal returns a baseline Portal config used for verification
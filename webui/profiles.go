@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/CrazeeGhost/stalkerhek/hls"
 	"github.com/CrazeeGhost/stalkerhek/proxy"
@@ -23,9 +24,80 @@ type Profile struct {
 	ID        int    `json:"id"`
 	Name      string `json:"name"`
 	PortalURL string `json:"portal_url"`
-	MAC       string `json:"mac"`
-	HlsPort   int    `json:"hls_port"`
-	ProxyPort int    `json:"proxy_port"`
+	// PortalURLs is an ordered list of portal mirrors for the same account. If empty, PortalURL is used.
+	PortalURLs []string `json:"portal_urls,omitempty"`
+	MAC        string   `json:"mac"`
+	HlsPort    int      `json:"hls_port"`
+	ProxyPort  int      `json:"proxy_port"`
+
+	// Failover maps channel group to the ordered list of profile IDs to stream from
+	// when this profile fails. Key "*" applies to all other groups.
+	Failover map[string][]int `json:"failover,omitempty"`
+
+	// TLS settings for every outbound connection of the profile (portal, streams, logos)
+	TLS *stalker.TLSOptions `json:"tls,omitempty"`
+
+	// DNS overrides and custom resolver for every outbound connection of the profile
+	DNS *stalker.DNSOptions `json:"dns,omitempty"`
+
+	// HTTPS of profile's HLS and proxy listeners: cert/key files or auto-generated certificate
+	HLSTLS   *stalker.ListenerTLS `json:"hls_tls,omitempty"`
+	ProxyTLS *stalker.ListenerTLS `json:"proxy_tls,omitempty"`
+
+	// Client allowlist and access token of profile's HLS and proxy listeners
+	Access *stalker.AccessRules `json:"access,omitempty"`
+
+	// Prefetch the next HLS segment while the current one is being served
+	Prefetch bool `json:"prefetch,omitempty"`
+
+	// Advertise all channels as HLS; raw MPEG-TS channels are segmented locally
+	HLSOutput bool `json:"hls_output,omitempty"`
+
+	// New links requested when upstream rejects or drops a stream; 0 uses the default, -1 disables
+	RetryBudget int `json:"retry_budget,omitempty"`
+
+	// Seconds stream fetching waits for connection, response headers and more data mid-stream;
+	// 0 uses the defaults, -1 disables a timeout
+	ConnectTimeout   int `json:"connect_timeout,omitempty"`
+	FirstByteTimeout int `json:"first_byte_timeout,omitempty"`
+	IdleTimeout      int `json:"idle_timeout,omitempty"`
+
+	// Variants of upstream HLS master playlists: max picture height, max bits per second,
+	// pin ("highest"/"lowest") and serving pinned variant's media playlist instead of the master
+	MaxResolution  int    `json:"max_resolution,omitempty"`
+	MaxBandwidth   int64  `json:"max_bandwidth,omitempty"`
+	VariantPin     string `json:"variant_pin,omitempty"`
+	CollapseMaster bool   `json:"collapse_master,omitempty"`
+
+	// XMLTV guide advertised in playlist header (url-tvg / x-tvg-url)
+	EPGURL string `json:"epg_url,omitempty"`
+
+	// User agent players are asked to use (#EXTVLCOPT:http-user-agent) when opening channels
+	PlayerUserAgent string `json:"player_user_agent,omitempty"`
+
+	// Rules customizing channel list (filters, renames, groups, order) of playlists, proxy and EPG
+	Rules *stalker.PlaylistRules `json:"rules,omitempty"`
+
+	// Minutes between health probes of each channel; 0 disables probing
+	ProbeInterval int `json:"probe_interval,omitempty"`
+
+	// Drop channels that failed their last probe from playlists instead of grouping them under "Offline"
+	HideOffline bool `json:"hide_offline,omitempty"`
+
+	// Max concurrent upstream streams allowed by the portal for this MAC; 0 means no limit
+	MaxStreams int `json:"max_streams,omitempty"`
+
+	// What to do when a new stream would exceed MaxStreams: "reject", "preempt-oldest" or "preempt-priority"
+	StreamPolicy string `json:"stream_policy,omitempty"`
+
+	// Client IP address or CIDR network -> priority for "preempt-priority"; "dvr" applies to recordings
+	ClientPriorities map[string]int `json:"client_priorities,omitempty"`
+
+	// Daily quota of profile's upstream traffic in MiB; new streams are refused once it's used up
+	DailyQuotaMB int64 `json:"daily_quota_mb,omitempty"`
+
+	// Client IP address or CIDR network -> MiB it may receive per day from all profiles
+	ClientQuotasMB map[string]int64 `json:"client_quotas_mb,omitempty"`
 }
 
 var (
@@ -52,17 +124,31 @@ func StartProfileServices(p Profile) {
 			DeviceIdAuth: true,
 			WatchDogTime: 5,
 			Location:     p.PortalURL,
+			Mirrors:      p.Mirrors(),
 			MAC:          p.MAC,
 		},
-		HLS: struct {
-			Enabled bool   `yaml:"enabled"`
-			Bind    string `yaml:"bind"`
-		}{Enabled: true, Bind: fmt.Sprintf("0.0.0.0:%d", p.HlsPort)},
-		Proxy: struct {
-			Enabled bool   `yaml:"enabled"`
-			Bind    string `yaml:"bind"`
-			Rewrite bool   `yaml:"rewrite"`
-		}{Enabled: true, Bind: fmt.Sprintf("0.0.0.0:%d", p.ProxyPort), Rewrite: true},
+	}
+	cfg.HLS.Enabled, cfg.HLS.Bind, cfg.HLS.TLS = true, fmt.Sprintf("0.0.0.0:%d", p.HlsPort), p.hlsTLS()
+	cfg.Proxy.Enabled, cfg.Proxy.Bind, cfg.Proxy.Rewrite, cfg.Proxy.TLS = true, fmt.Sprintf("0.0.0.0:%d", p.ProxyPort), true, p.proxyTLS()
+	cfg.HLS.Access, cfg.Proxy.Access = p.access(), p.access()
+	if _, err := stalker.NewAccessGuard("", p.access()); err != nil {
+		SetProfileError(p.ID, p.Name, "Access rules: "+err.Error())
+		log.Printf("[PROFILE %s] Invalid access rules: %v", p.Name, err)
+		return
+	}
+	transport, err := profileTransport(p)
+	if err != nil {
+		SetProfileError(p.ID, p.Name, "TLS settings: "+err.Error())
+		log.Printf("[PROFILE %s] Invalid TLS settings: %v", p.Name, err)
+		return
+	}
+	cfg.Portal.Client = stalker.NewHTTPClient(transport)
+	// Act on events portal sends via watchdog updates
+	portal := cfg.Portal
+	portal.OnEvent = func(ev stalker.WatchdogEvent) { handleWatchdogEvent(p, portal, ev) }
+	portal.OnMirrorChange = func(m string) {
+		log.Printf("[PROFILE %s] Active portal mirror: %s", p.Name, m)
+		SetProfileMirror(p.ID, m)
 	}
 	// Authenticate
 	if err := cfg.Portal.Start(); err != nil {
@@ -70,6 +156,7 @@ func StartProfileServices(p Profile) {
 		log.Printf("[PROFILE %s] Authentication failed: %v", p.Name, err)
 		return
 	}
+	SetProfileMirror(p.ID, portal.URL())
 	SetProfileValidating(p.ID, p.Name, "Retrieving channels...")
 	// Retrieve channels
 	chs, err := cfg.Portal.RetrieveChannels()
@@ -83,8 +170,16 @@ func StartProfileServices(p Profile) {
 		log.Printf("[PROFILE %s] No channels retrieved", p.Name)
 		return
 	}
-	SetProfileSuccess(p.ID, p.Name, len(chs), "", "", true)
 	log.Printf("[PROFILE %s] Retrieved %d channels", p.Name, len(chs))
+	setRawChannels(p.ID, chs)
+	rules, err := p.ruleSet()
+	if err != nil {
+		SetProfileError(p.ID, p.Name, "Playlist rules: "+err.Error())
+		log.Printf("[PROFILE %s] Invalid playlist rules: %v", p.Name, err)
+		return
+	}
+	chs = rules.Apply(chs)
+	SetProfileSuccess(p.ID, p.Name, len(chs), "", "", true)
 
 	// Create per-profile context
 	pCtx, pCancel := context.WithCancel(context.Background())
@@ -93,18 +188,125 @@ func StartProfileServices(p Profile) {
 	// Start HLS
 	go func(channels map[string]*stalker.Channel) {
 		log.Printf("[PROFILE %s] Starting HLS service on %s", p.Name, cfg.HLS.Bind)
-		hls.StartWithContext(pCtx, channels, cfg.HLS.Bind)
+		hls.StartWithOptions(pCtx, channels, hls.Options{
+			ProfileID:   p.ID,
+			ProfileName: p.Name,
+			Bind:        cfg.HLS.Bind,
+			TLS:         cfg.HLS.TLS,
+			Access:      cfg.HLS.Access,
+			Transport:   transport,
+			Failover:    p.Failover,
+			Prefetch:    p.Prefetch,
+			HLSOutput:   p.HLSOutput,
+			RetryBudget: p.RetryBudget,
+
+			ConnectTimeout:   time.Duration(p.ConnectTimeout) * time.Second,
+			FirstByteTimeout: time.Duration(p.FirstByteTimeout) * time.Second,
+			IdleTimeout:      time.Duration(p.IdleTimeout) * time.Second,
+			EPGURL:           p.EPGURL,
+			Variants: hls.VariantPolicy{
+				MaxHeight:    p.MaxResolution,
+				MaxBandwidth: p.MaxBandwidth,
+				Pin:          p.VariantPin,
+				Collapse:     p.CollapseMaster,
+			},
+
+			PlayerUserAgent: p.PlayerUserAgent,
+			ProbeInterval:   time.Duration(p.ProbeInterval) * time.Minute,
+			HideOffline:     p.HideOffline,
+
+			MaxStreams:       p.MaxStreams,
+			StreamPolicy:     p.StreamPolicy,
+			ClientPriorities: p.ClientPriorities,
+			DailyQuota:       p.DailyQuotaMB << 20,
+			ClientQuotas:     mibToBytes(p.ClientQuotasMB),
+		})
 		log.Printf("[PROFILE %s] HLS service stopped on %s", p.Name, cfg.HLS.Bind)
 	}(chs)
 
 	// Start Proxy
 	go func(channels map[string]*stalker.Channel) {
 		log.Printf("[PROFILE %s] Starting proxy service on %s", p.Name, cfg.Proxy.Bind)
-		proxy.StartWithContext(pCtx, cfg, channels)
+		proxy.StartProfile(pCtx, p.ID, cfg, channels, rules)
 		log.Printf("[PROFILE %s] Proxy service stopped on %s", p.Name, cfg.Proxy.Bind)
 	}(chs)
 }
 
+// mibToBytes converts quotas given in MiB to bytes
+func mibToBytes(m map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(m))
+	for k, v := range m {
+		out[k] = v << 20
+	}
+	return out
+}
+
+// profileTransport builds HTTP transport for all outbound connections of a profile.
+func profileTransport(p Profile) (*http.Transport, error) {
+	var tlsOpts stalker.TLSOptions
+	if p.TLS != nil {
+		tlsOpts = *p.TLS
+	}
+	return stalker.NewTransport(tlsOpts, p.dnsOptions())
+}
+
+// ruleSet returns compiled playlist rules of a profile, or nil if none are set.
+func (p Profile) ruleSet() (*stalker.RuleSet, error) {
+	if p.Rules == nil {
+		return nil, nil
+	}
+	return p.Rules.Compile()
+}
+
+// dnsOptions returns profile's DNS settings, or zero value if none are set.
+func (p Profile) dnsOptions() stalker.DNSOptions {
+	if p.DNS != nil {
+		return *p.DNS
+	}
+	return stalker.DNSOptions{}
+}
+
+// hlsTLS returns TLS settings of profile's HLS listener, or zero value for plain HTTP.
+func (p Profile) hlsTLS() stalker.ListenerTLS {
+	if p.HLSTLS != nil {
+		return *p.HLSTLS
+	}
+	return stalker.ListenerTLS{}
+}
+
+// proxyTLS returns TLS settings of profile's proxy listener, or zero value for plain HTTP.
+func (p Profile) proxyTLS() stalker.ListenerTLS {
+	if p.ProxyTLS != nil {
+		return *p.ProxyTLS
+	}
+	return stalker.ListenerTLS{}
+}
+
+// access returns profile's access rules, or zero value if everyone is allowed.
+func (p Profile) access() stalker.AccessRules {
+	if p.Access != nil {
+		return *p.Access
+	}
+	return stalker.AccessRules{}
+}
+
+// AccessPrefix returns path prefix carrying profile's access token, for links to its services.
+func (p Profile) AccessPrefix() string { return p.access().LinkPrefix() }
+
+// HLSScheme returns URL scheme of profile's HLS service.
+func (p Profile) HLSScheme() string { return p.hlsTLS().Scheme() }
+
+// ProxyScheme returns URL scheme of profile's proxy service.
+func (p Profile) ProxyScheme() string { return p.proxyTLS().Scheme() }
+
+// Mirrors returns ordered list of profile's portal URLs.
+func (p Profile) Mirrors() []string {
+	if len(p.PortalURLs) > 0 {
+		return p.PortalURLs
+	}
+	return []string{p.PortalURL}
+}
+
 func normalizePortalURL(in string) string {
 	s := strings.TrimSpace(in)
 	if s == "" {
@@ -186,6 +388,16 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
 		if portal == "" {
 			portal = defaultPortalURL
 		}
+		// Optional mirrors of the same portal, one per line, tried in order after the main URL
+		portalURLs := []string{portal}
+		for _, m := range strings.Split(r.FormValue("mirrors"), "\n") {
+			if m = normalizePortalURL(m); m != "" && m != portal {
+				portalURLs = append(portalURLs, m)
+			}
+		}
+		if len(portalURLs) == 1 {
+			portalURLs = nil
+		}
 		mac := strings.ToUpper(strings.TrimSpace(r.FormValue("mac")))
 		hlsStr := strings.TrimSpace(r.FormValue("hls_port"))
 		proxyStr := strings.TrimSpace(r.FormValue("proxy_port"))
@@ -200,11 +412,12 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
 			return
 		}
 		p := AddProfile(Profile{
-			Name:      name,
-			PortalURL: portal,
-			MAC:       mac,
-			HlsPort:   hlsPort,
-			ProxyPort: proxyPort,
+			Name:       name,
+			PortalURL:  portal,
+			PortalURLs: portalURLs,
+			MAC:        mac,
+			HlsPort:    hlsPort,
+			ProxyPort:  proxyPort,
 		})
 		_ = SaveProfiles()
 		// Immediately start services for this profile in a goroutine
@@ -270,8 +483,8 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
     .hint{font-size:13px;color:var(--muted);margin-top:8px;line-height:1.4}
     .row{display:grid;grid-template-columns:1fr;gap:12px}
     @media(min-width:520px){.row.two{grid-template-columns:1fr 1fr}}
-    input{width:100%;padding:14px 14px;border-radius:12px;border:1px solid var(--border);background:#0f1612;color:var(--text);outline:none;font-size:16px;transition:border-color .2s,box-shadow .2s}
-    input:focus{border-color:var(--brand);box-shadow:0 0 0 3px rgba(45,122,78,.2)}
+    input,textarea{width:100%;padding:14px 14px;border-radius:12px;border:1px solid var(--border);background:#0f1612;color:var(--text);outline:none;font-size:16px;transition:border-color .2s,box-shadow .2s;font-family:inherit}
+    input:focus,textarea:focus{border-color:var(--brand);box-shadow:0 0 0 3px rgba(45,122,78,.2)}
     .err{display:none;margin-top:6px;color:var(--bad);font-size:12px}
     .btnbar{display:flex;gap:12px;flex-wrap:wrap;margin-top:16px}
     button{cursor:pointer;border:none;border-radius:12px;padding:14px 16px;font-size:15px;font-weight:650;transition:background .2s,filter .2s}
@@ -297,6 +510,10 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
     .footnote{margin-top:12px;color:var(--muted);font-size:12px;line-height:1.4}
     .toast{position:fixed;right:16px;bottom:16px;max-width:520px;background:rgba(13,20,16,.92);border:1px solid var(--border);border-radius:14px;padding:12px 12px;display:none;box-shadow:0 16px 40px rgba(0,0,0,.45)}
     .toast strong{display:block;margin-bottom:4px}
+    table.sessions{width:100%;border-collapse:collapse;font-size:13px}
+    table.sessions th,table.sessions td{text-align:left;padding:6px 8px;border-bottom:1px solid var(--border)}
+    table.sessions th{color:var(--muted);font-weight:600}
+    table.sessions button{padding:6px 10px;font-size:12px}
   </style>
 </head>
 <body>
@@ -327,6 +544,9 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
           <input id="portal" name="portal" required placeholder="http://example.com/portal.php" title="Paste your portal URL; the UI will autocorrect it to /portal.php" />
           <div id="portalErr" class="err">Please enter a valid URL. We'll autocorrect to <b>/portal.php</b>.</div>
 
+          <label for="mirrors">Portal mirrors (optional)</label>
+          <textarea id="mirrors" name="mirrors" rows="2" placeholder="http://mirror1.example.com/portal.php" title="Other hostnames of the same portal, one per line. They are used in this order when the main URL keeps failing"></textarea>
+
           <label for="mac">MAC address (required)</label>
           <input id="mac" name="mac" required placeholder="00:1A:79:12:34:56" title="Must be uppercase with colons" />
           <div id="macErr" class="err">MAC must look like <b>00:1A:79:12:34:56</b>.</div>
@@ -360,15 +580,19 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
             <div class="phead">
               <div>
                 <div class="pname">{{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}}</div>
-                <div class="sub" style="margin-top:4px">Portal: <span style="color:#c5d1c5">{{.PortalURL}}</span></div>
+                <div class="sub" style="margin-top:4px">Portal: <span style="color:#c5d1c5">{{.PortalURL}}</span>{{if gt (len .PortalURLs) 1}}{{with slice .PortalURLs 1}} <span title="Mirrors: {{range .}}{{.}} {{end}}">(+{{len .}} mirrors)</span>{{end}}{{end}}</div>
                 <div class="sub">MAC: <span style="color:#c5d1c5">{{.MAC}}</span></div>
               </div>
               <div class="badg" id="badge-{{.ID}}" title="Current status of this profile">Idle</div>
             </div>
 
             <div class="links">
-              <a id="hls-{{.ID}}" href="http://{{$.Host}}:{{.HlsPort}}/" target="_blank" title="Open HLS endpoint">HLS: :{{.HlsPort}}</a>
-              <a id="pxy-{{.ID}}" href="http://{{$.Host}}:{{.ProxyPort}}/" target="_blank" title="Open Proxy endpoint">Proxy: :{{.ProxyPort}}</a>
+              <a id="hls-{{.ID}}" href="{{.HLSScheme}}://{{$.Host}}:{{.HlsPort}}{{.AccessPrefix}}/" target="_blank" title="Open HLS endpoint">HLS: :{{.HlsPort}}</a>
+              <a id="pxy-{{.ID}}" href="{{.ProxyScheme}}://{{$.Host}}:{{.ProxyPort}}{{.AccessPrefix}}/" target="_blank" title="Open Proxy endpoint">Proxy: :{{.ProxyPort}}</a>
+              <a href="/api/profiles/{{.ID}}/events" target="_blank" title="Events sent by portal (messages, channel updates, cut-offs)">Events</a>
+              <a href="/rules?id={{.ID}}" title="Filter, rename, regroup and reorder channels of this profile">Rules</a>
+              <a href="/logos?id={{.ID}}" title="Channels without logo in the local logo pack">Logos</a>
+              <a href="/recordings?id={{.ID}}" title="Schedule and manage recordings of this profile's channels">Recordings</a>
             </div>
 
             <div class="actions">
@@ -395,6 +619,17 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
         {{end}}
       </div>
     </div>
+
+    <div style="height:14px"></div>
+
+    <div class="card">
+      <h2>Now watching</h2>
+      <table class="sessions">
+        <thead><tr><th>Profile</th><th>Channel</th><th>Client</th><th>Watching</th><th>Sent</th><th>Bitrate</th><th></th></tr></thead>
+        <tbody id="sessions"><tr><td colspan="7" class="hint">Nobody is watching.</td></tr></tbody>
+      </table>
+      <div class="footnote">Proxy sessions are STBs streaming directly from the portal; their traffic is not counted. Kicked clients can't reopen the same channel for a minute.</div>
+    </div>
   </div>
 
   <div id="toast" class="toast"><strong id="toastTitle"></strong><div id="toastMsg"></div></div>
@@ -467,11 +702,16 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
           if(s.phase==='success') badge.classList.add('ok');
           if(s.phase==='error') badge.classList.add('err');
           if(s.running) badge.classList.add('run');
-          const label = s.running ? 'Running' : (s.phase==='success' ? 'Verified' : (s.phase==='error' ? 'Error' : (s.phase==='validating' ? 'Checking…' : 'Idle')));
+          if(s.blocked) badge.classList.add('err');
+          const label = s.blocked ? 'Blocked' : (s.running ? 'Running' : (s.phase==='success' ? 'Verified' : (s.phase==='error' ? 'Error' : (s.phase==='validating' ? 'Checking…' : 'Idle'))));
           badge.textContent = label;
           let lines=[];
           if(s.message) lines.push(s.message);
           if(s.channels) lines.push('Channels: '+s.channels);
+          if(s.mirror) lines.push('Active portal: '+s.mirror);
+          if(s.resolved) for(const x of s.resolved) lines.push('DNS: '+x);
+          if(s.blocked) lines.push('Account cut off by portal');
+          if(s.portal_message) lines.push('Portal message: '+s.portal_message);
           if(lines.length===0) lines.push('');
           meta.innerHTML = '<div>'+lines.map(x=>String(x).replace(/</g,'&lt;')).join('</div><div>')+'</div>';
           if(s.hls){ const h=document.getElementById('hls-'+s.id); if(h){ h.href=s.hls; h.textContent='HLS: '+s.hls; } }
@@ -481,6 +721,36 @@ func RegisterProfileHandlers(mux *http.ServeMux, onStart func()) {
     }
     setInterval(poll, 1200);
     poll();
+
+    const esc = x => String(x).replace(/[&<>"']/g, c => ({'&':'&amp;','<':'&lt;','>':'&gt;','"':'&quot;',"'":'&#39;'}[c]));
+    function fmtBytes(n){ return n >= 1<<30 ? (n/(1<<30)).toFixed(2)+' GiB' : (n/(1<<20)).toFixed(1)+' MiB'; }
+    function fmtAge(t){
+      const s = Math.max(0, Math.floor((Date.now() - new Date(t)) / 1000));
+      return s < 60 ? s+'s' : (s < 3600 ? Math.floor(s/60)+'m' : Math.floor(s/3600)+'h '+Math.floor(s%3600/60)+'m');
+    }
+    async function pollSessions(){
+      try{
+        const r = await fetch('/api/sessions', {cache:'no-store'});
+        const a = await r.json();
+        const body = document.getElementById('sessions');
+        body.innerHTML = a.length ? a.map(s =>
+          '<tr><td>'+esc(s.profile || ('Profile '+s.profile_id))+'</td><td>'+esc(s.channel)+'</td>'+
+          '<td title="'+esc(s.user_agent||'')+'">'+esc(s.client_ip)+' <span class="hint">'+s.source+'</span></td>'+
+          '<td>'+fmtAge(s.started)+'</td>'+
+          '<td>'+(s.source==='proxy' ? '&ndash;' : fmtBytes(s.bytes_sent))+'</td>'+
+          '<td>'+(s.source==='proxy' ? '&ndash;' : s.bitrate_kbps+' kbps')+'</td>'+
+          '<td>'+(s.kickable ? '<button class="danger" onclick="kick(\''+esc(s.id)+'\')">Kick</button>' : '')+'</td></tr>').join('')
+          : '<tr><td colspan="7" class="hint">Nobody is watching.</td></tr>';
+      }catch(e){}
+    }
+    async function kick(id){
+      if(!confirm('Disconnect this viewer?')) return;
+      const r = await fetch('/api/sessions/kick?id='+encodeURIComponent(id), {method:'POST'});
+      if(!r.ok) showToast('Kick failed', await r.text());
+      pollSessions();
+    }
+    setInterval(pollSessions, 2500);
+    pollSessions();
   </script>
 </body>
 </html>`
@@ -500,6 +770,16 @@ func GetProfile(id int) (Profile, bool) {
     return Profile{}, false
 }
 
+// UpdateProfile modifies a profile by ID; returns false if it does not exist
+func UpdateProfile(id int, fn func(p *Profile)) bool {
+    profMu.Lock()
+    defer profMu.Unlock()
+    for i := range profiles {
+        if profiles[i].ID == id { fn(&profiles[i]); return true }
+    }
+    return false
+}
+
 // DeleteProfile removes a profile by ID
 func DeleteProfile(id int) {
     profMu.Lock()
@@ -0,0 +1,270 @@
+package webui
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/dvr"
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+// recordingRequest is the body of a new recording. Either start and end, or epg_id of channel's
+// upcoming programme must be given.
+type recordingRequest struct {
+	Channel string    `json:"channel"`
+	Title   string    `json:"title"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	EPGID   string    `json:"epg_id"`
+}
+
+// profileRecording returns recording of given profile by ?rid= query parameter
+func profileRecording(w http.ResponseWriter, r *http.Request, p Profile) (dvr.Recording, bool) {
+	rec, ok := dvr.Get(atoiSafe(r.URL.Query().Get("rid")))
+	if !ok || rec.ProfileID != p.ID {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return rec, false
+	}
+	return rec, true
+}
+
+func init() {
+	// GET lists recordings, POST schedules a new one, DELETE ?rid=N removes one with its file
+	registerProfileAPI("recordings", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		switch r.Method {
+		case http.MethodPost:
+			var req recordingRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.EPGID != "" {
+				ch, ok := hls.LookupChannel(p.ID, req.Channel)
+				if !ok {
+					http.Error(w, "channel not found or profile is not running", http.StatusConflict)
+					return
+				}
+				programmes, err := ch.EPG()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+				found := false
+				for _, pr := range programmes {
+					if pr.ID == req.EPGID {
+						req.Title, req.Start, req.End, found = pr.Title, pr.Start, pr.End, true
+						break
+					}
+				}
+				if !found {
+					http.Error(w, "programme not found in channel's EPG", http.StatusNotFound)
+					return
+				}
+			}
+			rec, err := dvr.Schedule(dvr.Recording{ProfileID: p.ID, Channel: req.Channel, Title: req.Title, Start: req.Start, End: req.End})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, rec)
+		case http.MethodDelete:
+			rec, ok := profileRecording(w, r, p)
+			if !ok {
+				return
+			}
+			if err := dvr.Delete(rec.ID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, map[string]bool{"deleted": true})
+		default:
+			writeJSON(w, dvr.List(p.ID))
+		}
+	})
+
+	// POST ?rid=N stops a scheduled or running recording, keeping what was recorded
+	registerProfileAPI("recordings/stop", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rec, ok := profileRecording(w, r, p)
+		if !ok {
+			return
+		}
+		if err := dvr.Stop(rec.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		rec, _ = dvr.Get(rec.ID)
+		writeJSON(w, rec)
+	})
+
+	// GET ?channel=<title> returns channel's current and upcoming programmes
+	registerProfileAPI("epg", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		ch, ok := hls.LookupChannel(p.ID, r.URL.Query().Get("channel"))
+		if !ok {
+			http.Error(w, "channel not found or profile is not running", http.StatusNotFound)
+			return
+		}
+		programmes, err := ch.EPG()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, programmes)
+	})
+}
+
+// RegisterRecordingHandlers mounts recordings page
+func RegisterRecordingHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/recordings", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := GetProfile(atoiSafe(r.URL.Query().Get("id")))
+		if !ok {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		channels, _ := hls.ChannelTitles(p.ID)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		t := template.Must(template.New("recordings").Parse(recordingsTpl))
+		_ = t.Execute(w, struct {
+			Profile
+			Host     string
+			Channels []string
+		}{p, host, channels})
+	})
+}
+
+const recordingsTpl = `<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Recordings - {{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}}</title>
+  <style>
+    :root{--bg:#0a0f0a;--panel:#0d1410;--border:#1f2e23;--text:#e0e6e0;--muted:#9aaa9a;--brand:#2d7a4e;--brand-hover:#3a8f5e;--bad:#e85d4d}
+    *{box-sizing:border-box}
+    body{margin:0;font-family:system-ui,-apple-system,Segoe UI,Roboto,Ubuntu,Helvetica,Arial,sans-serif;background:linear-gradient(180deg, #0d1410 0%, #0a0f0a 100%);color:var(--text);min-height:100vh}
+    a{color:var(--brand);text-decoration:none} a:hover{color:var(--brand-hover);text-decoration:underline}
+    .wrap{max-width:1200px;margin:0 auto;padding:16px 12px 60px}
+    h1{margin:0 0 6px 0;font-size:26px}
+    .sub{color:var(--muted);font-size:14px;line-height:1.4;margin-bottom:16px}
+    .grid{display:grid;grid-template-columns:1fr;gap:16px}
+    @media(min-width:900px){.grid{grid-template-columns:1fr 2fr}}
+    .card{background:linear-gradient(180deg, rgba(17,24,21,.96), rgba(13,20,16,.94));border:1px solid var(--border);border-radius:16px;padding:20px;box-shadow:0 12px 32px rgba(0,0,0,.4)}
+    .card h2{margin:0 0 12px 0;font-size:18px}
+    label{display:block;font-size:13px;color:#c5d1c5;margin:12px 0 6px}
+    input{width:100%;padding:10px 12px;border-radius:12px;border:1px solid var(--border);background:#0f1612;color:var(--text);outline:none;font-size:14px}
+    input:focus{border-color:var(--brand);box-shadow:0 0 0 3px rgba(45,122,78,.2)}
+    button{cursor:pointer;border:none;border-radius:12px;padding:10px 14px;font-size:14px;font-weight:650;background:var(--brand);color:white;margin-top:12px}
+    button:hover{background:var(--brand-hover)}
+    button.ghost{background:transparent;border:1px solid var(--border);color:var(--text);margin:0;padding:6px 10px;font-size:12px}
+    .err{color:var(--bad);font-size:13px;margin-top:8px;white-space:pre-wrap}
+    table{width:100%;border-collapse:collapse;font-size:13px}
+    th,td{text-align:left;padding:6px 8px;border-bottom:1px solid var(--border)}
+    th{color:var(--muted);font-weight:600}
+    .muted{color:var(--muted)}
+  </style>
+</head>
+<body>
+  <div class="wrap">
+    <h1>Recordings</h1>
+    <div class="sub">{{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}} &middot; Completed recordings are listed in the "Recordings" group of the playlist. <a href="/dashboard">Back to dashboard</a></div>
+
+    <div class="grid">
+      <div class="card">
+        <h2>New recording</h2>
+        {{if not .Channels}}<div class="muted">Profile is not running, so its channels are not known.</div>{{end}}
+        <label for="channel">Channel</label>
+        <input id="channel" list="channels" autocomplete="off">
+        <datalist id="channels">{{range .Channels}}<option value="{{.}}">{{end}}</datalist>
+        <label for="title">Title (optional)</label>
+        <input id="title">
+        <label for="start">Start (empty = now)</label>
+        <input id="start" type="datetime-local">
+        <label for="end">End</label>
+        <input id="end" type="datetime-local">
+        <button onclick="schedule()">Schedule</button>
+        <button class="ghost" style="margin-left:8px" onclick="loadEPG()">Show EPG</button>
+        <div class="err" id="err"></div>
+        <table id="epg" style="margin-top:12px"></table>
+      </div>
+
+      <div class="card">
+        <h2>Scheduled and recorded</h2>
+        <table>
+          <thead><tr><th>Title</th><th>Channel</th><th>Time</th><th>Status</th><th>Size</th><th></th></tr></thead>
+          <tbody id="list"></tbody>
+        </table>
+      </div>
+    </div>
+  </div>
+
+<script>
+const api = '/api/profiles/{{.ID}}/';
+const hls = '{{.HLSScheme}}://{{.Host}}:{{.HlsPort}}{{.AccessPrefix}}/recordings/';
+const $ = id => document.getElementById(id);
+const esc = s => String(s).replace(/[&<>"']/g, c => ({'&':'&amp;','<':'&lt;','>':'&gt;','"':'&quot;',"'":'&#39;'}[c]));
+const fmt = t => new Date(t).toLocaleString([], {dateStyle:'short', timeStyle:'short'});
+const size = n => n > 1<<30 ? (n/(1<<30)).toFixed(2)+' GiB' : (n/(1<<20)).toFixed(1)+' MiB';
+
+async function call(method, path, body) {
+  const resp = await fetch(api + path, {method, headers: {'Content-Type':'application/json'}, body: body ? JSON.stringify(body) : undefined});
+  if (!resp.ok) throw new Error(await resp.text());
+  return resp.json();
+}
+
+async function refresh() {
+  const list = await call('GET', 'recordings');
+  $('list').innerHTML = list.length ? list.map(r =>
+    '<tr><td>' + (r.status === 'completed' ? '<a href="' + hls + r.id + '.ts">' + esc(r.title) + '</a>' : esc(r.title)) + '</td>' +
+    '<td>' + esc(r.channel) + '</td><td>' + fmt(r.start) + ' &ndash; ' + fmt(r.end) + '</td>' +
+    '<td title="' + esc(r.error || '') + '">' + r.status + (r.retries ? ' (' + r.retries + ' retries)' : '') + '</td>' +
+    '<td>' + size(r.size) + '</td><td>' +
+    (r.status === 'scheduled' || r.status === 'recording' ? '<button class="ghost" onclick="stop(' + r.id + ')">Stop</button> ' : '') +
+    '<button class="ghost" onclick="del(' + r.id + ')">Delete</button></td></tr>').join('')
+    : '<tr><td colspan="6" class="muted">No recordings yet.</td></tr>';
+}
+
+async function schedule(epgID) {
+  $('err').textContent = '';
+  const body = {channel: $('channel').value, title: $('title').value};
+  if (epgID) {
+    body.epg_id = epgID;
+  } else {
+    if ($('start').value) body.start = new Date($('start').value).toISOString();
+    if (!$('end').value) { $('err').textContent = 'End is required.'; return; }
+    body.end = new Date($('end').value).toISOString();
+  }
+  try { await call('POST', 'recordings', body); refresh(); } catch (e) { $('err').textContent = e.message; }
+}
+
+async function loadEPG() {
+  $('err').textContent = '';
+  try {
+    const list = await call('GET', 'epg?channel=' + encodeURIComponent($('channel').value));
+    $('epg').innerHTML = list.length ? list.map(p =>
+      '<tr><td>' + fmt(p.start) + '</td><td>' + esc(p.title) + '</td><td><button class="ghost" onclick="schedule(\'' + esc(p.id) + '\')">Record</button></td></tr>').join('')
+      : '<tr><td class="muted">No EPG for this channel.</td></tr>';
+  } catch (e) { $('err').textContent = e.message; }
+}
+
+async function stop(id) { try { await call('POST', 'recordings/stop?rid=' + id); } catch (e) { alert(e.message); } refresh(); }
+async function del(id) {
+  if (!confirm('Delete this recording and its file?')) return;
+  try { await call('DELETE', 'recordings?rid=' + id); } catch (e) { alert(e.message); }
+  refresh();
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>`
@@ -0,0 +1,319 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+	"github.com/CrazeeGhost/stalkerhek/proxy"
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+var (
+	rawMu       sync.RWMutex
+	rawChannels = map[int]map[string]*stalker.Channel{} // Channel lists as given by portal, before playlist rules
+)
+
+var errNotRunning = errors.New("profile is not running")
+
+// setRawChannels remembers channel list retrieved from profile's portal, so rules can be
+// previewed and re-applied without asking portal again
+func setRawChannels(id int, chs map[string]*stalker.Channel) {
+	rawMu.Lock()
+	rawChannels[id] = chs
+	rawMu.Unlock()
+}
+
+func getRawChannels(id int) map[string]*stalker.Channel {
+	rawMu.RLock()
+	defer rawMu.RUnlock()
+	return rawChannels[id]
+}
+
+// applyRules applies current playlist rules of a profile to its running services. Returns number of channels left.
+func applyRules(id int) (int, error) {
+	p, ok := GetProfile(id)
+	if !ok {
+		return 0, errors.New("profile not found")
+	}
+	rules, err := p.ruleSet()
+	if err != nil {
+		return 0, err
+	}
+	chs := rules.Apply(getRawChannels(id))
+	hlsOK := hls.UpdateChannels(id, chs)
+	proxyOK := proxy.UpdateChannels(id, chs) && proxy.SetRules(id, rules)
+	if !hlsOK && !proxyOK {
+		return 0, errNotRunning
+	}
+	SetProfileChannels(id, len(chs))
+	return len(chs), nil
+}
+
+// rulesPreview shows how playlist rules change profile's channel list
+type rulesPreview struct {
+	Total    int              `json:"total"`
+	Channels []previewChannel `json:"channels"`
+	Hidden   []string         `json:"hidden"`
+}
+
+type previewChannel struct {
+	Title    string `json:"title"`
+	Original string `json:"original"`
+	Group    string `json:"group"`
+	Number   int    `json:"number,omitempty"`
+}
+
+func previewRules(raw map[string]*stalker.Channel, rules *stalker.RuleSet) rulesPreview {
+	out := rulesPreview{Total: len(raw), Channels: []previewChannel{}, Hidden: []string{}}
+	applied := rules.Apply(raw)
+	kept := make(map[string]bool, len(applied))
+	for _, c := range applied {
+		kept[c.CMD] = true
+	}
+	original := make(map[string]string, len(raw)) // CMD -> original title
+	for _, c := range raw {
+		original[c.CMD] = c.Title
+		if !kept[c.CMD] {
+			out.Hidden = append(out.Hidden, c.Title)
+		}
+	}
+	for _, c := range applied {
+		out.Channels = append(out.Channels, previewChannel{Title: c.Title, Original: original[c.CMD], Group: c.Genre(), Number: c.Number})
+	}
+	sort.Slice(out.Channels, func(i, j int) bool {
+		a, b := applied[out.Channels[i].Title], applied[out.Channels[j].Title]
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.Title < b.Title
+	})
+	sort.Strings(out.Hidden)
+	return out
+}
+
+// decodeRules reads playlist rules from JSON request body and validates them
+func decodeRules(r *http.Request) (stalker.PlaylistRules, *stalker.RuleSet, error) {
+	var rules stalker.PlaylistRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		return rules, nil, err
+	}
+	rs, err := rules.Compile()
+	return rules, rs, err
+}
+
+func init() {
+	// GET returns profile's playlist rules, POST replaces them and applies them to running services
+	registerProfileAPI("rules", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		if r.Method != http.MethodPost {
+			rules := stalker.PlaylistRules{}
+			if p.Rules != nil {
+				rules = *p.Rules
+			}
+			writeJSON(w, rules)
+			return
+		}
+		rules, _, err := decodeRules(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		UpdateProfile(p.ID, func(p *Profile) {
+			if rules.IsZero() {
+				p.Rules = nil
+			} else {
+				p.Rules = &rules
+			}
+		})
+		_ = SaveProfiles()
+		resp := map[string]interface{}{"saved": true, "applied": false}
+		if n, err := applyRules(p.ID); err == nil {
+			resp["applied"], resp["channels"] = true, n
+		} else if err != errNotRunning {
+			resp["error"] = err.Error()
+		}
+		writeJSON(w, resp)
+	})
+
+	// POST with rules in body returns how they would change channel list, without saving them
+	registerProfileAPI("rules/preview", func(w http.ResponseWriter, r *http.Request, p Profile) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		_, rs, err := decodeRules(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		raw := getRawChannels(p.ID)
+		if raw == nil {
+			http.Error(w, "channel list is not known yet, verify or start the profile first", http.StatusConflict)
+			return
+		}
+		writeJSON(w, previewRules(raw, rs))
+	})
+}
+
+// RegisterRulesHandlers mounts playlist rules editor page
+func RegisterRulesHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := GetProfile(atoiSafe(r.URL.Query().Get("id")))
+		if !ok {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		t := template.Must(template.New("rules").Parse(rulesTpl))
+		_ = t.Execute(w, p)
+	})
+}
+
+const rulesTpl = `<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Playlist rules - {{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}}</title>
+  <style>
+    :root{--bg:#0a0f0a;--panel:#0d1410;--border:#1f2e23;--text:#e0e6e0;--muted:#9aaa9a;--brand:#2d7a4e;--brand-hover:#3a8f5e;--bad:#e85d4d}
+    *{box-sizing:border-box}
+    body{margin:0;font-family:system-ui,-apple-system,Segoe UI,Roboto,Ubuntu,Helvetica,Arial,sans-serif;background:linear-gradient(180deg, #0d1410 0%, #0a0f0a 100%);color:var(--text);min-height:100vh}
+    a{color:var(--brand);text-decoration:none} a:hover{color:var(--brand-hover);text-decoration:underline}
+    .wrap{max-width:1200px;margin:0 auto;padding:16px 12px 60px}
+    h1{margin:0 0 6px 0;font-size:26px}
+    .sub{color:var(--muted);font-size:14px;line-height:1.4;margin-bottom:16px}
+    .grid{display:grid;grid-template-columns:1fr;gap:16px}
+    @media(min-width:900px){.grid{grid-template-columns:1fr 1fr}}
+    .card{background:linear-gradient(180deg, rgba(17,24,21,.96), rgba(13,20,16,.94));border:1px solid var(--border);border-radius:16px;padding:20px;box-shadow:0 12px 32px rgba(0,0,0,.4)}
+    .card h2{margin:0 0 12px 0;font-size:18px}
+    label{display:block;font-size:13px;color:#c5d1c5;margin:12px 0 6px}
+    .hint{font-size:12px;color:var(--muted);margin-top:4px;line-height:1.4}
+    textarea{width:100%;padding:10px 12px;border-radius:12px;border:1px solid var(--border);background:#0f1612;color:var(--text);outline:none;font-size:14px;font-family:ui-monospace,monospace}
+    textarea:focus{border-color:var(--brand);box-shadow:0 0 0 3px rgba(45,122,78,.2)}
+    button{cursor:pointer;border:none;border-radius:12px;padding:12px 16px;font-size:15px;font-weight:650;background:var(--brand);color:white;margin-top:16px}
+    button:hover{background:var(--brand-hover)}
+    .err{color:var(--bad);font-size:13px;margin-top:8px;white-space:pre-wrap}
+    table{width:100%;border-collapse:collapse;font-size:13px}
+    th,td{text-align:left;padding:6px 8px;border-bottom:1px solid var(--border)}
+    th{color:var(--muted);font-weight:600}
+    .muted{color:var(--muted)}
+    .list{max-height:70vh;overflow:auto}
+  </style>
+</head>
+<body>
+  <div class="wrap">
+    <h1>Playlist rules</h1>
+    <div class="sub">{{if .Name}}{{.Name}}{{else}}Profile {{.ID}}{{end}} &middot; Rules apply to the M3U playlists, the proxy's channel lists and the EPG. <a href="/dashboard">Back to dashboard</a></div>
+
+    <div class="grid">
+      <div class="card">
+        <h2>Rules</h2>
+        <label><input type="checkbox" id="hide_adult" style="width:auto"> Hide adult channels and genres</label>
+
+        <label for="include">Include titles (regex, one per line)</label>
+        <textarea id="include" rows="2" placeholder="^(BBC|ITV)"></textarea>
+        <div class="hint">If set, only channels matching one of these are kept.</div>
+
+        <label for="exclude">Exclude titles (regex, one per line)</label>
+        <textarea id="exclude" rows="2" placeholder="(?i)\bTEST\b"></textarea>
+
+        <label for="include_genres">Include genres (one per line)</label>
+        <textarea id="include_genres" rows="2" placeholder="News"></textarea>
+
+        <label for="exclude_genres">Exclude genres (one per line)</label>
+        <textarea id="exclude_genres" rows="2" placeholder="Radio"></textarea>
+
+        <label for="rename">Rename (<code>regex =&gt; replacement</code>, one per line, applied in order)</label>
+        <textarea id="rename" rows="3" placeholder="^UK: (.*) =&gt; $1&#10;\s*(HD|FHD)$ =&gt; "></textarea>
+
+        <label for="groups">Groups (<code>genre =&gt; group</code>, one per line)</label>
+        <textarea id="groups" rows="2" placeholder="Sport =&gt; Sports"></textarea>
+
+        <label for="order">Pinned order (new titles, one per line)</label>
+        <textarea id="order" rows="3" placeholder="BBC One&#10;BBC Two"></textarea>
+
+        <label for="numbers">Channel numbers (<code>title = number</code>, one per line)</label>
+        <textarea id="numbers" rows="3" placeholder="BBC One = 1"></textarea>
+        <div class="hint">Order and numbers refer to titles after renaming. Channels without a pinned position follow in alphabetical order.</div>
+
+        <button id="save" type="button">Save rules</button>
+        <div id="status" class="hint"></div>
+        <div id="err" class="err"></div>
+      </div>
+
+      <div class="card">
+        <h2>Preview</h2>
+        <div id="summary" class="sub">Loading...</div>
+        <div class="list">
+          <table>
+            <thead><tr><th>#</th><th>Title</th><th>Group</th><th>Portal title</th></tr></thead>
+            <tbody id="preview"></tbody>
+          </table>
+          <div id="hidden" class="hint"></div>
+        </div>
+      </div>
+    </div>
+  </div>
+
+  <script>
+    const api = '/api/profiles/{{.ID}}/';
+    const lines = id => document.getElementById(id).value.split('\n').map(s=>s.trim()).filter(s=>s!=='');
+    const pairs = (id, sep) => lines(id).map(l=>{ const i=sep==='=' ? l.lastIndexOf(sep) : l.indexOf(sep); return i<0 ? [l, ''] : [l.slice(0,i).trim(), l.slice(i+sep.length).trim()]; });
+    const esc = s => String(s).replace(/&/g,'&amp;').replace(/</g,'&lt;');
+
+    function collect(){
+      const r = {hide_adult: document.getElementById('hide_adult').checked};
+      for(const k of ['include','exclude','include_genres','exclude_genres','order']){ const v=lines(k); if(v.length) r[k]=v; }
+      const rn = pairs('rename','=>').map(([match, replace])=>({match, replace}));
+      if(rn.length) r.rename = rn;
+      const g = {}; for(const [k,v] of pairs('groups','=>')) if(k && v) g[k]=v;
+      if(Object.keys(g).length) r.groups = g;
+      const n = {}; for(const [k,v] of pairs('numbers','=')) { const x=parseInt(v,10); if(k && x>0) n[k]=x; }
+      if(Object.keys(n).length) r.numbers = n;
+      return r;
+    }
+
+    function fill(r){
+      document.getElementById('hide_adult').checked = !!r.hide_adult;
+      for(const k of ['include','exclude','include_genres','exclude_genres','order']) document.getElementById(k).value = (r[k]||[]).join('\n');
+      document.getElementById('rename').value = (r.rename||[]).map(x=>x.match+' => '+x.replace).join('\n');
+      document.getElementById('groups').value = Object.entries(r.groups||{}).map(([k,v])=>k+' => '+v).join('\n');
+      document.getElementById('numbers').value = Object.entries(r.numbers||{}).sort((a,b)=>a[1]-b[1]).map(([k,v])=>k+' = '+v).join('\n');
+    }
+
+    async function preview(){
+      const err = document.getElementById('err');
+      try{
+        const resp = await fetch(api+'rules/preview', {method:'POST', body: JSON.stringify(collect())});
+        const text = await resp.text();
+        if(!resp.ok){ err.textContent = text; document.getElementById('summary').textContent = 'No preview'; return; }
+        err.textContent = '';
+        const p = JSON.parse(text);
+        document.getElementById('summary').textContent = p.channels.length+' of '+p.total+' channels shown, '+p.hidden.length+' hidden';
+        document.getElementById('preview').innerHTML = p.channels.map((c,i)=>
+          '<tr><td class="muted">'+(c.number||i+1)+'</td><td>'+esc(c.title)+'</td><td>'+esc(c.group)+'</td><td class="muted">'+(c.original!==c.title?esc(c.original):'')+'</td></tr>').join('');
+        document.getElementById('hidden').innerHTML = p.hidden.length ? '<b>Hidden:</b> '+p.hidden.map(esc).join(', ') : '';
+      }catch(e){ err.textContent = String(e); }
+    }
+
+    let timer;
+    document.querySelectorAll('textarea,input').forEach(el=>el.addEventListener('input', ()=>{ clearTimeout(timer); timer=setTimeout(preview, 300); }));
+
+    document.getElementById('save').addEventListener('click', async ()=>{
+      const status = document.getElementById('status');
+      const resp = await fetch(api+'rules', {method:'POST', body: JSON.stringify(collect())});
+      const text = await resp.text();
+      if(!resp.ok){ document.getElementById('err').textContent = text; return; }
+      const r = JSON.parse(text);
+      status.textContent = r.applied ? 'Saved and applied ('+r.channels+' channels).' : (r.error ? 'Saved, but not applied: '+r.error : 'Saved. Rules will be used when the profile starts.');
+    });
+
+    fetch(api+'rules', {cache:'no-store'}).then(r=>r.json()).then(r=>{ fill(r); preview(); });
+  </script>
+</body>
+</html>`
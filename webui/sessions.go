@@ -0,0 +1,69 @@
+package webui
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+	"github.com/CrazeeGhost/stalkerhek/proxy"
+)
+
+// sessionView is an active session with the name of its profile
+type sessionView struct {
+	hls.Session
+	Profile string `json:"profile"`
+}
+
+// listSessions returns sessions of HLS and proxy services of a profile (or all, if profileID is 0)
+func listSessions(profileID int) []sessionView {
+	all := hls.GetSessions(profileID)
+	for _, s := range proxy.GetSessions(profileID) {
+		all = append(all, hls.Session{
+			ID:        s.ID,
+			Source:    "proxy",
+			ProfileID: s.ProfileID,
+			Channel:   s.Channel,
+			ClientIP:  s.ClientIP,
+			UserAgent: s.UserAgent,
+			Started:   s.Started,
+			LastSeen:  s.LastSeen,
+		})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Started.Before(all[j].Started) })
+
+	out := make([]sessionView, 0, len(all))
+	for _, s := range all {
+		name := ""
+		if p, ok := GetProfile(s.ProfileID); ok {
+			name = p.Name
+		}
+		out = append(out, sessionView{Session: s, Profile: name})
+	}
+	return out
+}
+
+// RegisterSessionHandlers mounts /api/sessions (GET, optional ?profile=N) and
+// /api/sessions/kick (POST ?id=...)
+func RegisterSessionHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, listSessions(atoiSafe(r.URL.Query().Get("profile"))))
+	})
+
+	mux.HandleFunc("/api/sessions/kick", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if strings.HasPrefix(id, "proxy-") {
+			http.Error(w, "stream goes directly from portal to the STB and can't be kicked", http.StatusConflict)
+			return
+		}
+		if !hls.KickSession(id) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]bool{"kicked": true})
+	})
+}
@@ -11,6 +11,14 @@ import (
     "github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
+// listenerTLS makes the WebUI listen on HTTPS; set with SetTLS before starting it
+var listenerTLS stalker.ListenerTLS
+
+// SetTLS configures HTTPS of the WebUI listener.
+func SetTLS(o stalker.ListenerTLS) {
+    listenerTLS = o
+}
+
 type uiState struct {
     PortalURL string
     MAC       string
@@ -45,6 +53,27 @@ func StartWithContext(ctx context.Context, cfg *stalker.Config, ready chan struc
     // mount health/metrics/info endpoints
     RegisterHealthHandlers(mux)
 
+    // mount per-profile API endpoints (/api/profiles/{id}/...)
+    RegisterProfileAPIHandlers(mux)
+
+    // mount playlist rules editor
+    RegisterRulesHandlers(mux)
+
+    // mount logo pack report
+    RegisterLogoHandlers(mux)
+
+    // mount recordings page
+    RegisterRecordingHandlers(mux)
+
+    // mount aggregated playlist of all profiles
+    RegisterPlaylistHandlers(mux)
+
+    // mount active sessions API (now watching, kick)
+    RegisterSessionHandlers(mux)
+
+    // mount bandwidth accounting API
+    RegisterBandwidthHandlers(mux)
+
     // middleware to count requests/errors
     var handler http.Handler = mux
     handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -110,7 +139,7 @@ func StartWithContext(ctx context.Context, cfg *stalker.Config, ready chan struc
     }()
 
     go func() {
-        if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        if err := stalker.ListenAndServe(srv, listenerTLS); err != nil && err != http.ErrServerClosed {
             log.Printf("webui error: %v", err)
         }
     }()